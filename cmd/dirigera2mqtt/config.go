@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+)
+
+const configUsage = `Usage: dirigera2mqtt config <init|check> [options]
+
+  init    write a configuration file with the default values
+  check   validate the configuration and print the effective values
+`
+
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "init":
+		return runConfigInit(args[1:])
+	case "check":
+		return runConfigCheck(args[1:])
+	}
+	fmt.Fprint(os.Stderr, configUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runConfigInit(args []string) error {
+	fs := flag.NewFlagSet("config init", flag.ExitOnError)
+	format := fs.String("format", config.Formats[0], "file format: "+strings.Join(config.Formats, ", "))
+	out := fs.String("o", "", "output file (default app.<format>)")
+	force := fs.Bool("force", false, "overwrite an existing file")
+	_ = fs.Parse(args)
+
+	content, err := config.Encode(config.DefaultConfig(), *format)
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = config.FileName + "." + *format
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("default configuration written to %s\n", path)
+	return nil
+}
+
+func runConfigCheck(args []string) error {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", "./", "configuration file or directory containing app.env, app.yaml or app.toml")
+	format := fs.String("format", config.Formats[0], "output format: "+strings.Join(config.Formats, ", "))
+	config.RegisterFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath, fs)
+	if err != nil {
+		return err
+	}
+	content, err := config.Encode(cfg, *format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
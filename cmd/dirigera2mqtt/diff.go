@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+)
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	basePath := fs.String("base", "", "base firmware image (required)")
+	in := fs.String("in", "", "image to compare with the base (required)")
+	offset := fs.Int("offset", config.DefaultAppOffset, "offset of the application image")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	_ = fs.Parse(args)
+
+	if *basePath == "" || *in == "" {
+		fs.Usage()
+		return errors.New("diff: -base and -in are required")
+	}
+	base, err := os.ReadFile(*basePath)
+	if err != nil {
+		return err
+	}
+	image, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+
+	report, err := service.DiffFirmware(base, image, *offset)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+
+	if *jsonOutput {
+		err = printJSON(report)
+	} else {
+		for _, r := range report.Ranges {
+			label := r.Region
+			if r.Slot != "" {
+				label += " " + r.Slot
+			}
+			segment := "-"
+			if r.Segment >= 0 {
+				segment = fmt.Sprintf("%d", r.Segment)
+			}
+			marker := ""
+			if !r.Expected {
+				marker = "  <-- UNEXPECTED"
+			}
+			fmt.Printf("0x%06X-0x%06X %6d bytes  segment %s  %s%s\n", r.Start, r.End, r.End-r.Start, segment, label, marker)
+		}
+		fmt.Printf("%d differing ranges, %d unexpected\n", len(report.Ranges), report.Unexpected)
+	}
+	if err != nil {
+		return err
+	}
+	if report.Unexpected > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
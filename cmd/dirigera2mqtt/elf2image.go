@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+)
+
+// convertELF converts an ELF file like `esptool.py elf2image` and writes the
+// flash parameters of params into the header
+func convertELF(file string, opts esp.ELFOptions, params esp.FlashParams) ([]byte, error) {
+	elfData, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	image, err := esp.ELFToImage(elfData, opts)
+	if err == nil {
+		err = esp.SetFlashParams(image, params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return image, nil
+}
+
+func runELF2Image(args []string) error {
+	fs := flag.NewFlagSet("elf2image", flag.ExitOnError)
+	in := fs.String("in", "", "ESP32-C6 ELF file (required)")
+	out := fs.String("o", "", "output file for the image (required)")
+	minRev := fs.Uint("min-rev-full", 0, "minimum chip revision as major*100+minor")
+	maxRev := fs.Uint("max-rev-full", 0xFFFF, "maximum chip revision as major*100+minor")
+	elfSHA256Offset := fs.Int("elf-sha256-offset", 0, fmt.Sprintf("image offset to store the ELF SHA-256 at, 0x%x for ESP-IDF apps", esp.AppELFSHA256Offset))
+	noHash := fs.Bool("no-hash", false, "do not append the SHA-256 of the image")
+	var params esp.FlashParams
+	fs.StringVar(&params.Mode, "flash-mode", "qio", "flash mode (qio, qout, dio, dout)")
+	fs.StringVar(&params.Size, "flash-size", "1MB", "flash size (e.g. 4MB)")
+	fs.StringVar(&params.Freq, "flash-freq", "80m", "flash frequency (80m, 40m, 20m)")
+	_ = fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fs.Usage()
+		return errors.New("elf2image: -in and -o are required")
+	}
+	if *minRev > 0xFFFF || *maxRev > 0xFFFF {
+		return errors.New("elf2image: chip revisions must not exceed 65535")
+	}
+	image, err := convertELF(*in, esp.ELFOptions{
+		MinChipRev:      uint8(*minRev / 100),
+		MinChipRevFull:  uint16(*minRev),
+		MaxChipRevFull:  uint16(*maxRev),
+		ELFSHA256Offset: *elfSHA256Offset,
+		OmitHash:        *noHash,
+	}, params)
+	if err != nil {
+		return fmt.Errorf("elf2image: %w", err)
+	}
+	if err = os.WriteFile(*out, image, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%d bytes)\n", *out, len(image))
+	return nil
+}
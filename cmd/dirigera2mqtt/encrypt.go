@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+func runEncrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	in := fs.String("in", "", "merged image, or a single part with -address (required)")
+	out := fs.String("o", "", "output file (required)")
+	keyFile := fs.String("key", "", "raw 32 byte XTS-AES-128 flash encryption key (required)")
+	decrypt := fs.Bool("decrypt", false, "decrypt a pre-encrypted image or flash dump instead")
+	address := fs.Int("address", -1, "flash address of a single part; by default the whole merged image is processed")
+	tableOffset := fs.Int("partition-table-offset", partition.DefaultOffset, "offset of the partition table")
+	_ = fs.Parse(args)
+
+	if *in == "" || *out == "" || *keyFile == "" {
+		fs.Usage()
+		return errors.New("encrypt: -in, -o and -key are required")
+	}
+	image, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	var result []byte
+	var regions []flashcrypt.Region
+	if *address >= 0 {
+		if *decrypt {
+			result, err = flashcrypt.Decrypt(key, uint32(*address), image)
+		} else {
+			result, err = flashcrypt.Encrypt(key, uint32(*address), image)
+		}
+		regions = []flashcrypt.Region{{Name: *in, Offset: *address, Size: len(image)}}
+	} else if *decrypt {
+		result, regions, err = flashcrypt.DecryptImage(image, key, flashcrypt.Options{PartitionTableOffset: *tableOffset})
+	} else {
+		result, regions, err = flashcrypt.EncryptImage(image, key, flashcrypt.Options{PartitionTableOffset: *tableOffset})
+	}
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	if err = os.WriteFile(*out, result, 0o644); err != nil {
+		return err
+	}
+	for _, region := range regions {
+		fmt.Printf("0x%06x-0x%06x %s\n", region.Offset, region.Offset+region.Size, region.Name)
+	}
+	fmt.Printf("wrote %s (%d bytes, %s)\n", *out, len(result), map[bool]string{true: "decrypted", false: "encrypted"}[*decrypt])
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flasher"
+	"github.com/rddl-network/dirigera2mqtt/service"
+)
+
+func runFlash(args []string) error {
+	fs := flag.NewFlagSet("flash", flag.ExitOnError)
+	portName := fs.String("port", "", "serial port of the bridge, e.g. /dev/ttyUSB0 (required)")
+	baud := fs.Int("baud", 115200, "baud rate used to connect to the ROM loader")
+	flashBaud := fs.Int("flash-baud", 460800, "baud rate used while flashing, 0 keeps -baud")
+	in := fs.String("in", "", "merged base firmware image (required)")
+	offset := fs.Int("offset", config.DefaultAppOffset, "offset of the application image")
+	noCompress := fs.Bool("no-compress", false, "transfer the image uncompressed")
+	noReset := fs.Bool("no-reset", false, "do not reset the chip into download mode via DTR/RTS")
+	noReboot := fs.Bool("no-reboot", false, "stay in the ROM loader after flashing")
+	minSecureVersion := fs.Uint("min-secure-version", 0, "refuse apps with a lower secure_version")
+	var req service.FirmwareRequest
+	readPEMFiles := addRequestFlags(fs, &req)
+	_ = fs.Parse(args)
+
+	if *portName == "" || *in == "" {
+		fs.Usage()
+		return errors.New("flash: -port and -in are required")
+	}
+	if err := readPEMFiles(); err != nil {
+		return err
+	}
+
+	image, err := readAndPatch(*in, *offset, &req)
+	if err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	plain, err := decryptedImage(image, &req)
+	if err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	app, err := esp.ParseImage(plain[*offset:])
+	if err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	// without the descriptor the anti-rollback check cannot be made
+	if app.AppDesc == nil {
+		return fmt.Errorf("flash: the app at 0x%x has no app descriptor", *offset)
+	}
+	if app.AppDesc.SecureVersion < uint32(*minSecureVersion) {
+		return fmt.Errorf("flash: secure_version %d of the app is below the minimum %d", app.AppDesc.SecureVersion, *minSecureVersion)
+	}
+	if app.Chip == nil {
+		return fmt.Errorf("flash: unknown chip ID 0x%04x in the app header", app.Header.ChipID)
+	}
+	bootloader, err := esp.ParseImage(plain[app.Chip.BootloaderOffset:])
+	if err != nil {
+		return fmt.Errorf("flash: %s has no bootloader at 0x%x: %w", *in, app.Chip.BootloaderOffset, err)
+	}
+	opts := flasher.Options{
+		Chip:      app.Chip.Name,
+		FlashSize: esp.FlashSizeBytes(bootloader.Header.SpiSpeedSize),
+		Compress:  !*noCompress,
+		Reboot:    !*noReboot,
+		Progress: func(written int, total int) {
+			fmt.Printf("\rwriting %d/%d blocks", written, total)
+		},
+	}
+	// the revision of the connected chip is read from its eFuses
+	if app.Chip.RevisionEFuse != nil {
+		revisions, err := service.ChipRevisions(plain, *offset)
+		if err != nil {
+			return fmt.Errorf("flash: %w", err)
+		}
+		opts.ChipRevisions = &revisions
+	} else {
+		fmt.Fprintf(os.Stderr, "flash: reading the chip revision of a %s is not supported, skipping the revision check\n", app.Chip.Name)
+	}
+
+	port, err := flasher.OpenPort(*portName, *baud)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	if !*noReset {
+		if err = port.ResetIntoBootloader(); err != nil {
+			return fmt.Errorf("flash: reset into download mode failed: %w", err)
+		}
+	}
+
+	loader := flasher.NewLoader(port)
+	if err = loader.Sync(10); err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	if *flashBaud != 0 && *flashBaud != *baud {
+		if err = loader.ChangeBaudrate(uint32(*flashBaud)); err != nil {
+			return fmt.Errorf("flash: %w", err)
+		}
+		if err = port.SetBaudrate(*flashBaud); err != nil {
+			return err
+		}
+	}
+
+	chip, err := flasher.Flash(loader, image, opts)
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	if !*noReboot && !*noReset {
+		_ = port.HardReset()
+	}
+	fmt.Fprintf(os.Stdout, "flashed %d bytes to %s on %s and verified the MD5\n", len(image), chip, *portName)
+	return nil
+}
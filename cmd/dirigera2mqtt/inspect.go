@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"github.com/rddl-network/dirigera2mqtt/service"
+)
+
+type inspectResult struct {
+	Offset   int                 `json:"offset"`
+	Header   esp.ImageHeader     `json:"header"`
+	Chip     *esp.Chip           `json:"chip,omitempty"`
+	Segments []esp.Segment       `json:"segments"`
+	AppDesc  *esp.AppDesc        `json:"app_desc,omitempty"`
+	Boot     *partition.Entry    `json:"boot,omitempty"`
+	Slots    []service.SlotValue `json:"slots"`
+	Valid    bool                `json:"valid"`
+}
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	in := fs.String("in", "", "firmware image (required)")
+	offset := fs.Int("offset", config.DefaultAppOffset, "offset of the image to inspect")
+	basePath := fs.String("base", "", "base firmware the image was built from; reads back the provisioned slots")
+	reveal := fs.Bool("reveal", false, "show secret slot values instead of masking them")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	_ = fs.Parse(args)
+
+	if *in == "" {
+		fs.Usage()
+		return errors.New("inspect: -in is required")
+	}
+	firmware, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	if *offset < 0 || *offset >= len(firmware) {
+		return fmt.Errorf("inspect: offset 0x%x is outside of %s", *offset, *in)
+	}
+	image := firmware[*offset:]
+	img, err := esp.ParseImage(image)
+	if err != nil {
+		return fmt.Errorf("inspect: %w", err)
+	}
+
+	result := inspectResult{
+		Offset:   *offset,
+		Header:   img.Header,
+		Segments: img.Segments,
+		AppDesc:  img.AppDesc,
+		Chip:     img.Chip,
+		Slots:    []service.SlotValue{},
+		Valid:    img.Valid(),
+	}
+	if boot, err := otadata.BootPartitionOf(firmware, partition.DefaultOffset); err == nil {
+		result.Boot = &boot
+	}
+	if *basePath != "" {
+		base, err := os.ReadFile(*basePath)
+		if err != nil {
+			return err
+		}
+		report, err := service.InspectFirmware(base, firmware, *offset, *reveal)
+		if err != nil {
+			return fmt.Errorf("inspect: %w", err)
+		}
+		result.Slots = report.Slots
+	} else {
+		for _, location := range service.FindSlots(image[:img.Length]) {
+			result.Slots = append(result.Slots, service.SlotValue{
+				Name:   location.Slot.Name,
+				Offset: *offset + location.Offset,
+				Size:   location.Slot.Size(),
+			})
+		}
+	}
+
+	if *jsonOutput {
+		return printJSON(result)
+	}
+	printInspectResult(&result)
+	return nil
+}
+
+func printInspectResult(result *inspectResult) {
+	header := result.Header
+	fmt.Printf("Image at 0x%06x (%s)\n\n", result.Offset, map[bool]string{true: "valid", false: "INVALID"}[result.Valid])
+	fmt.Printf("Header:\n")
+	fmt.Printf("  Chip ID:       0x%04X", header.ChipID)
+	if result.Chip != nil {
+		fmt.Printf(" (%s)", result.Chip.Name)
+	}
+	fmt.Printf("\n")
+	fmt.Printf("  Entry Point:   0x%08X\n", header.EntryAddr)
+	fmt.Printf("  SPI Mode:      %d\n", header.SpiMode)
+	fmt.Printf("  Flash Params:  0x%02X\n", header.SpiSpeedSize)
+	fmt.Printf("  Chip Revision: %s\n", header.ChipRevisions())
+	fmt.Printf("  Hash Appended: %t\n\n", header.HashAppend == 1)
+
+	fmt.Printf("Segments:\n")
+	for i, seg := range result.Segments {
+		fmt.Printf("  Segment %d:     Load: 0x%08X, Size: %d bytes, Offset: 0x%06X", i, seg.LoadAddr, seg.DataLen, seg.Offset)
+		if len(seg.Types) > 0 {
+			fmt.Printf(", Type: %s", strings.Join(seg.Types, "/"))
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("\n")
+
+	if desc := result.AppDesc; desc != nil {
+		fmt.Printf("App Descriptor:\n")
+		fmt.Printf("  Project:        %s\n", desc.ProjectName)
+		fmt.Printf("  Version:        %s\n", desc.Version)
+		fmt.Printf("  Secure Version: %d\n", desc.SecureVersion)
+		fmt.Printf("  Compiled:       %s %s\n", desc.Date, desc.Time)
+		fmt.Printf("  IDF Version:    %s\n", desc.IDFVersion)
+		fmt.Printf("  ELF SHA-256:    %s\n\n", desc.ELFSHA256)
+	}
+
+	if boot := result.Boot; boot != nil {
+		fmt.Printf("Boot:\n")
+		fmt.Printf("  Slot:           %s\n", otadata.SlotName(*boot))
+		fmt.Printf("  Partition:      %s at 0x%06X\n\n", boot.Label, boot.Offset)
+	}
+
+	fmt.Printf("Placeholder Slots:\n")
+	if len(result.Slots) == 0 {
+		fmt.Printf("  none found\n")
+	}
+	for _, slot := range result.Slots {
+		fmt.Printf("  %-15s Offset: 0x%06X, Size: %d bytes", slot.Name, slot.Offset, slot.Size)
+		if slot.Provisioned {
+			fmt.Printf(", Value: %q", slot.Value)
+		}
+		fmt.Printf("\n")
+	}
+}
@@ -1,69 +1,98 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"html/template"
-	"log"
 	"os"
 
 	"github.com/rddl-network/dirigera2mqtt/config"
 	"github.com/rddl-network/dirigera2mqtt/service"
-	"github.com/spf13/viper"
 )
 
-func loadConfig(path string) (cfg *config.Config, err error) {
-	v := viper.New()
-	v.AddConfigPath(path)
-	v.SetConfigName("app")
-	v.SetConfigType("env")
-	v.AutomaticEnv()
+const usage = `Usage: dirigera2mqtt <command> [options]
 
-	err = v.ReadInConfig()
-	if err == nil {
-		cfg = config.GetConfig()
-		cfg.ServiceBind = v.GetString("SERVICE_BIND")
-		cfg.ServicePort = v.GetInt("SERVICE_PORT")
-		cfg.FirmwareESP32C6 = v.GetString("FIRMWARE_ESP32C6")
-		cfg.LogLevel = v.GetString("LOG_LEVEL")
-		return
-	}
-	log.Println("no config file found")
+Commands:
+  serve     start the firmware web service (default)
+  config    create or check the configuration file
+  patch     patch a firmware image offline
+  verify    verify checksums and hashes of firmware images or a whole merged image
+  inspect   show header, segments, app descriptor and placeholder slots
+  diff      compare an image with its base firmware segment by segment
+  merge     assemble bootloader, partition table, otadata and app images
+  partition convert partition tables between ESP-IDF CSV and binary
+  elf2image convert an ESP32-C6 ELF file into a flashable image
+  encrypt   encrypt or decrypt images for flash encryption in development mode
+  flash     patch a firmware image and write it to a bridge via serial
 
-	tmpl := template.New("appConfigFileTemplate")
-	configTemplate, err := tmpl.Parse(config.DefaultConfigTemplate)
-	if err != nil {
-		return
-	}
+Run 'dirigera2mqtt <command> -h' for the options of a command.
+`
 
-	var buffer bytes.Buffer
-	if err = configTemplate.Execute(&buffer, config.GetConfig()); err != nil {
-		return
+func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
 
-	if err = v.ReadConfig(&buffer); err != nil {
-		return
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "config":
+		err = runConfig(args)
+	case "patch":
+		err = runPatch(args)
+	case "verify":
+		err = runVerify(args)
+	case "inspect":
+		err = runInspect(args)
+	case "diff":
+		err = runDiff(args)
+	case "merge":
+		err = runMerge(args)
+	case "partition":
+		err = runPartition(args)
+	case "encrypt":
+		err = runEncrypt(args)
+	case "elf2image":
+		err = runELF2Image(args)
+	case "flash":
+		err = runFlash(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
-	if err = v.SafeWriteConfig(); err != nil {
-		return
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	log.Println("default config file created. please adapt it and restart the application. exiting...")
-	os.Exit(0)
-	return
 }
 
-func main() {
-	cfg, err := loadConfig("./")
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "./", "configuration file or directory containing app.env, app.yaml or app.toml")
+	config.RegisterFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath, fs)
 	if err != nil {
-		log.Fatalf("fatal error reading the configuration %s", err)
+		return fmt.Errorf("serve: reading the configuration:\n%w", err)
 	}
 
 	fmt.Println("Web Service mode")
 
-	Dirigera2MQTTService := service.NewTrustAnchorAttestationService(cfg)
-	err = Dirigera2MQTTService.Run()
+	Dirigera2MQTTService, err := service.NewTrustAnchorAttestationService(cfg)
 	if err != nil {
-		fmt.Print(err.Error())
+		return err
 	}
+	return Dirigera2MQTTService.Run()
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/merge"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("o", "", "output file for the merged image (required)")
+	tableOffset := fs.Uint("partition-table-offset", partition.DefaultOffset, "offset of the partition table")
+	bootSlot := fs.String("boot-slot", "", "generate otadata booting factory or ota_<n> instead of merging an otadata file")
+	chipName := fs.String("chip", "auto", "chip family placing the bootloader, auto takes it from the header of the first file")
+	var params esp.FlashParams
+	fs.StringVar(&params.Mode, "flash-mode", "keep", "flash mode written to the bootloader header (qio, qout, dio, dout)")
+	fs.StringVar(&params.Size, "flash-size", "keep", "flash size written to the bootloader header (e.g. 4MB)")
+	fs.StringVar(&params.Freq, "flash-freq", "keep", "flash frequency written to the bootloader header (80m, 40m, 20m)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: dirigera2mqtt merge -o <out> [options] <offset> <file> [<offset> <file> ...]\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	files := fs.Args()
+	if *out == "" || len(files) == 0 || len(files)%2 != 0 {
+		fs.Usage()
+		return errors.New("merge: -o and pairs of <offset> <file> are required")
+	}
+
+	var chip *esp.Chip
+	if *chipName != "auto" {
+		if chip = esp.ChipByName(*chipName); chip == nil {
+			return fmt.Errorf("merge: unknown chip %q", *chipName)
+		}
+	}
+
+	var parts []merge.Part
+	var elf string
+	for i := 0; i < len(files); i += 2 {
+		offset, err := strconv.ParseUint(files[i], 0, 32)
+		if err != nil {
+			return fmt.Errorf("merge: invalid offset %q: %w", files[i], err)
+		}
+		var data []byte
+		switch strings.ToLower(filepath.Ext(files[i+1])) {
+		case ".csv":
+			// CSV partition tables are converted like by gen_esp32part.py
+			table, err := readPartitionTable(files[i+1], uint32(offset))
+			if err == nil {
+				data, err = table.Binary()
+			}
+			if err != nil {
+				return fmt.Errorf("merge: %w", err)
+			}
+		case ".elf":
+			// ELF files can only be converted to ESP32-C6 images, ESP-IDF
+			// writes the flash parameters into their app header as well
+			if chip != nil && chip != esp.ESP32C6 {
+				return fmt.Errorf("merge: %s: ELF files are only supported for the %s, not the %s", files[i+1], esp.ESP32C6.Name, chip.Name)
+			}
+			elf = files[i+1]
+			opts := esp.ELFOptions{ELFSHA256Offset: esp.AppELFSHA256Offset}
+			if offset == uint64(esp.ESP32C6.BootloaderOffset) {
+				opts.ELFSHA256Offset = 0
+			}
+			if data, err = convertELF(files[i+1], opts, params); err != nil {
+				return fmt.Errorf("merge: %w", err)
+			}
+		default:
+			if data, err = os.ReadFile(files[i+1]); err != nil {
+				return err
+			}
+		}
+		parts = append(parts, merge.Part{Offset: uint32(offset), Name: files[i+1], Data: data})
+	}
+	if elf != "" && chip == nil {
+		// the chip family merge takes from the first part
+		if img, err := esp.ParseImage(parts[0].Data); err == nil && img.Chip != nil && img.Chip != esp.ESP32C6 {
+			return fmt.Errorf("merge: %s: ELF files are only supported for the %s, %s is a %s image", elf, esp.ESP32C6.Name, parts[0].Name, img.Chip.Name)
+		}
+	}
+
+	merged, err := merge.Merge(parts, merge.Options{Flash: params, PartitionTableOffset: uint32(*tableOffset), BootSlot: *bootSlot, Chip: chip})
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	if err = os.WriteFile(*out, merged, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%d bytes)\n", *out, len(merged))
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// readPartitionTable reads a CSV or binary partition table, telling them apart
+// by the file extension
+func readPartitionTable(file string, tableOffset uint32) (*partition.Table, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var table *partition.Table
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		table, err = partition.ParseCSV(bytes.NewReader(data), tableOffset)
+	} else {
+		table, err = partition.ParseBinary(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if err = table.Validate(tableOffset); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return table, nil
+}
+
+func runPartition(args []string) error {
+	fs := flag.NewFlagSet("partition", flag.ExitOnError)
+	in := fs.String("in", "", "CSV (.csv) or binary partition table (required)")
+	out := fs.String("o", "", "output file, binary unless it ends in .csv (default: print the CSV)")
+	tableOffset := fs.Uint("partition-table-offset", partition.DefaultOffset, "offset of the partition table")
+	_ = fs.Parse(args)
+
+	if *in == "" {
+		fs.Usage()
+		return errors.New("partition: -in is required")
+	}
+	table, err := readPartitionTable(*in, uint32(*tableOffset))
+	if err != nil {
+		return fmt.Errorf("partition: %w", err)
+	}
+	if *out == "" {
+		fmt.Print(table.CSV())
+		return nil
+	}
+	output := []byte(table.CSV())
+	if !strings.EqualFold(filepath.Ext(*out), ".csv") {
+		if output, err = table.Binary(); err != nil {
+			return fmt.Errorf("partition: %w", err)
+		}
+	}
+	if err = os.WriteFile(*out, output, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%d partitions)\n", *out, len(table.Entries))
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/rddl-network/dirigera2mqtt/service"
+)
+
+type patchResult struct {
+	In       string `json:"in"`
+	Out      string `json:"out"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+	SHA256   string `json:"sha256"`
+	// Encrypted images are written through the flash encryption
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// addRequestFlags registers the firmware request fields on fs. The returned
+// function reads the referenced PEM and key files after parsing.
+func addRequestFlags(fs *flag.FlagSet, req *service.FirmwareRequest) func() error {
+	caCert := fs.String("ca-cert", "", "PEM file with the MQTT broker CA certificate(s)")
+	clientCert := fs.String("client-cert", "", "PEM file with the client certificate chain")
+	clientKey := fs.String("client-key", "", "PEM file with the client key")
+	flashEncryptionKey := fs.String("flash-encryption-key", "", "raw XTS-AES-128 key file; writes the image pre-encrypted for flash encryption")
+	fs.StringVar(&req.SSID, "ssid", "", "WiFi SSID")
+	fs.StringVar(&req.PWD, "pwd", "", "WiFi password")
+	fs.StringVar(&req.LiquidAddress, "liquid-address", "", "Liquid address")
+	fs.StringVar(&req.DirAuthToken, "dir-auth-token", "", "Dirigera access token")
+	fs.StringVar(&req.DirURI, "dir-uri", "", "Dirigera URI")
+	fs.StringVar(&req.BootSlot, "boot-slot", "", "app partition to boot, factory or ota_<n> (default: keep the otadata)")
+	fs.StringVar(&req.ChipRevision, "chip-revision", "", "revision of the target chip, e.g. v0.1; refuses images that cannot run on it")
+
+	return func() error {
+		for _, pem := range []struct {
+			file  string
+			value *string
+		}{{*caCert, &req.CACert}, {*clientCert, &req.ClientCert}, {*clientKey, &req.ClientKey}} {
+			if pem.file == "" {
+				continue
+			}
+			content, err := os.ReadFile(pem.file)
+			if err != nil {
+				return err
+			}
+			*pem.value = string(content)
+		}
+		if *flashEncryptionKey != "" {
+			key, err := os.ReadFile(*flashEncryptionKey)
+			if err != nil {
+				return err
+			}
+			req.FlashEncryptionKey = hex.EncodeToString(key)
+		}
+		return nil
+	}
+}
+
+// readAndPatch reads the base image in, verifies the application image at
+// offset and patches it with req.
+func readAndPatch(in string, offset int, req *service.FirmwareRequest) ([]byte, error) {
+	firmware, err := os.ReadFile(in)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > len(firmware) {
+		return nil, fmt.Errorf("offset 0x%x is outside of %s", offset, in)
+	}
+	img, err := esp.ParseImage(firmware[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", in, err)
+	}
+	if !img.Valid() {
+		return nil, fmt.Errorf("integrity check of %s failed", in)
+	}
+	if req.ChipRevision != "" {
+		revisions, err := service.ChipRevisions(firmware, offset)
+		if err == nil {
+			err = req.CheckChipRevision(revisions)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", in, err)
+		}
+	}
+	return service.BuildFirmware(firmware, req, offset)
+}
+
+// decryptedImage returns the plaintext of an image patched with req
+func decryptedImage(patched []byte, req *service.FirmwareRequest) ([]byte, error) {
+	if req.FlashEncryptionKey == "" {
+		return patched, nil
+	}
+	key, err := hex.DecodeString(req.FlashEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := flashcrypt.DecryptImage(patched, key, flashcrypt.Options{})
+	return plain, err
+}
+
+func runPatch(args []string) error {
+	fs := flag.NewFlagSet("patch", flag.ExitOnError)
+	in := fs.String("in", "", "base firmware image (required)")
+	out := fs.String("out", "", "output file for the patched image (required)")
+	offset := fs.Int("offset", config.DefaultAppOffset, "offset of the application image")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	var req service.FirmwareRequest
+	readPEMFiles := addRequestFlags(fs, &req)
+	_ = fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fs.Usage()
+		return errors.New("patch: -in and -out are required")
+	}
+	if err := readPEMFiles(); err != nil {
+		return err
+	}
+
+	patched, err := readAndPatch(*in, *offset, &req)
+	if err != nil {
+		return fmt.Errorf("patch: %w", err)
+	}
+	if err = os.WriteFile(*out, patched, 0o644); err != nil {
+		return err
+	}
+
+	plain, err := decryptedImage(patched, &req)
+	if err != nil {
+		return fmt.Errorf("patch: %w", err)
+	}
+	img, err := esp.ParseImage(plain[*offset:])
+	if err != nil {
+		return fmt.Errorf("patch: %w", err)
+	}
+	sum := sha256.Sum256(patched)
+	result := patchResult{
+		In:        *in,
+		Out:       *out,
+		Size:      len(patched),
+		Checksum:  fmt.Sprintf("%02x", img.StoredChecksum),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Encrypted: req.FlashEncryptionKey != "",
+	}
+	if *jsonOutput {
+		return printJSON(result)
+	}
+	fmt.Printf("patched %s -> %s (%d bytes, checksum %s, sha256 %s", result.In, result.Out, result.Size, result.Checksum, result.SHA256)
+	if result.Encrypted {
+		fmt.Printf(", encrypted")
+	}
+	fmt.Printf(")\n")
+	return nil
+}
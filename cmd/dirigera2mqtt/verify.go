@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/integrity"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+)
+
+// offsetList is a flag value holding comma separated image offsets
+type offsetList []int
+
+func (o *offsetList) String() string {
+	parts := make([]string, len(*o))
+	for i, offset := range *o {
+		parts[i] = fmt.Sprintf("0x%x", offset)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o *offsetList) Set(value string) error {
+	*o = nil
+	for _, part := range strings.Split(value, ",") {
+		offset, err := strconv.ParseInt(strings.TrimSpace(part), 0, 64)
+		if err != nil {
+			return err
+		}
+		*o = append(*o, int(offset))
+	}
+	return nil
+}
+
+type verifyResult struct {
+	Offset           int    `json:"offset"`
+	Error            string `json:"error,omitempty"`
+	StoredChecksum   string `json:"stored_checksum,omitempty"`
+	ComputedChecksum string `json:"computed_checksum,omitempty"`
+	ChecksumValid    bool   `json:"checksum_valid"`
+	HashAppended     bool   `json:"hash_appended"`
+	HashValid        bool   `json:"hash_valid"`
+	// Signatures are the Secure Boot V2 signature blocks of signed images
+	Signatures     []esp.Signature `json:"signatures,omitempty"`
+	SignatureError string          `json:"signature_error,omitempty"`
+	Valid          bool            `json:"valid"`
+}
+
+func verifyImage(firmware []byte, offset int) verifyResult {
+	result := verifyResult{Offset: offset}
+	if offset < 0 || offset >= len(firmware) {
+		result.Error = "offset outside of file"
+		return result
+	}
+	img, err := esp.ParseImage(firmware[offset:])
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.StoredChecksum = fmt.Sprintf("%02x", img.StoredChecksum)
+	result.ComputedChecksum = fmt.Sprintf("%02x", img.ComputedChecksum)
+	result.ChecksumValid = img.ChecksumValid()
+	result.HashAppended = img.HashAppended
+	result.HashValid = img.HashValid()
+	result.Valid = img.Valid()
+	result.Signatures, err = esp.ParseSignatures(firmware[offset:], img.Length)
+	if err != nil {
+		result.SignatureError = err.Error()
+		result.Valid = false
+	}
+	for _, signature := range result.Signatures {
+		result.Valid = result.Valid && signature.Valid()
+	}
+	return result
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	in := fs.String("in", "", "firmware image (required)")
+	offsets := offsetList{0x0, config.DefaultAppOffset}
+	fs.Var(&offsets, "offsets", "comma separated image offsets to verify")
+	merged := fs.Bool("merged", false, "verify every part of a merged image instead of single images")
+	minSecureVersion := fs.Uint("min-secure-version", 0, "with -merged, flag apps with a lower secure_version as rollbacks")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	_ = fs.Parse(args)
+
+	if *in == "" {
+		fs.Usage()
+		return errors.New("verify: -in is required")
+	}
+	firmware, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	if *merged {
+		opts := integrity.Options{MinSecureVersion: uint32(*minSecureVersion)}
+		if chip := esp.BootloaderChip(firmware); chip != nil {
+			opts.BootloaderOffset = chip.BootloaderOffset
+		}
+		return verifyMerged(firmware, opts, *jsonOutput)
+	}
+
+	valid := true
+	results := make([]verifyResult, 0, len(offsets))
+	for _, offset := range offsets {
+		result := verifyImage(firmware, offset)
+		valid = valid && result.Valid
+		results = append(results, result)
+	}
+
+	if *jsonOutput {
+		err = printJSON(results)
+	} else {
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Printf("0x%06x: ERROR %s\n", result.Offset, result.Error)
+				continue
+			}
+			fmt.Printf("0x%06x: checksum %s/%s %s, hash %s, signature %s, %s\n", result.Offset,
+				result.StoredChecksum, result.ComputedChecksum, okText(result.ChecksumValid),
+				hashText(result), signatureText(result), map[bool]string{true: "VALID", false: "INVALID"}[result.Valid])
+			for i, signature := range result.Signatures {
+				fmt.Printf("    block %d: %s, key digest %s, %s\n", i, signature.Scheme, signature.KeyDigest, okText(signature.Valid()))
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !valid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func verifyMerged(firmware []byte, opts integrity.Options, jsonOutput bool) error {
+	report := integrity.Verify(firmware, opts)
+	if jsonOutput {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, region := range report.Regions {
+			fmt.Printf("0x%06x-0x%06x %-15s %-12s %s\n", region.Offset, region.Offset+region.Size,
+				region.Kind, region.Name, regionText(region))
+			for _, err := range region.Errors {
+				fmt.Printf("    %s\n", err)
+			}
+		}
+		if report.Boot != nil {
+			fmt.Printf("boots %s (partition %q at 0x%x)\n", otadata.SlotName(*report.Boot), report.Boot.Label, report.Boot.Offset)
+		}
+		fmt.Println(map[bool]string{true: "VALID", false: "INVALID"}[report.Valid])
+	}
+	if !report.Valid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func regionText(region integrity.Region) string {
+	status := map[bool]string{true: "ok", false: "INVALID"}[region.Valid]
+	switch {
+	case region.Image != nil:
+		status += fmt.Sprintf(", %d bytes, %d segments, chip %s", region.Image.Length, region.Image.Segments, region.Image.ChipRevisions)
+		if region.Image.AppDesc != nil {
+			status += fmt.Sprintf(", %s %s", region.Image.AppDesc.ProjectName, region.Image.AppDesc.Version)
+		}
+		if n := len(region.Image.Signatures); n > 0 {
+			status += fmt.Sprintf(", %d signatures", n)
+		}
+	case region.Table != nil:
+		status += fmt.Sprintf(", %d partitions", len(region.Table.Entries))
+	case region.Empty:
+		status += ", erased"
+	}
+	return status
+}
+
+func okText(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "mismatch"
+}
+
+func hashText(result verifyResult) string {
+	if !result.HashAppended {
+		return "not appended"
+	}
+	return okText(result.HashValid)
+}
+
+func signatureText(result verifyResult) string {
+	switch {
+	case result.SignatureError != "":
+		return result.SignatureError
+	case len(result.Signatures) == 0:
+		return "none"
+	}
+	valid := true
+	for _, signature := range result.Signatures {
+		valid = valid && signature.Valid()
+	}
+	return fmt.Sprintf("%d blocks %s", len(result.Signatures), okText(valid))
+}
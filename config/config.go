@@ -1,24 +1,44 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rddl-network/go-utils/logger"
 )
 
-const DefaultConfigTemplate = `
-FIRMWARE_ESP32C6="{{ .FirmwareESP32C6 }}"
-SERVICE_BIND="{{ .ServiceBind }}"
-SERVICE_PORT={{ .ServicePort }}
-LOG_LEVEL="{{ .LogLevel }}"
-`
-
-// Config defines TA's top level configuration
+// Config defines TA's top level configuration. Every exported field is a
+// configuration key: the mapstructure tag is the key used in YAML and TOML
+// files and as command line flag, the upper case form with underscores is
+// used in env files and as environment variable.
 type Config struct {
-	FirmwareESP32C6 string `json:"firmware-esp32-c6"   mapstructure:"firmware-esp32-c6"`
-	ServiceBind     string `json:"service-bind"        mapstructure:"service-bind"`
-	ServicePort     int    `json:"service-port"        mapstructure:"service-port"`
-	LogLevel        string `json:"log-level"           mapstructure:"log-level"`
+	MCURegistry               string `json:"mcu-registry" mapstructure:"mcu-registry" desc:"YAML, TOML or JSON file listing the MCUs the service builds firmwares for, empty serves the ESP32-C6 of the *-esp32c6 keys"`
+	FirmwareESP32C6           string `json:"firmware-esp32c6" mapstructure:"firmware-esp32c6" desc:"path of the merged ESP32-C6 base firmware"`
+	AppELFESP32C6             string `json:"app-elf-esp32c6"  mapstructure:"app-elf-esp32c6"  desc:"ESP32-C6 app ELF replacing the app of the base firmware, empty keeps it"`
+	FlashEncryptionKeyESP32C6 string `json:"flash-encryption-key-esp32c6" mapstructure:"flash-encryption-key-esp32c6" desc:"raw 32 byte XTS-AES-128 key file encrypting ESP32-C6 builds that request encryption without a key of their own"`
+	SigningKeyESP32C6         string `json:"signing-key-esp32c6" mapstructure:"signing-key-esp32c6" desc:"PEM key re-signing patched ESP32-C6 apps for Secure Boot V2, empty leaves signatures as they are"`
+	MinSecureVersionESP32C6   int    `json:"min-secure-version-esp32c6" mapstructure:"min-secure-version-esp32c6" desc:"lowest secure_version of ESP32-C6 apps the service serves, older apps are refused as rollbacks"`
+	ServiceBind               string `json:"service-bind"     mapstructure:"service-bind"     desc:"address the web service binds to"`
+	ServicePort               int    `json:"service-port"     mapstructure:"service-port"     desc:"port of the web service"`
+	LogLevel                  string `json:"log-level"        mapstructure:"log-level"        desc:"log level: debug, info, warn or error"`
+	RegistryPath              string `json:"registry-path"    mapstructure:"registry-path"    desc:"bbolt database of provisioned devices, empty keeps devices in memory"`
+	ProfilesDir               string `json:"profiles-dir"     mapstructure:"profiles-dir"     desc:"directory of provisioning profiles, empty disables profiles"`
+	BuildCacheSize            int64  `json:"build-cache-size" mapstructure:"build-cache-size" desc:"memory in bytes for caching built firmwares, 0 disables the cache"`
+
+	ReadHeaderTimeout time.Duration `json:"read-header-timeout" mapstructure:"read-header-timeout" desc:"maximum time to read request headers"`
+	ReadTimeout       time.Duration `json:"read-timeout"        mapstructure:"read-timeout"        desc:"maximum time to read a request including its body"`
+	WriteTimeout      time.Duration `json:"write-timeout"       mapstructure:"write-timeout"       desc:"maximum time to build and write a response"`
+	IdleTimeout       time.Duration `json:"idle-timeout"        mapstructure:"idle-timeout"        desc:"maximum time a keep-alive connection stays idle"`
+	ShutdownTimeout   time.Duration `json:"shutdown-timeout"    mapstructure:"shutdown-timeout"    desc:"time in-flight requests get to finish on SIGINT or SIGTERM"`
+	MaxBodySize       int64         `json:"max-body-size"       mapstructure:"max-body-size"       desc:"maximum request body size in bytes"`
+
+	// registry holds the entries read from the mcu-registry file at path
+	registry struct {
+		path string
+		mcus []MCU
+	}
 }
 
 // global singleton
@@ -34,6 +54,16 @@ func DefaultConfig() *Config {
 		ServiceBind:     "localhost",
 		ServicePort:     8080,
 		LogLevel:        logger.DEBUG,
+		RegistryPath:    "./registry.db",
+		ProfilesDir:     "./profiles",
+		BuildCacheSize:  64 << 20,
+
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		MaxBodySize:       16 << 20,
 	}
 }
 
@@ -44,3 +74,49 @@ func GetConfig() *Config {
 	})
 	return config
 }
+
+// Validate reports every invalid value of the configuration
+func (c *Config) Validate() error {
+	var errs []error
+	if c.MCURegistry == "" && c.FirmwareESP32C6 == "" {
+		errs = append(errs, errors.New("firmware-esp32c6: must not be empty"))
+	}
+	if c.MCURegistry != "" {
+		if _, err := c.MCUs(); err != nil {
+			errs = append(errs, fmt.Errorf("mcu-registry: %w", err))
+		}
+	}
+	if c.MinSecureVersionESP32C6 < 0 {
+		errs = append(errs, fmt.Errorf("min-secure-version-esp32c6: %d must not be negative", c.MinSecureVersionESP32C6))
+	}
+	if c.ServicePort < 1 || c.ServicePort > 65535 {
+		errs = append(errs, fmt.Errorf("service-port: %d is not a valid port", c.ServicePort))
+	}
+	switch c.LogLevel {
+	case logger.DEBUG, logger.INFO, logger.WARN, logger.ERROR:
+	default:
+		errs = append(errs, fmt.Errorf("log-level: unknown level %q", c.LogLevel))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read-header-timeout", c.ReadHeaderTimeout},
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-timeout", c.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: %s must not be negative", d.name, d.value))
+		}
+	}
+	if c.BuildCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("build-cache-size: %d must not be negative", c.BuildCacheSize))
+	}
+	if c.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("max-body-size: %d must be positive", c.MaxBodySize))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte("service-port: 9000\nservice-bind: 0.0.0.0\nlog-level: info\n"), 0o600))
+	t.Setenv("SERVICE_PORT", "9100")
+	t.Setenv("LOG_LEVEL", "warn")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-log-level", "error"}))
+
+	cfg, err := config.Load(dir, fs)
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0", cfg.ServiceBind)
+	assert.Equal(t, 9100, cfg.ServicePort)
+	assert.Equal(t, "error", cfg.LogLevel)
+	assert.Equal(t, config.DefaultConfig().FirmwareESP32C6, cfg.FirmwareESP32C6)
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	require.NoError(t, os.WriteFile(path, []byte("SERVICE_PORT=http\nLOG_LEVEL=loud\nUNKNOWN_KEY=1\n"), 0o600))
+
+	_, err := config.Load(path, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown key "unknown_key"`)
+	assert.Contains(t, err.Error(), "service-port: invalid value http")
+	assert.Contains(t, err.Error(), `log-level: unknown level "loud"`)
+
+	_, err = config.Load(filepath.Join(t.TempDir(), "missing.toml"), nil)
+	assert.Error(t, err)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.ServicePort = 8443
+	cfg.RegistryPath = ""
+	for _, format := range config.Formats {
+		content, err := config.Encode(cfg, format)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), config.FileName+"."+format)
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+
+		loaded, err := config.Load(path, nil)
+		require.NoError(t, err, format)
+		assert.Equal(t, cfg, loaded, format)
+	}
+}
+
+func TestMCURegistry(t *testing.T) {
+	cfg := config.DefaultConfig()
+	mcus, err := cfg.MCUs()
+	require.NoError(t, err)
+	require.Len(t, mcus, 1)
+	assert.Equal(t, "esp32c6", mcus[0].Name)
+	assert.Equal(t, cfg.FirmwareESP32C6, mcus[0].Firmware)
+	assert.Equal(t, config.DefaultAppOffset, mcus[0].AppOffset())
+	assert.True(t, mcus[0].IsEnabled())
+	assert.Equal(t, "dirigerac2mqtt_esp32c6.bin", mcus[0].Filename)
+
+	dir := t.TempDir()
+	cfg.MCURegistry = filepath.Join(dir, "mcus.yaml")
+	require.NoError(t, os.WriteFile(cfg.MCURegistry, []byte(`mcus:
+  - name: esp32c6
+    firmware: c6.bin
+    app-offsets: [0x20000]
+    filename: bridge_c6.bin
+  - name: esp32s3
+    firmware: s3.bin
+    app-offsets: [0x10000, 0x110000]
+    schema: [ssid, pwd]
+    enabled: false
+`), 0o600))
+	mcus, err = cfg.MCUs()
+	require.NoError(t, err)
+	require.Len(t, mcus, 2)
+	assert.Equal(t, "bridge_c6.bin", mcus[0].Filename)
+	assert.Equal(t, "dirigera2mqtt_esp32s3.bin", mcus[1].Filename)
+	assert.Equal(t, []int{0x10000, 0x110000}, mcus[1].AppOffsets)
+	assert.Equal(t, []string{"ssid", "pwd"}, mcus[1].Schema)
+	assert.False(t, mcus[1].IsEnabled())
+
+	// the registry is read once
+	require.NoError(t, os.Remove(cfg.MCURegistry))
+	require.NoError(t, cfg.Validate())
+	cached, err := cfg.MCUs()
+	require.NoError(t, err)
+	assert.Equal(t, mcus, cached)
+
+	invalid := filepath.Join(dir, "invalid.toml")
+	require.NoError(t, os.WriteFile(invalid, []byte(`[[mcus]]
+name = "esp32c6"
+[[mcus]]
+name = "esp32c6"
+firmware = "c6.bin"
+app-offsets = [-1]
+`), 0o600))
+	_, err = config.ReadMCUs(invalid)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "esp32c6: firmware: must not be empty")
+	assert.Contains(t, err.Error(), "esp32c6: listed twice")
+	assert.Contains(t, err.Error(), "app-offsets: -1 must not be negative")
+
+	misspelled := filepath.Join(dir, "misspelled.yaml")
+	require.NoError(t, os.WriteFile(misspelled, []byte(`mcus:
+  - name: esp32c6
+    firmware: c6.bin
+    app-offsets: [0x20000]
+    filname: bridge_c6.bin
+  - name: esp32s3
+    firmware: s3.bin
+    app-offset: [0x10000]
+    enable: false
+`), 0o600))
+	_, err = config.ReadMCUs(misspelled)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "esp32c6: unknown key filname")
+	assert.Contains(t, err.Error(), "esp32s3: unknown key app-offset")
+	assert.Contains(t, err.Error(), "esp32s3: unknown key enable")
+}
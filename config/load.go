@@ -0,0 +1,230 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Formats lists the supported configuration file formats. The first one is
+// the default of config init.
+var Formats = []string{"env", "yaml", "toml"}
+
+// FileName is the base name of the configuration file searched in a directory
+const FileName = "app"
+
+// key describes a configuration key derived from a field of Config
+type key struct {
+	Name  string
+	Env   string
+	Desc  string
+	index int
+}
+
+func keys() (keys []key) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("mapstructure")
+		keys = append(keys, key{
+			Name:  name,
+			Env:   strings.ToUpper(strings.ReplaceAll(name, "-", "_")),
+			Desc:  field.Tag.Get("desc"),
+			index: i,
+		})
+	}
+	return
+}
+
+// normalizeKey maps env, YAML and TOML spellings to the key name
+func normalizeKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// set converts value to the type of the field of k and assigns it
+func (k key) set(cfg *Config, value interface{}) (err error) {
+	field := reflect.ValueOf(cfg).Elem().Field(k.index)
+	switch field.Interface().(type) {
+	case string:
+		var v string
+		if v, err = cast.ToStringE(value); err == nil {
+			field.SetString(v)
+		}
+	case int:
+		var v int
+		if v, err = cast.ToIntE(value); err == nil {
+			field.SetInt(int64(v))
+		}
+	case bool:
+		var v bool
+		if v, err = cast.ToBoolE(value); err == nil {
+			field.SetBool(v)
+		}
+	case int64:
+		var v int64
+		if v, err = cast.ToInt64E(value); err == nil {
+			field.SetInt(v)
+		}
+	case time.Duration:
+		var v time.Duration
+		if v, err = cast.ToDurationE(value); err == nil {
+			field.SetInt(int64(v))
+		}
+	default:
+		err = fmt.Errorf("unsupported type %s", field.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %v: %w", k.Name, value, err)
+	}
+	return nil
+}
+
+func (k key) get(cfg *Config) interface{} {
+	return reflect.ValueOf(cfg).Elem().Field(k.index).Interface()
+}
+
+// RegisterFlags adds a flag for every configuration key to fs. Flags are
+// only applied by Load if they are set explicitly.
+func RegisterFlags(fs *flag.FlagSet) {
+	defaults := DefaultConfig()
+	for _, k := range keys() {
+		fs.String(k.Name, "", fmt.Sprintf("%s (default %v, env %s)", k.Desc, k.get(defaults), k.Env))
+	}
+}
+
+// FindFile returns the configuration file in dir or an empty string if there
+// is none
+func FindFile(dir string) string {
+	for _, format := range append(Formats, "yml") {
+		path := filepath.Join(dir, FileName+"."+format)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the file at path, environment variables and the flags set on fs.
+// path may be a directory, which is searched with FindFile, or empty. fs may
+// be nil. All unknown keys and invalid values are reported together.
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	cfg := DefaultConfig()
+	var errs []error
+	index := map[string]key{}
+	for _, k := range keys() {
+		index[k.Name] = k
+	}
+
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("configuration: %w", err)
+		}
+		if info.IsDir() {
+			path = FindFile(path)
+		}
+	}
+	if path != "" {
+		settings, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k, ok := index[normalizeKey(name)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key %q", path, name))
+				continue
+			}
+			if err := k.set(cfg, settings[name]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		}
+	}
+
+	for _, k := range keys() {
+		if value, ok := os.LookupEnv(k.Env); ok {
+			if err := k.set(cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", k.Env, err))
+			}
+		}
+	}
+
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			if k, ok := index[f.Name]; ok {
+				if err := k.set(cfg, f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("flag -%s: %w", f.Name, err))
+				}
+			}
+		})
+	}
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if filepath.Ext(path) == ".env" {
+		v.SetConfigType("env")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return v.AllSettings(), nil
+}
+
+// Encode renders cfg as configuration file in format, documenting every key
+func Encode(cfg *Config, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, k := range keys() {
+		value := k.get(cfg)
+		var rendered string
+		switch v := value.(type) {
+		case string:
+			rendered = strconv.Quote(v)
+		case time.Duration:
+			rendered = strconv.Quote(v.String())
+		default:
+			rendered = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&buf, "# %s\n", k.Desc)
+		switch format {
+		case "env":
+			fmt.Fprintf(&buf, "%s=%s\n", k.Env, rendered)
+		case "yaml", "yml":
+			fmt.Fprintf(&buf, "%s: %s\n", k.Name, rendered)
+		case "toml":
+			fmt.Fprintf(&buf, "%s = %s\n", k.Name, rendered)
+		default:
+			return nil, fmt.Errorf("unknown configuration format %q", format)
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// DefaultAppOffset is the flash offset of the app image in the merged
+// firmwares of ESP-IDF's default partition tables
+const DefaultAppOffset = 0x20000
+
+// MCU is an entry of the MCU registry: a base firmware the service builds
+// bridges from. Keys are spelled like configuration keys.
+type MCU struct {
+	// Name is the :mcu of the build endpoint, e.g. esp32c6
+	Name string `json:"name" mapstructure:"name"`
+	// Firmware is the path of the merged base firmware
+	Firmware string `json:"firmware" mapstructure:"firmware"`
+	// AppOffsets are the flash offsets of the app images that get patched,
+	// e.g. factory and ota_0; the first one is the app replaced by AppELF
+	// and reported in listings
+	AppOffsets []int `json:"app-offsets" mapstructure:"app-offsets"`
+	// Filename is the name of downloaded builds
+	Filename string `json:"filename" mapstructure:"filename"`
+	// Schema lists the request fields the firmware supports, empty allows
+	// every field
+	Schema []string `json:"schema,omitempty" mapstructure:"schema"`
+	// Enabled false keeps the entry out of the service, omitted enables it
+	Enabled *bool `json:"enabled,omitempty" mapstructure:"enabled"`
+
+	AppELF             string `json:"app-elf,omitempty" mapstructure:"app-elf"`
+	SigningKey         string `json:"signing-key,omitempty" mapstructure:"signing-key"`
+	FlashEncryptionKey string `json:"flash-encryption-key,omitempty" mapstructure:"flash-encryption-key"`
+	MinSecureVersion   int    `json:"min-secure-version,omitempty" mapstructure:"min-secure-version"`
+}
+
+// IsEnabled reports whether the service offers the MCU
+func (m *MCU) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// AppOffset returns the offset of the primary app image
+func (m *MCU) AppOffset() int {
+	return m.AppOffsets[0]
+}
+
+func (m *MCU) validate() error {
+	var errs []error
+	if m.Firmware == "" {
+		errs = append(errs, errors.New("firmware: must not be empty"))
+	}
+	if len(m.AppOffsets) == 0 {
+		errs = append(errs, errors.New("app-offsets: must list at least one offset"))
+	}
+	for _, offset := range m.AppOffsets {
+		if offset < 0 {
+			errs = append(errs, fmt.Errorf("app-offsets: %d must not be negative", offset))
+		}
+	}
+	if m.MinSecureVersion < 0 {
+		errs = append(errs, fmt.Errorf("min-secure-version: %d must not be negative", m.MinSecureVersion))
+	}
+	return errors.Join(errs...)
+}
+
+// esp32c6Filename is the name ESP32-C6 builds were always downloaded as
+const esp32c6Filename = "dirigerac2mqtt_esp32c6.bin"
+
+// defaultFilename is the name of downloaded builds of an MCU without one.
+// The ESP32-C6 keeps the name clients already rely on.
+func defaultFilename(name string) string {
+	if name == "esp32c6" {
+		return esp32c6Filename
+	}
+	return "dirigera2mqtt_" + name + ".bin"
+}
+
+// MCUs returns the MCU registry: the entries of the mcu-registry file or,
+// without one, the ESP32-C6 described by the *-esp32c6 keys. The file is
+// read once, later calls return the entries read first.
+func (c *Config) MCUs() ([]MCU, error) {
+	if c.MCURegistry == "" {
+		return []MCU{{
+			Name:               "esp32c6",
+			Firmware:           c.FirmwareESP32C6,
+			AppOffsets:         []int{DefaultAppOffset},
+			Filename:           defaultFilename("esp32c6"),
+			AppELF:             c.AppELFESP32C6,
+			SigningKey:         c.SigningKeyESP32C6,
+			FlashEncryptionKey: c.FlashEncryptionKeyESP32C6,
+			MinSecureVersion:   c.MinSecureVersionESP32C6,
+		}}, nil
+	}
+	if c.registry.path != c.MCURegistry {
+		mcus, err := ReadMCUs(c.MCURegistry)
+		if err != nil {
+			return nil, err
+		}
+		c.registry.path, c.registry.mcus = c.MCURegistry, mcus
+	}
+	return slices.Clone(c.registry.mcus), nil
+}
+
+// ReadMCUs reads and validates the MCU registry at path, a YAML, TOML or
+// JSON file listing the entries under the key mcus
+func ReadMCUs(path string) ([]MCU, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	var entries []map[string]any
+	if err := v.UnmarshalKey("mcus", &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no mcus listed", path)
+	}
+	mcus := make([]MCU, len(entries))
+	var errs []error
+	names := map[string]bool{}
+	for i, entry := range entries {
+		mcu := &mcus[i]
+		unused, err := decodeMCU(entry, mcu)
+		name := mcu.Name
+		if name == "" {
+			name = fmt.Sprintf("mcus[%d]", i)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, name, err))
+			continue
+		}
+		for _, key := range unused {
+			errs = append(errs, fmt.Errorf("%s: %s: unknown key %s", path, name, key))
+		}
+		if mcu.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: %s: name: must not be empty", path, name))
+			continue
+		}
+		if names[mcu.Name] {
+			errs = append(errs, fmt.Errorf("%s: %s: listed twice", path, mcu.Name))
+		}
+		names[mcu.Name] = true
+		if mcu.Filename == "" {
+			mcu.Filename = defaultFilename(mcu.Name)
+		}
+		if err := mcu.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, mcu.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return mcus, nil
+}
+
+// decodeMCU decodes an entry of the MCU registry into mcu like viper decodes
+// configuration keys and returns the keys of entry that mcu has no field for
+func decodeMCU(entry map[string]any, mcu *MCU) ([]string, error) {
+	var metadata mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToSliceHookFunc(","),
+		WeaklyTypedInput: true,
+		Metadata:         &metadata,
+		Result:           mcu,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(entry); err != nil {
+		return nil, err
+	}
+	slices.Sort(metadata.Unused)
+	return metadata.Unused, nil
+}
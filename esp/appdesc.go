@@ -0,0 +1,72 @@
+package esp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// AppDescMagic marks the esp_app_desc_t at the start of the first DROM segment
+const (
+	AppDescMagic = 0xABCD5432
+	AppDescSize  = 256
+)
+
+// rawAppDesc mirrors the memory layout of esp_app_desc_t
+type rawAppDesc struct {
+	Magic              uint32
+	SecureVersion      uint32
+	Reserved1          [2]uint32
+	Version            [32]byte
+	ProjectName        [32]byte
+	Time               [16]byte
+	Date               [16]byte
+	IDFVersion         [32]byte
+	AppELFSHA256       [32]byte
+	MinEfuseBlkRevFull uint16
+	MaxEfuseBlkRevFull uint16
+	MMUPageSize        uint8
+	Reserved3          [3]uint8
+	Reserved2          [18]uint32
+}
+
+// AppDesc holds the application description embedded by ESP-IDF.
+type AppDesc struct {
+	Magic         uint32 `json:"magic"`
+	SecureVersion uint32 `json:"secure_version"`
+	Version       string `json:"version"`
+	ProjectName   string `json:"project_name"`
+	Time          string `json:"time"`
+	Date          string `json:"date"`
+	IDFVersion    string `json:"idf_version"`
+	ELFSHA256     string `json:"elf_sha256"`
+}
+
+// ParseAppDesc parses the application description at the start of segment.
+// It returns nil if the segment does not start with an esp_app_desc_t.
+func ParseAppDesc(segment []byte) *AppDesc {
+	if len(segment) < AppDescSize || binary.LittleEndian.Uint32(segment) != AppDescMagic {
+		return nil
+	}
+	var raw rawAppDesc
+	if err := binary.Read(bytes.NewReader(segment), binary.LittleEndian, &raw); err != nil {
+		return nil
+	}
+	return &AppDesc{
+		Magic:         raw.Magic,
+		SecureVersion: raw.SecureVersion,
+		Version:       cString(raw.Version[:]),
+		ProjectName:   cString(raw.ProjectName[:]),
+		Time:          cString(raw.Time[:]),
+		Date:          cString(raw.Date[:]),
+		IDFVersion:    cString(raw.IDFVersion[:]),
+		ELFSHA256:     hex.EncodeToString(raw.AppELFSHA256[:]),
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
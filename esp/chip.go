@@ -0,0 +1,260 @@
+package esp
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Segment types by the memory a segment is loaded to
+const (
+	MemoryPadding = "PADDING"
+	MemoryIROM    = "IROM"
+	MemoryDROM    = "DROM"
+	MemoryIRAM    = "IRAM"
+	MemoryDRAM    = "DRAM"
+	MemoryRTC     = "RTC"
+)
+
+// MemoryRegion is an address range [Start, End) of a chip's memory map
+type MemoryRegion struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Type  string `json:"type"`
+}
+
+// Chip describes what differs between the ESP chip families as far as their
+// images are concerned
+type Chip struct {
+	Name string `json:"name"`
+	// ID is the chip_id of the extended image header
+	ID uint16 `json:"id"`
+	// BootloaderOffset is the flash offset the ROM loads the bootloader from
+	BootloaderOffset int `json:"bootloader_offset"`
+	// FlashFrequencies maps esptool flash frequency names to the lower
+	// nibble of header byte 3, the encoding differs between the families
+	FlashFrequencies map[string]uint8 `json:"-"`
+	// MemoryMap lists the regions segments are loaded to. The flash caches
+	// of the ESP32-C6, -H2 and -P4 map instructions and data to the same
+	// addresses, as do their unified SRAMs, so these regions carry two types.
+	MemoryMap []MemoryRegion `json:"-"`
+	// Magics are the values the ROM loader reads from the chip detect
+	// register 0x40001000 on this family, one per ECO revision that changed
+	// it. The ESP32-P4 has none, its ROM only reports the chip ID in the
+	// security info.
+	Magics []uint32 `json:"magics,omitempty"`
+	// RevisionEFuse locates the chip revision in the eFuses, nil if reading
+	// it is not supported
+	RevisionEFuse *RevisionEFuse `json:"revision_efuse,omitempty"`
+}
+
+// RevisionEFuse locates the chip revision in the eFuses: the minor and the
+// major revision are bit fields of the 32 bit word at Addr
+type RevisionEFuse struct {
+	Addr       uint32 `json:"addr"`
+	MinorShift uint   `json:"minor_shift"`
+	MinorBits  uint   `json:"minor_bits"`
+	MajorShift uint   `json:"major_shift"`
+	MajorBits  uint   `json:"major_bits"`
+}
+
+// Decode returns the chip revision stored in word
+func (e *RevisionEFuse) Decode(word uint32) ChipRevision {
+	field := func(shift uint, bits uint) int { return int(word >> shift & (1<<bits - 1)) }
+	return NewChipRevision(field(e.MajorShift, e.MajorBits), field(e.MinorShift, e.MinorBits))
+}
+
+// flash frequency encodings of esptool
+var (
+	flashFrequencies   = map[string]uint8{"80m": 0xF, "40m": 0x0, "26m": 0x1, "20m": 0x2}
+	flashFrequenciesC2 = map[string]uint8{"60m": 0xF, "30m": 0x0, "20m": 0x1, "15m": 0x2}
+	flashFrequenciesH2 = map[string]uint8{"48m": 0xF, "24m": 0x0, "16m": 0x1, "12m": 0x2}
+	flashFrequenciesP4 = map[string]uint8{"80m": 0xF, "40m": 0x0, "20m": 0x2}
+)
+
+// padding segments of esptool are loaded to address 0
+var paddingRegion = MemoryRegion{0x00000000, 0x00010000, MemoryPadding}
+
+// The chip families with their ESP-IDF memory maps
+var (
+	ESP32 = &Chip{
+		Name: "ESP32", ID: 0x0000, BootloaderOffset: 0x1000, FlashFrequencies: flashFrequencies,
+		Magics: []uint32{0x00F01D83},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x3F400000, 0x3F800000, MemoryDROM},
+			{0x3FF80000, 0x3FF82000, MemoryRTC},
+			{0x3FFAE000, 0x40000000, MemoryDRAM},
+			{0x40080000, 0x400C0000, MemoryIRAM},
+			{0x400C0000, 0x400C2000, MemoryRTC},
+			{0x400D0000, 0x40400000, MemoryIROM},
+			{0x50000000, 0x50002000, MemoryRTC},
+		},
+	}
+	ESP32S2 = &Chip{
+		Name: "ESP32-S2", ID: 0x0002, BootloaderOffset: 0x1000, FlashFrequencies: flashFrequencies,
+		Magics: []uint32{0x000007C6},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x3F000000, 0x3FF80000, MemoryDROM},
+			{0x3FF9E000, 0x3FFA0000, MemoryRTC},
+			{0x3FFB0000, 0x40000000, MemoryDRAM},
+			{0x40020000, 0x40070000, MemoryIRAM},
+			{0x40070000, 0x40072000, MemoryRTC},
+			{0x40080000, 0x40800000, MemoryIROM},
+			{0x50000000, 0x50002000, MemoryRTC},
+		},
+	}
+	ESP32S3 = &Chip{
+		Name: "ESP32-S3", ID: 0x0009, FlashFrequencies: flashFrequencies,
+		Magics: []uint32{0x00000009},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x3C000000, 0x3E000000, MemoryDROM},
+			{0x3FC88000, 0x3FD00000, MemoryDRAM},
+			{0x40370000, 0x403E0000, MemoryIRAM},
+			{0x42000000, 0x44000000, MemoryIROM},
+			{0x50000000, 0x50002000, MemoryRTC},
+			{0x600FE000, 0x60100000, MemoryRTC},
+		},
+	}
+	ESP32C2 = &Chip{
+		Name: "ESP32-C2", ID: 0x000C, FlashFrequencies: flashFrequenciesC2,
+		Magics: []uint32{0x6F51306F, 0x7C41A06F},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x3C000000, 0x3C400000, MemoryDROM},
+			{0x3FCA0000, 0x3FCE0000, MemoryDRAM},
+			{0x4037C000, 0x403C0000, MemoryIRAM},
+			{0x42000000, 0x42400000, MemoryIROM},
+		},
+	}
+	ESP32C3 = &Chip{
+		Name: "ESP32-C3", ID: 0x0005, FlashFrequencies: flashFrequencies,
+		// ECO1+2, ECO3, ECO6 and ECO7
+		Magics: []uint32{0x6921506F, 0x1B31506F, 0x4881606F, 0x4361606F},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x3C000000, 0x3C800000, MemoryDROM},
+			{0x3FC80000, 0x3FCE0000, MemoryDRAM},
+			{0x4037C000, 0x403E0000, MemoryIRAM},
+			{0x42000000, 0x42800000, MemoryIROM},
+			{0x50000000, 0x50002000, MemoryRTC},
+		},
+	}
+	ESP32C6 = &Chip{
+		Name: "ESP32-C6", ID: ChipIDESP32C6, FlashFrequencies: FlashFrequencies,
+		Magics: []uint32{0x2CE0806F},
+		// word 3 of eFuse block 1
+		RevisionEFuse: &RevisionEFuse{Addr: 0x600B0850, MinorShift: 18, MinorBits: 4, MajorShift: 22, MajorBits: 2},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x40800000, 0x40880000, MemoryIRAM},
+			{0x40800000, 0x40880000, MemoryDRAM},
+			{0x42000000, 0x42800000, MemoryIROM},
+			{0x42000000, 0x42800000, MemoryDROM},
+			{0x50000000, 0x50004000, MemoryRTC},
+		},
+	}
+	ESP32H2 = &Chip{
+		Name: "ESP32-H2", ID: 0x0010, FlashFrequencies: flashFrequenciesH2,
+		Magics: []uint32{0xD7B73E80},
+		// word 3 of eFuse block 1
+		RevisionEFuse: &RevisionEFuse{Addr: 0x600B0850, MinorShift: 18, MinorBits: 3, MajorShift: 21, MajorBits: 2},
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x40800000, 0x40850000, MemoryIRAM},
+			{0x40800000, 0x40850000, MemoryDRAM},
+			{0x42000000, 0x42800000, MemoryIROM},
+			{0x42000000, 0x42800000, MemoryDROM},
+			{0x50000000, 0x50001000, MemoryRTC},
+		},
+	}
+	ESP32P4 = &Chip{
+		Name: "ESP32-P4", ID: 0x0012, BootloaderOffset: 0x2000, FlashFrequencies: flashFrequenciesP4,
+		MemoryMap: []MemoryRegion{
+			paddingRegion,
+			{0x40000000, 0x4C000000, MemoryIROM},
+			{0x40000000, 0x4C000000, MemoryDROM},
+			{0x4FF00000, 0x4FFC0000, MemoryIRAM},
+			{0x4FF00000, 0x4FFC0000, MemoryDRAM},
+			{0x50108000, 0x50110000, MemoryRTC},
+		},
+	}
+)
+
+// Chips lists the supported chip families by chip ID
+var Chips = []*Chip{ESP32, ESP32S2, ESP32C3, ESP32S3, ESP32C2, ESP32C6, ESP32H2, ESP32P4}
+
+// ChipByID returns the chip family of a chip_id, nil for unknown IDs
+func ChipByID(id uint16) *Chip {
+	for _, chip := range Chips {
+		if chip.ID == id {
+			return chip
+		}
+	}
+	return nil
+}
+
+// ChipByName returns the chip family called name, ignoring case and dashes
+// like esptool's --chip does, nil for unknown names
+func ChipByName(name string) *Chip {
+	normalize := func(s string) string { return strings.ToLower(strings.ReplaceAll(s, "-", "")) }
+	for _, chip := range Chips {
+		if normalize(chip.Name) == normalize(name) {
+			return chip
+		}
+	}
+	return nil
+}
+
+// ChipByMagic returns the chip family reporting magic in the chip detect
+// register, nil for unknown values
+func ChipByMagic(magic uint32) *Chip {
+	for _, chip := range Chips {
+		if slices.Contains(chip.Magics, magic) {
+			return chip
+		}
+	}
+	return nil
+}
+
+// BootloaderChip returns the chip family of the bootloader of a merged flash
+// image: the first family whose bootloader offset holds an image naming it
+// in its header, nil if there is none
+func BootloaderChip(flash []byte) *Chip {
+	for _, chip := range Chips {
+		if chip.BootloaderOffset >= len(flash) {
+			continue
+		}
+		img, err := ParseImage(flash[chip.BootloaderOffset:])
+		if err == nil && img.Chip == chip {
+			return chip
+		}
+	}
+	return nil
+}
+
+// MemoryTypes returns the types of the memory at addr, empty if addr is not
+// mapped to memory segments can be loaded to
+func (c *Chip) MemoryTypes(addr uint32) (types []string) {
+	for _, region := range c.MemoryMap {
+		if region.Start <= addr && addr < region.End && !slices.Contains(types, region.Type) {
+			types = append(types, region.Type)
+		}
+	}
+	return
+}
+
+// FlashFrequency returns the name of the flash frequency encoded in the
+// lower nibble of header byte 3, the fastest one if several share the value
+func (c *Chip) FlashFrequency(sizeFreq uint8) string {
+	name, mhz := "", 0
+	for candidate, value := range c.FlashFrequencies {
+		n, _ := strconv.Atoi(strings.TrimSuffix(candidate, "m"))
+		if value == sizeFreq&0x0F && n > mhz {
+			name, mhz = candidate, n
+		}
+	}
+	return name
+}
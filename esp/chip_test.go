@@ -0,0 +1,172 @@
+package esp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChips(t *testing.T) {
+	t.Parallel()
+
+	ids := map[uint16]string{}
+	for _, chip := range esp.Chips {
+		assert.NotContains(t, ids, chip.ID, chip.Name)
+		ids[chip.ID] = chip.Name
+		assert.Same(t, chip, esp.ChipByID(chip.ID))
+		assert.Same(t, chip, esp.ChipByName(chip.Name))
+	}
+	assert.Len(t, ids, 8)
+	assert.Same(t, esp.ESP32S3, esp.ChipByName("esp32s3"))
+	assert.Nil(t, esp.ChipByID(0x00FF))
+	assert.Nil(t, esp.ChipByName("esp8266"))
+
+	magics := map[uint32]string{}
+	for _, chip := range esp.Chips {
+		for _, magic := range chip.Magics {
+			assert.NotContains(t, magics, magic, chip.Name)
+			magics[magic] = chip.Name
+			assert.Same(t, chip, esp.ChipByMagic(magic))
+		}
+	}
+	assert.Same(t, esp.ESP32C6, esp.ChipByMagic(0x2CE0806F))
+	assert.Same(t, esp.ESP32C3, esp.ChipByMagic(0x4361606F))
+	assert.Empty(t, esp.ESP32P4.Magics)
+	assert.Nil(t, esp.ChipByMagic(0x12345678))
+
+	// ESP32-C6 v0.1 and ESP32-H2 v1.2 as stored in word 3 of eFuse block 1
+	assert.Equal(t, esp.NewChipRevision(0, 1), esp.ESP32C6.RevisionEFuse.Decode(0xFF000000|1<<18))
+	assert.Equal(t, esp.NewChipRevision(1, 2), esp.ESP32H2.RevisionEFuse.Decode(1<<21|2<<18))
+	assert.Nil(t, esp.ESP32S3.RevisionEFuse)
+
+	assert.Equal(t, 0x1000, esp.ESP32.BootloaderOffset)
+	assert.Equal(t, 0x2000, esp.ESP32P4.BootloaderOffset)
+	assert.Equal(t, 0x0, esp.ESP32C6.BootloaderOffset)
+}
+
+func TestMemoryTypes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		chip  *esp.Chip
+		addr  uint32
+		types []string
+	}{
+		{esp.ESP32, 0x3F400020, []string{esp.MemoryDROM}},
+		{esp.ESP32, 0x400D0020, []string{esp.MemoryIROM}},
+		{esp.ESP32, 0x40080000, []string{esp.MemoryIRAM}},
+		{esp.ESP32, 0x3FFB0000, []string{esp.MemoryDRAM}},
+		{esp.ESP32, 0x50000000, []string{esp.MemoryRTC}},
+		{esp.ESP32S3, 0x3C000020, []string{esp.MemoryDROM}},
+		{esp.ESP32S3, 0x600FE000, []string{esp.MemoryRTC}},
+		{esp.ESP32C3, 0x42000020, []string{esp.MemoryIROM}},
+		{esp.ESP32C3, 0x4037C000, []string{esp.MemoryIRAM}},
+		{esp.ESP32C6, 0x420D0020, []string{esp.MemoryIROM, esp.MemoryDROM}},
+		{esp.ESP32C6, 0x40800000, []string{esp.MemoryIRAM, esp.MemoryDRAM}},
+		{esp.ESP32C6, 0x50000000, []string{esp.MemoryRTC}},
+		{esp.ESP32C6, 0x00000000, []string{esp.MemoryPadding}},
+		{esp.ESP32C6, 0x3C000020, nil},
+		{esp.ESP32P4, 0x4FF00000, []string{esp.MemoryIRAM, esp.MemoryDRAM}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.types, tt.chip.MemoryTypes(tt.addr), "%s 0x%08x", tt.chip.Name, tt.addr)
+	}
+}
+
+func TestFlashFrequency(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "80m", esp.ESP32C6.FlashFrequency(0x30))
+	assert.Equal(t, "20m", esp.ESP32C6.FlashFrequency(0x22))
+	assert.Equal(t, "40m", esp.ESP32.FlashFrequency(0x20))
+	assert.Equal(t, "80m", esp.ESP32.FlashFrequency(0x2F))
+	assert.Equal(t, "60m", esp.ESP32C2.FlashFrequency(0x0F))
+	assert.Equal(t, "48m", esp.ESP32H2.FlashFrequency(0x0F))
+	assert.Equal(t, "", esp.ESP32P4.FlashFrequency(0x01))
+}
+
+func TestParseImageDetectsChip(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	app, err := esp.ParseImage(firmware[0x20000:])
+	require.NoError(t, err)
+	assert.Same(t, esp.ESP32C6, app.Chip)
+	assert.Equal(t, []string{esp.MemoryIROM, esp.MemoryDROM}, app.Segments[0].Types)
+	assert.Equal(t, []string{esp.MemoryIRAM, esp.MemoryDRAM}, app.Segments[1].Types)
+
+	// unknown chips are parsed without classification
+	unknown := append([]byte{}, firmware[0x20000:]...)
+	unknown[12] = 0xFF
+	app, err = esp.ParseImage(unknown)
+	require.NoError(t, err)
+	assert.Nil(t, app.Chip)
+	assert.Nil(t, app.Segments[0].Types)
+
+	// esptool encodes 40 MHz for the ESP32-C6 the same as 80 MHz
+	header := append([]byte{}, firmware[:0x8000]...)
+	require.NoError(t, esp.SetFlashParams(header, esp.FlashParams{Freq: "20m"}))
+	assert.Equal(t, uint8(0x2), header[3]&0x0F)
+	assert.Error(t, esp.SetFlashParams(header, esp.FlashParams{Freq: "26m"}))
+}
+
+func TestBootloaderChip(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	assert.Same(t, esp.ESP32C6, esp.BootloaderChip(firmware))
+
+	// an ESP32 keeps its bootloader at 0x1000
+	esp32 := bytes.Repeat([]byte{0xFF}, 0x8000)
+	copy(esp32[0x1000:], firmware[:0x7000])
+	binary.LittleEndian.PutUint16(esp32[0x1000+12:], esp.ESP32.ID)
+	require.NoError(t, esp.SetFlashParams(esp32[0x1000:], esp.FlashParams{}))
+	assert.Same(t, esp.ESP32, esp.BootloaderChip(esp32))
+
+	// an ESP32-C6 header at the ESP32 offset is no bootloader
+	misplaced := bytes.Repeat([]byte{0xFF}, 0x8000)
+	copy(misplaced[0x1000:], firmware[:0x7000])
+	assert.Nil(t, esp.BootloaderChip(misplaced))
+}
+
+func TestChipRevisions(t *testing.T) {
+	t.Parallel()
+
+	for text, expected := range map[string]esp.ChipRevision{"v0.1": 1, "1.0": 100, "v3.12": 312, "v0.99": 99} {
+		rev, err := esp.ParseChipRevision(text)
+		require.NoError(t, err, text)
+		assert.Equal(t, expected, rev, text)
+	}
+	for _, text := range []string{"", "v1", "v1.100", "v-1.0", "vx.1", "v655.35"} {
+		_, err := esp.ParseChipRevision(text)
+		assert.Error(t, err, text)
+	}
+	assert.Equal(t, "v1.2", esp.NewChipRevision(1, 2).String())
+
+	v0 := esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)}
+	v1 := esp.ChipRevisionRange{Min: esp.NewChipRevision(1, 0), Max: esp.NoMaxChipRevision}
+	assert.True(t, v0.Contains(esp.NewChipRevision(0, 2)))
+	assert.False(t, v0.Contains(esp.NewChipRevision(1, 0)))
+	assert.True(t, v1.Contains(esp.NewChipRevision(9, 99)))
+	assert.Equal(t, "v1.0 and later", v1.String())
+	overlap := v0.Intersect(v1)
+	assert.Greater(t, overlap.Min, overlap.Max)
+	assert.EqualError(t, v0.Check(esp.NewChipRevision(1, 1)), "chip revision v1.1 is not supported, the firmware runs on v0.0 - v0.99")
+
+	encoded, err := json.Marshal([]esp.ChipRevisionRange{v0, v1})
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"min": "v0.0", "max": "v0.99"}, {"min": "v1.0"}]`, string(encoded))
+	var decoded []esp.ChipRevisionRange
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, []esp.ChipRevisionRange{v0, v1}, decoded)
+	assert.ErrorContains(t, json.Unmarshal([]byte(`{"min": "v1"}`), &v0), "min")
+	assert.ErrorContains(t, json.Unmarshal([]byte(`{"min": "v1.0", "max": "rev2"}`), &v0), "max")
+}
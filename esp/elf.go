@@ -0,0 +1,259 @@
+package esp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ESP32-C6 image layout constants as used by esptool
+const (
+	ChipIDESP32C6 = 13
+	// IROMAlign is the flash MMU page size flash mapped segments are aligned to
+	IROMAlign    = 0x10000
+	IROMMapStart = 0x42000000
+	IROMMapEnd   = 0x42800000
+	DROMMapStart = 0x42800000
+	DROMMapEnd   = 0x43000000
+	// MaxSegments is the maximum number of ELF sections an image can be built from
+	MaxSegments = 16
+	// WPPinDisabled is the wp_pin value of images not using a flash WP pin
+	WPPinDisabled = 0xEE
+	// AppELFSHA256Offset is the image offset of app_elf_sha256 in the app
+	// descriptor of ESP-IDF apps
+	AppELFSHA256Offset = 0xb0
+)
+
+func isFlashAddr(addr uint32) bool {
+	return (IROMMapStart <= addr && addr < IROMMapEnd) || (DROMMapStart <= addr && addr < DROMMapEnd)
+}
+
+// ELFOptions sets the header fields of an image built from an ELF file
+type ELFOptions struct {
+	// SpiMode and SpiSpeedSize are the raw header values, see FlashModes,
+	// FlashSizes and FlashFrequencies
+	SpiMode        uint8
+	SpiSpeedSize   uint8
+	MinChipRev     uint8
+	MinChipRevFull uint16
+	// MaxChipRevFull 0 is written as 0xFFFF, no upper limit, like esptool does
+	MaxChipRevFull uint16
+	// ELFSHA256Offset is the image offset the SHA-256 of the ELF file is
+	// written to, AppELFSHA256Offset for ESP-IDF apps; 0 leaves the image untouched
+	ELFSHA256Offset int
+	// OmitHash leaves out the SHA-256 appended to the image
+	OmitHash bool
+}
+
+type section struct {
+	name string
+	addr uint32
+	data []byte
+}
+
+// readSections returns the loadable sections of an ESP-IDF ELF file in file
+// order, padded to 4 bytes
+func readSections(file *elf.File) ([]section, error) {
+	var sections []section
+	for _, s := range file.Sections {
+		if s.Type != elf.SHT_PROGBITS && s.Type != elf.SHT_INIT_ARRAY && s.Type != elf.SHT_FINI_ARRAY {
+			continue
+		}
+		if s.Addr == 0 || s.Size == 0 {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", s.Name, err)
+		}
+		padded := make([]byte, (len(data)+3)&^3)
+		copy(padded, data)
+		sections = append(sections, section{name: s.Name, addr: uint32(s.Addr), data: padded})
+	}
+	return sections, nil
+}
+
+// mergeAdjacent merges every section into its predecessor that it directly
+// follows in memory of the same type, so sections of different memory types
+// stay in separate segments
+func mergeAdjacent(sections []section) []section {
+	merged := []section{sections[0]}
+	for _, s := range sections[1:] {
+		last := &merged[len(merged)-1]
+		if slices.Equal(ESP32C6.MemoryTypes(last.addr), ESP32C6.MemoryTypes(s.addr)) && s.addr == last.addr+uint32(len(last.data)) {
+			last.data = append(last.data, s.data...)
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// moveToFront moves the section called name to the front of sections
+func moveToFront(sections []section, name string) {
+	for i, s := range sections {
+		if s.name == name {
+			copy(sections[1:i+1], sections[:i])
+			sections[0] = s
+			return
+		}
+	}
+}
+
+// alignmentPadding returns the length of the padding segment needed at pos so
+// that the data of a segment loaded at addr starts at a file offset congruent
+// to addr modulo IROMAlign
+func alignmentPadding(pos int, addr uint32) int {
+	alignPast := int(addr%IROMAlign) - SegmentHeaderSize
+	padding := IROMAlign - pos%IROMAlign + alignPast
+	if padding == 0 || padding == IROMAlign {
+		return 0
+	}
+	// the padding segment has a header of its own
+	padding -= SegmentHeaderSize
+	if padding < 0 {
+		padding += IROMAlign
+	}
+	return padding
+}
+
+// ELFToImage converts an ESP32-C6 ELF file into an app or bootloader image
+// byte-identical to `esptool.py elf2image`: loadable sections are merged
+// where adjacent, flash mapped segments are placed on their MMU page offset,
+// padded with pieces of RAM segments, and checksum and SHA-256 are appended.
+func ELFToImage(elfData []byte, opts ELFOptions) ([]byte, error) {
+	file, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		return nil, err
+	}
+	if file.Class != elf.ELFCLASS32 || file.Data != elf.ELFDATA2LSB || file.Machine != elf.EM_RISCV {
+		return nil, errors.New("not a little endian 32 bit RISC-V ELF file")
+	}
+	sections, err := readSections(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) == 0 {
+		return nil, errors.New("the ELF file has no loadable sections")
+	}
+	sections = mergeAdjacent(sections)
+	if len(sections) > MaxSegments {
+		return nil, fmt.Errorf("%d segments exceed the maximum of %d, check the linker script", len(sections), MaxSegments)
+	}
+
+	var flash, ram []section
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].addr < sections[j].addr })
+	for _, s := range sections {
+		if isFlashAddr(s.addr) {
+			flash = append(flash, s)
+		} else {
+			ram = append(ram, s)
+		}
+	}
+	// the app and bootloader descriptors have to be at the start of the image
+	moveToFront(flash, ".flash.appdesc")
+	moveToFront(ram, ".dram0.bootdesc")
+	for i := 1; i < len(flash); i++ {
+		if flash[i].addr/IROMAlign == flash[i-1].addr/IROMAlign {
+			return nil, fmt.Errorf("segment at 0x%08x lands in the same flash page as the segment at 0x%08x", flash[i].addr, flash[i-1].addr)
+		}
+	}
+
+	maxRev := opts.MaxChipRevFull
+	if maxRev == 0 {
+		maxRev = 0xFFFF
+	}
+	header := ImageHeader{
+		Magic:          ImageHeaderMagic,
+		SpiMode:        opts.SpiMode,
+		SpiSpeedSize:   opts.SpiSpeedSize,
+		EntryAddr:      uint32(file.Entry),
+		WpPin:          WPPinDisabled,
+		ChipID:         ChipIDESP32C6,
+		MinChipRev:     opts.MinChipRev,
+		MinChipRevFull: opts.MinChipRevFull,
+		MaxChipRevFull: maxRev,
+	}
+	if !opts.OmitHash {
+		header.HashAppend = 1
+	}
+	var out bytes.Buffer
+	if err = binary.Write(&out, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	elfHash := sha256.Sum256(elfData)
+	checksum := uint8(ChecksumMagic)
+	count := 0
+	write := func(addr uint32, data []byte) error {
+		pos := out.Len()
+		if offset := opts.ELFSHA256Offset; offset != 0 && offset >= pos && offset < pos+len(data) {
+			patch := offset - pos
+			if patch < SegmentHeaderSize || patch+HashSize > len(data) {
+				return fmt.Errorf("ELF SHA-256 at 0x%x crosses the boundary of the segment at 0x%08x", offset, addr)
+			}
+			patch -= SegmentHeaderSize
+			if !bytes.Equal(data[patch:patch+HashSize], make([]byte, HashSize)) {
+				return fmt.Errorf("the ELF SHA-256 at 0x%x would overwrite data", offset)
+			}
+			data = bytes.Clone(data)
+			copy(data[patch:], elfHash[:])
+		}
+		var segmentHeader [SegmentHeaderSize]byte
+		binary.LittleEndian.PutUint32(segmentHeader[0:], addr)
+		binary.LittleEndian.PutUint32(segmentHeader[4:], uint32(len(data)))
+		out.Write(segmentHeader[:])
+		out.Write(data)
+		for _, b := range data {
+			checksum ^= b
+		}
+		count++
+		return nil
+	}
+
+	for len(flash) > 0 {
+		padding := alignmentPadding(out.Len(), flash[0].addr)
+		if padding == 0 {
+			if err = write(flash[0].addr, flash[0].data); err != nil {
+				return nil, err
+			}
+			flash = flash[1:]
+			continue
+		}
+		// fill the gap with the start of the next RAM segment if possible
+		if len(ram) > 0 && padding > SegmentHeaderSize {
+			piece := ram[0].data[:min(padding, len(ram[0].data))]
+			if err = write(ram[0].addr, piece); err != nil {
+				return nil, err
+			}
+			ram[0].addr += uint32(len(piece))
+			ram[0].data = ram[0].data[len(piece):]
+			if len(ram[0].data) == 0 {
+				ram = ram[1:]
+			}
+		} else if err = write(0, make([]byte, padding)); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range ram {
+		if err = write(s.addr, s.data); err != nil {
+			return nil, err
+		}
+	}
+
+	// the checksum is the last byte of a 16 byte block
+	out.Write(make([]byte, 15-out.Len()%16))
+	out.WriteByte(checksum)
+	image := out.Bytes()
+	image[1] = uint8(count)
+	if !opts.OmitHash {
+		hash := sha256.Sum256(image)
+		image = append(image, hash[:]...)
+	}
+	return image, nil
+}
@@ -0,0 +1,171 @@
+package esp_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type elfSection struct {
+	name string
+	typ  elf.SectionType
+	addr uint32
+	data []byte
+	size uint32
+}
+
+// writeELF builds a minimal RISC-V executable holding sections
+func writeELF(t *testing.T, entry uint32, sections []elfSection) []byte {
+	t.Helper()
+	names := []byte{0}
+	nameOffsets := make([]uint32, len(sections)+1)
+	for i, s := range append(sections, elfSection{name: ".shstrtab"}) {
+		nameOffsets[i] = uint32(len(names))
+		names = append(append(names, s.name...), 0)
+	}
+
+	var body bytes.Buffer
+	headers := []elf.Section32{{}}
+	offset := uint32(binary.Size(elf.Header32{}))
+	for i, s := range sections {
+		size := uint32(len(s.data))
+		if s.typ == elf.SHT_NOBITS {
+			size = s.size
+		}
+		headers = append(headers, elf.Section32{
+			Name: nameOffsets[i], Type: uint32(s.typ), Flags: uint32(elf.SHF_ALLOC),
+			Addr: s.addr, Off: offset + uint32(body.Len()), Size: size, Addralign: 4,
+		})
+		body.Write(s.data)
+	}
+	headers = append(headers, elf.Section32{
+		Name: nameOffsets[len(sections)], Type: uint32(elf.SHT_STRTAB),
+		Off: offset + uint32(body.Len()), Size: uint32(len(names)), Addralign: 1,
+	})
+	body.Write(names)
+
+	header := elf.Header32{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_RISCV), Version: uint32(elf.EV_CURRENT),
+		Entry: entry, Shoff: offset + uint32(body.Len()), Ehsize: uint16(offset),
+		Phentsize: uint16(binary.Size(elf.Prog32{})), Shentsize: uint16(binary.Size(elf.Section32{})),
+		Shnum: uint16(len(headers)), Shstrndx: uint16(len(headers) - 1),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var out bytes.Buffer
+	require.NoError(t, binary.Write(&out, binary.LittleEndian, &header))
+	out.Write(body.Bytes())
+	require.NoError(t, binary.Write(&out, binary.LittleEndian, headers))
+	return out.Bytes()
+}
+
+// sectionsOf undoes the segment layout of an image: RAM segments split to pad
+// flash segments are joined again
+func sectionsOf(t *testing.T, image []byte) (*esp.Image, []elfSection) {
+	img, err := esp.ParseImage(image)
+	require.NoError(t, err)
+	segments := append([]esp.Segment{}, img.Segments...)
+	sort.Slice(segments, func(i, j int) bool { return segments[i].LoadAddr < segments[j].LoadAddr })
+	var sections []elfSection
+	for _, segment := range segments {
+		data := image[segment.Offset : segment.Offset+int(segment.DataLen)]
+		if n := len(sections); n > 0 && sections[n-1].addr+uint32(len(sections[n-1].data)) == segment.LoadAddr {
+			sections[n-1].data = append(sections[n-1].data, data...)
+			continue
+		}
+		sections = append(sections, elfSection{typ: elf.SHT_PROGBITS, addr: segment.LoadAddr, data: bytes.Clone(data)})
+	}
+	return img, sections
+}
+
+func optionsOf(img *esp.Image) esp.ELFOptions {
+	return esp.ELFOptions{
+		SpiMode:        img.Header.SpiMode,
+		SpiSpeedSize:   img.Header.SpiSpeedSize,
+		MinChipRevFull: img.Header.MinChipRevFull,
+		MaxChipRevFull: img.Header.MaxChipRevFull,
+	}
+}
+
+func TestELFToImage(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+
+	t.Run("app", func(t *testing.T) {
+		t.Parallel()
+		expected := firmware[0x20000 : 0x20000+0x10aff0]
+		img, sections := sectionsOf(t, expected)
+		// IRAM at 0x40800000, DRAM at 0x4081a470, IROM at 0x42000020 and the
+		// app descriptor followed by rodata at 0x420d0020
+		require.Len(t, sections, 4)
+		appDesc, rodata := sections[3], sections[3]
+		appDesc.name, appDesc.data = ".flash.appdesc", appDesc.data[:esp.AppDescSize]
+		rodata.name, rodata.addr, rodata.data = ".flash.rodata", rodata.addr+esp.AppDescSize, rodata.data[esp.AppDescSize:]
+		sections[0].name, sections[1].name, sections[2].name = ".iram0.text", ".dram0.data", ".flash.text"
+		elfFile := writeELF(t, img.Header.EntryAddr, []elfSection{
+			sections[0], sections[1],
+			{name: ".dram0.bss", typ: elf.SHT_NOBITS, addr: 0x4081e000, size: 0x2000},
+			sections[2], appDesc, rodata,
+			{name: ".comment", typ: elf.SHT_PROGBITS, data: []byte("GCC")},
+		})
+
+		image, err := esp.ELFToImage(elfFile, optionsOf(img))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, image))
+
+		// the ELF SHA-256 of ESP-IDF apps lives in the app descriptor
+		copy(appDesc.data[0x90:0xb0], make([]byte, 32))
+		elfFile = writeELF(t, img.Header.EntryAddr, []elfSection{sections[0], sections[1], sections[2], appDesc, rodata})
+		opts := optionsOf(img)
+		opts.ELFSHA256Offset = esp.AppELFSHA256Offset
+		image, err = esp.ELFToImage(elfFile, opts)
+		require.NoError(t, err)
+		converted, err := esp.ParseImage(image)
+		require.NoError(t, err)
+		assert.True(t, converted.Valid())
+		elfHash := sha256.Sum256(elfFile)
+		assert.Equal(t, hex.EncodeToString(elfHash[:]), converted.AppDesc.ELFSHA256)
+
+		opts.ELFSHA256Offset = 0x40
+		_, err = esp.ELFToImage(elfFile, opts)
+		assert.ErrorContains(t, err, "would overwrite data")
+	})
+
+	t.Run("bootloader", func(t *testing.T) {
+		t.Parallel()
+		expected := firmware[:0x57e0]
+		img, sections := sectionsOf(t, expected)
+		require.Len(t, sections, 3)
+		sections[0].name, sections[1].name, sections[2].name = ".iram_loader.text", ".iram.text", ".dram0.bootdesc"
+		elfFile := writeELF(t, img.Header.EntryAddr, sections)
+
+		image, err := esp.ELFToImage(elfFile, optionsOf(img))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, image))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		_, err := esp.ELFToImage([]byte("not an ELF"), esp.ELFOptions{})
+		assert.Error(t, err)
+		_, err = esp.ELFToImage(writeELF(t, 0, []elfSection{
+			{name: ".flash.text", typ: elf.SHT_PROGBITS, addr: 0x42000020, data: make([]byte, 16)},
+			{name: ".flash.rodata", typ: elf.SHT_PROGBITS, addr: 0x42008000, data: make([]byte, 16)},
+		}), esp.ELFOptions{})
+		assert.ErrorContains(t, err, "lands in the same flash page")
+	})
+}
@@ -0,0 +1,105 @@
+package esp
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// FlashModes maps esptool flash mode names to the header value
+var FlashModes = map[string]uint8{
+	"qio":  0,
+	"qout": 1,
+	"dio":  2,
+	"dout": 3,
+}
+
+// FlashSizes maps esptool flash size names to the upper nibble of header byte 3
+var FlashSizes = map[string]uint8{
+	"1MB":   0x00,
+	"2MB":   0x10,
+	"4MB":   0x20,
+	"8MB":   0x30,
+	"16MB":  0x40,
+	"32MB":  0x50,
+	"64MB":  0x60,
+	"128MB": 0x70,
+}
+
+// FlashFrequencies maps esptool flash frequency names to the lower nibble of
+// header byte 3 for the ESP32-C6, which runs its flash at 80 MHz if 40 MHz
+// is requested. Chip.FlashFrequencies holds the encoding of other chips.
+var FlashFrequencies = map[string]uint8{
+	"80m": 0x0,
+	"40m": 0x0,
+	"20m": 0x2,
+}
+
+// FlashParams selects the flash parameters to write into an image header.
+// Empty fields or "keep" leave the value of the image untouched.
+type FlashParams struct {
+	Mode string
+	Size string
+	Freq string
+}
+
+func lookupFlashParam(kind string, table map[string]uint8, name string) (value uint8, keep bool, err error) {
+	if name == "" || name == "keep" {
+		return 0, true, nil
+	}
+	value, ok := table[name]
+	if !ok {
+		return 0, false, fmt.Errorf("unknown flash %s %q", kind, name)
+	}
+	return value, false, nil
+}
+
+// SetFlashParams rewrites flash mode, size and frequency in the header of
+// image like esptool does for bootloaders. Frequencies are encoded for the
+// chip of the image. The appended SHA-256 is recalculated if present; the
+// checksum does not cover the header.
+func SetFlashParams(image []byte, params FlashParams) error {
+	img, err := ParseImage(image)
+	if err != nil {
+		return err
+	}
+	mode, keepMode, err := lookupFlashParam("mode", FlashModes, params.Mode)
+	if err != nil {
+		return err
+	}
+	size, keepSize, err := lookupFlashParam("size", FlashSizes, params.Size)
+	if err != nil {
+		return err
+	}
+	frequencies := FlashFrequencies
+	if chip := ChipByID(img.Header.ChipID); chip != nil {
+		frequencies = chip.FlashFrequencies
+	}
+	freq, keepFreq, err := lookupFlashParam("frequency", frequencies, params.Freq)
+	if err != nil {
+		return err
+	}
+	if keepMode {
+		mode = image[2]
+	}
+	if keepSize {
+		size = image[3] & 0xF0
+	}
+	if keepFreq {
+		freq = image[3] & 0x0F
+	}
+	image[2] = mode
+	image[3] = size | freq
+
+	if img.HashAppended {
+		dataLength := img.Length - HashSize
+		hash := sha256.Sum256(image[:dataLength])
+		copy(image[dataLength:], hash[:])
+	}
+	return nil
+}
+
+// FlashSizeBytes returns the flash size in bytes encoded in the upper nibble
+// of header byte 3
+func FlashSizeBytes(sizeFreq uint8) uint32 {
+	return 1 << 20 << (sizeFreq >> 4)
+}
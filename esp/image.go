@@ -0,0 +1,142 @@
+package esp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ESP image format constants
+const (
+	ImageHeaderMagic  = 0xE9
+	ChecksumMagic     = 0xEF
+	ImageHeaderSize   = 24
+	SegmentHeaderSize = 8
+	HashSize          = sha256.Size
+)
+
+// ImageHeader represents the ESP image header including the extended header
+type ImageHeader struct {
+	Magic          uint8    `json:"magic"`
+	SegmentCount   uint8    `json:"segment_count"`
+	SpiMode        uint8    `json:"spi_mode"`
+	SpiSpeedSize   uint8    `json:"spi_speed_size"`
+	EntryAddr      uint32   `json:"entry_addr"`
+	WpPin          uint8    `json:"wp_pin"`
+	SpiPinDrv      [3]uint8 `json:"spi_pin_drv"`
+	ChipID         uint16   `json:"chip_id"`
+	MinChipRev     uint8    `json:"min_chip_rev"`
+	MinChipRevFull uint16   `json:"min_chip_rev_full"`
+	MaxChipRevFull uint16   `json:"max_chip_rev_full"`
+	Reserved       [4]uint8 `json:"-"`
+	HashAppend     uint8    `json:"hash_append"`
+}
+
+// Segment describes a segment of an image. Offset is the position of the
+// segment data relative to the start of the image.
+// Types classifies the memory the segment is loaded to, see Chip.MemoryTypes.
+type Segment struct {
+	LoadAddr uint32   `json:"load_addr"`
+	DataLen  uint32   `json:"data_len"`
+	Offset   int      `json:"offset"`
+	Types    []string `json:"types,omitempty"`
+}
+
+// Image holds the parsed structure of an ESP app or bootloader image.
+type Image struct {
+	Header           ImageHeader
+	Segments         []Segment
+	ChecksumOffset   int
+	StoredChecksum   uint8
+	ComputedChecksum uint8
+	HashAppended     bool
+	StoredHash       [HashSize]byte
+	ComputedHash     [HashSize]byte
+	Length           int
+	AppDesc          *AppDesc
+	// Chip is the chip family detected from the header, nil if unknown
+	Chip *Chip
+}
+
+// ParseImage parses the image starting at the beginning of data. Trailing
+// data after the image is ignored.
+func ParseImage(data []byte) (*Image, error) {
+	img := &Image{}
+	if len(data) < ImageHeaderSize {
+		return nil, errors.New("image too short for header")
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &img.Header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if img.Header.Magic != ImageHeaderMagic {
+		return nil, fmt.Errorf("invalid header magic: 0x%02X (expected 0x%02X)", img.Header.Magic, ImageHeaderMagic)
+	}
+
+	img.Chip = ChipByID(img.Header.ChipID)
+	checksum := uint8(ChecksumMagic)
+	offset := ImageHeaderSize
+	for i := 0; i < int(img.Header.SegmentCount); i++ {
+		if offset+SegmentHeaderSize > len(data) {
+			return nil, fmt.Errorf("segment header %d exceeds image size", i)
+		}
+		segment := Segment{
+			LoadAddr: binary.LittleEndian.Uint32(data[offset:]),
+			DataLen:  binary.LittleEndian.Uint32(data[offset+4:]),
+			Offset:   offset + SegmentHeaderSize,
+		}
+		if img.Chip != nil {
+			segment.Types = img.Chip.MemoryTypes(segment.LoadAddr)
+		}
+		end := segment.Offset + int(segment.DataLen)
+		if end > len(data) || end < segment.Offset {
+			return nil, fmt.Errorf("segment %d exceeds image size", i)
+		}
+		for _, b := range data[segment.Offset:end] {
+			checksum ^= b
+		}
+		img.Segments = append(img.Segments, segment)
+		offset = end
+	}
+
+	// the checksum is stored in the last byte of the 16 byte aligned block
+	img.ChecksumOffset = (offset+16)&^15 - 1
+	if img.ChecksumOffset >= len(data) {
+		return nil, errors.New("image too short for checksum")
+	}
+	img.StoredChecksum = data[img.ChecksumOffset]
+	img.ComputedChecksum = checksum
+	img.Length = img.ChecksumOffset + 1
+
+	img.HashAppended = img.Header.HashAppend == 1
+	if img.HashAppended {
+		if img.Length+HashSize > len(data) {
+			return nil, errors.New("image too short for appended hash")
+		}
+		copy(img.StoredHash[:], data[img.Length:img.Length+HashSize])
+		img.ComputedHash = sha256.Sum256(data[:img.Length])
+		img.Length += HashSize
+	}
+
+	if len(img.Segments) > 0 {
+		img.AppDesc = ParseAppDesc(data[img.Segments[0].Offset : img.Segments[0].Offset+int(img.Segments[0].DataLen)])
+	}
+	return img, nil
+}
+
+// ChecksumValid reports whether the stored checksum matches the segment data.
+func (img *Image) ChecksumValid() bool {
+	return img.StoredChecksum == img.ComputedChecksum
+}
+
+// HashValid reports whether the appended SHA-256 matches the image. Images
+// without an appended hash are considered valid.
+func (img *Image) HashValid() bool {
+	return !img.HashAppended || img.StoredHash == img.ComputedHash
+}
+
+// Valid reports whether checksum and appended hash are both consistent.
+func (img *Image) Valid() bool {
+	return img.ChecksumValid() && img.HashValid()
+}
@@ -0,0 +1,56 @@
+package esp_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImage(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+
+	bootloader, err := esp.ParseImage(firmware)
+	require.NoError(t, err)
+	assert.True(t, bootloader.Valid())
+	assert.Equal(t, 3, len(bootloader.Segments))
+	assert.Equal(t, 0x57e0, bootloader.Length)
+	assert.Nil(t, bootloader.AppDesc)
+
+	app, err := esp.ParseImage(firmware[0x20000:])
+	require.NoError(t, err)
+	assert.True(t, app.Valid())
+	assert.Equal(t, uint16(0x000D), app.Header.ChipID)
+	assert.Equal(t, 5, len(app.Segments))
+	assert.Equal(t, uint32(0x420d0020), app.Segments[0].LoadAddr)
+	assert.Equal(t, 0x10aff0, app.Length)
+	require.NotNil(t, app.AppDesc)
+	assert.Equal(t, "v0.1.3-2-g2470f4a-dirty", app.AppDesc.Version)
+	assert.Equal(t, uint32(esp.AppDescMagic), app.AppDesc.Magic)
+	assert.Equal(t, "wifi_station", app.AppDesc.ProjectName)
+	assert.Equal(t, "v5.5-beta1-dirty", app.AppDesc.IDFVersion)
+}
+
+func TestParseImageDetectsCorruption(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	app := firmware[0x20000:]
+	app[0x200] ^= 0xFF
+
+	img, err := esp.ParseImage(app)
+	require.NoError(t, err)
+	assert.False(t, img.ChecksumValid())
+	assert.False(t, img.HashValid())
+
+	_, err = esp.ParseImage(app[:0x100])
+	assert.Error(t, err)
+	_, err = esp.ParseImage([]byte("not an image at all, really not"))
+	assert.ErrorContains(t, err, "invalid header magic")
+}
@@ -0,0 +1,135 @@
+package esp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ChipRevision is a chip revision in the major*100+minor encoding of the
+// image header, e.g. 1 for v0.1 and 100 for v1.0
+type ChipRevision uint16
+
+// NoMaxChipRevision as max_chip_rev_full accepts every later revision
+const NoMaxChipRevision ChipRevision = 0xFFFF
+
+// NewChipRevision returns the revision vmajor.minor
+func NewChipRevision(major int, minor int) ChipRevision {
+	return ChipRevision(major*100 + minor)
+}
+
+// ParseChipRevision parses a revision written as esptool prints it, v0.1 or
+// 0.1
+func ParseChipRevision(s string) (ChipRevision, error) {
+	majorText, minorText, ok := strings.Cut(strings.TrimPrefix(s, "v"), ".")
+	major, majorErr := strconv.ParseUint(majorText, 10, 16)
+	minor, minorErr := strconv.ParseUint(minorText, 10, 16)
+	if !ok || majorErr != nil || minorErr != nil || minor > 99 || major*100+minor >= uint64(NoMaxChipRevision) {
+		return 0, fmt.Errorf("invalid chip revision %q, expected v<major>.<minor>", s)
+	}
+	return NewChipRevision(int(major), int(minor)), nil
+}
+
+// Major returns the major revision
+func (r ChipRevision) Major() int {
+	return int(r) / 100
+}
+
+// Minor returns the minor revision
+func (r ChipRevision) Minor() int {
+	return int(r) % 100
+}
+
+func (r ChipRevision) String() string {
+	return fmt.Sprintf("v%d.%d", r.Major(), r.Minor())
+}
+
+// ChipRevisionRange is the range of chip revisions [Min, Max] an image runs
+// on, the ROM and the bootloader refuse images outside of it
+type ChipRevisionRange struct {
+	Min ChipRevision
+	// Max is NoMaxChipRevision without an upper limit
+	Max ChipRevision
+}
+
+// ChipRevisions returns the range of chip revisions the image supports
+func (h *ImageHeader) ChipRevisions() ChipRevisionRange {
+	return ChipRevisionRange{Min: ChipRevision(h.MinChipRevFull), Max: ChipRevision(h.MaxChipRevFull)}
+}
+
+// Contains reports whether rev is within the range
+func (r ChipRevisionRange) Contains(rev ChipRevision) bool {
+	return r.Min <= rev && (r.Max == NoMaxChipRevision || rev <= r.Max)
+}
+
+// Intersect returns the revisions within both ranges, the range of a
+// firmware made of several images. The result is empty, Min > Max, if the
+// ranges do not overlap.
+func (r ChipRevisionRange) Intersect(other ChipRevisionRange) ChipRevisionRange {
+	return ChipRevisionRange{Min: max(r.Min, other.Min), Max: min(r.Max, other.Max)}
+}
+
+// Check returns an UnsupportedChipRevisionError if rev is not within the
+// range
+func (r ChipRevisionRange) Check(rev ChipRevision) error {
+	if !r.Contains(rev) {
+		return &UnsupportedChipRevisionError{Revision: rev, Supported: r}
+	}
+	return nil
+}
+
+// UnsupportedChipRevisionError reports a chip revision outside of the
+// revisions a firmware runs on
+type UnsupportedChipRevisionError struct {
+	Revision  ChipRevision
+	Supported ChipRevisionRange
+}
+
+func (e *UnsupportedChipRevisionError) Error() string {
+	return fmt.Sprintf("chip revision %s is not supported, the firmware runs on %s", e.Revision, e.Supported)
+}
+
+func (r ChipRevisionRange) String() string {
+	if r.Max == NoMaxChipRevision {
+		return r.Min.String() + " and later"
+	}
+	return r.Min.String() + " - " + r.Max.String()
+}
+
+// MarshalJSON encodes the range as {"min": "v0.0", "max": "v0.99"}, without
+// max if there is no upper limit
+func (r ChipRevisionRange) MarshalJSON() ([]byte, error) {
+	encoded := struct {
+		Min string `json:"min"`
+		Max string `json:"max,omitempty"`
+	}{Min: r.Min.String()}
+	if r.Max != NoMaxChipRevision {
+		encoded.Max = r.Max.String()
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a range encoded by MarshalJSON, a missing max means
+// no upper limit
+func (r *ChipRevisionRange) UnmarshalJSON(data []byte) error {
+	var encoded struct {
+		Min string `json:"min"`
+		Max string `json:"max"`
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	minimum, err := ParseChipRevision(encoded.Min)
+	if err != nil {
+		return fmt.Errorf("min: %w", err)
+	}
+	maximum := NoMaxChipRevision
+	if encoded.Max != "" {
+		if maximum, err = ParseChipRevision(encoded.Max); err != nil {
+			return fmt.Errorf("max: %w", err)
+		}
+	}
+	*r = ChipRevisionRange{Min: minimum, Max: maximum}
+	return nil
+}
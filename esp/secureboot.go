@@ -0,0 +1,318 @@
+package esp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"slices"
+)
+
+// Secure Boot V2 signature sector layout
+const (
+	// SignatureSectorSize is the size of the sector following the image
+	// padded to it, holding up to MaxSignatures signature blocks
+	SignatureSectorSize = 0x1000
+	SignatureBlockSize  = 1216
+	SignatureBlockMagic = 0xE7
+	MaxSignatures       = 3
+	// signatureCRCOffset is the offset of the CRC32 over the block before it
+	signatureCRCOffset = 1196
+	signatureDigestEnd = 36
+)
+
+// Signature schemes, stored as the version of the signature block
+const (
+	SchemeRSA3072PSS = 0x02
+	SchemeECDSAP256  = 0x03
+)
+
+const (
+	rsaKeyBits      = 3072
+	rsaKeySize      = rsaKeyBits / 8
+	rsaKeyBlockSize = rsaKeySize + 4 + rsaKeySize + 4
+	// pssSaltLength is the salt length used by espsecure and the ROM
+	pssSaltLength     = 32
+	ecdsaCurveP256    = 2
+	ecdsaCoordSize    = 32
+	ecdsaKeyBlockSize = 1 + 2*ecdsaCoordSize
+)
+
+// SchemeName returns the name of a signature scheme
+func SchemeName(scheme uint8) string {
+	switch scheme {
+	case SchemeRSA3072PSS:
+		return "RSA-3072-PSS"
+	case SchemeECDSAP256:
+		return "ECDSA-P256"
+	}
+	return fmt.Sprintf("unknown (0x%02x)", scheme)
+}
+
+// Signature is a parsed Secure Boot V2 signature block
+type Signature struct {
+	Scheme string `json:"scheme"`
+	// KeyDigest is the SHA-256 of the public key block, the value burned
+	// into the eFuse key digest of devices trusting the key
+	KeyDigest   string `json:"key_digest"`
+	ImageDigest string `json:"image_digest"`
+	// DigestValid reports whether ImageDigest matches the signed image
+	DigestValid bool `json:"digest_valid"`
+	// SignatureValid reports whether the signature of ImageDigest verifies
+	SignatureValid bool             `json:"signature_valid"`
+	PublicKey      crypto.PublicKey `json:"-"`
+}
+
+// Valid reports whether the block signs the image it follows
+func (s *Signature) Valid() bool {
+	return s.DigestValid && s.SignatureValid
+}
+
+// SignatureOffset returns the offset of the signature sector behind an image
+// of length bytes, which is padded with 0xFF up to the next sector
+func SignatureOffset(length int) int {
+	return (length + SignatureSectorSize - 1) &^ (SignatureSectorSize - 1)
+}
+
+// reversed returns a copy of b in reverse byte order, the ROM stores big
+// numbers little endian
+func reversed(b []byte) []byte {
+	r := bytes.Clone(b)
+	slices.Reverse(r)
+	return r
+}
+
+// ParseSignatures parses the signature sector behind the image of length
+// bytes at the start of data and verifies every signature block against the
+// image. Images without signature sector have no signatures. Malformed
+// blocks are reported as error.
+func ParseSignatures(data []byte, length int) ([]Signature, error) {
+	offset := SignatureOffset(length)
+	if offset+SignatureSectorSize > len(data) || data[offset] != SignatureBlockMagic {
+		return nil, nil
+	}
+	digest := sha256.Sum256(data[:offset])
+	var signatures []Signature
+	for i := 0; i < MaxSignatures; i++ {
+		block := data[offset+i*SignatureBlockSize : offset+(i+1)*SignatureBlockSize]
+		if block[0] != SignatureBlockMagic {
+			break
+		}
+		signature, err := parseSignatureBlock(block, digest)
+		if err != nil {
+			return nil, fmt.Errorf("signature block %d: %w", i, err)
+		}
+		signatures = append(signatures, *signature)
+	}
+	return signatures, nil
+}
+
+func parseSignatureBlock(block []byte, digest [sha256.Size]byte) (*Signature, error) {
+	if crc := crc32.ChecksumIEEE(block[:signatureCRCOffset]); crc != binary.LittleEndian.Uint32(block[signatureCRCOffset:]) {
+		return nil, fmt.Errorf("CRC mismatch: computed %08x", crc)
+	}
+	signature := &Signature{
+		Scheme:      SchemeName(block[1]),
+		ImageDigest: hex.EncodeToString(block[4:signatureDigestEnd]),
+		DigestValid: bytes.Equal(block[4:signatureDigestEnd], digest[:]),
+	}
+	imageDigest := block[4:signatureDigestEnd]
+	var keyBlock []byte
+	switch block[1] {
+	case SchemeRSA3072PSS:
+		keyBlock = block[signatureDigestEnd : signatureDigestEnd+rsaKeyBlockSize]
+		key, err := parseRSAKeyBlock(keyBlock)
+		if err != nil {
+			return nil, err
+		}
+		sig := reversed(block[signatureDigestEnd+rsaKeyBlockSize : signatureDigestEnd+rsaKeyBlockSize+rsaKeySize])
+		signature.PublicKey = key
+		signature.SignatureValid = rsa.VerifyPSS(key, crypto.SHA256, imageDigest, sig, &rsa.PSSOptions{SaltLength: pssSaltLength}) == nil
+	case SchemeECDSAP256:
+		keyBlock = block[signatureDigestEnd : signatureDigestEnd+ecdsaKeyBlockSize]
+		key, err := parseECDSAKeyBlock(keyBlock)
+		if err != nil {
+			return nil, err
+		}
+		sig := block[signatureDigestEnd+ecdsaKeyBlockSize:]
+		r := new(big.Int).SetBytes(reversed(sig[:ecdsaCoordSize]))
+		s := new(big.Int).SetBytes(reversed(sig[ecdsaCoordSize : 2*ecdsaCoordSize]))
+		signature.PublicKey = key
+		signature.SignatureValid = ecdsa.Verify(key, imageDigest, r, s)
+	default:
+		return nil, fmt.Errorf("unknown signature scheme 0x%02x", block[1])
+	}
+	keyDigest := sha256.Sum256(keyBlock)
+	signature.KeyDigest = hex.EncodeToString(keyDigest[:])
+	return signature, nil
+}
+
+// rsaKeyBlock returns n, e and the Montgomery parameters rinv and mdash the
+// ROM uses for the modular exponentiation
+func rsaKeyBlock(key *rsa.PublicKey) []byte {
+	r := new(big.Int).Lsh(big.NewInt(1), 2*rsaKeyBits)
+	rinv := r.Mod(r, key.N)
+	word := new(big.Int).Lsh(big.NewInt(1), 32)
+	mdash := new(big.Int).ModInverse(key.N, word)
+	mdash.Sub(word, mdash).Mod(mdash, word)
+
+	block := make([]byte, 0, rsaKeyBlockSize)
+	block = append(block, reversed(key.N.FillBytes(make([]byte, rsaKeySize)))...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(key.E))
+	block = append(block, reversed(rinv.FillBytes(make([]byte, rsaKeySize)))...)
+	return binary.LittleEndian.AppendUint32(block, uint32(mdash.Uint64()))
+}
+
+func parseRSAKeyBlock(block []byte) (*rsa.PublicKey, error) {
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(reversed(block[:rsaKeySize])),
+		E: int(binary.LittleEndian.Uint32(block[rsaKeySize:])),
+	}
+	if key.N.BitLen() != rsaKeyBits || key.N.Bit(0) == 0 {
+		return nil, errors.New("public key is not an RSA-3072 modulus")
+	}
+	if !bytes.Equal(rsaKeyBlock(key), block) {
+		return nil, errors.New("RSA key parameters rinv and mdash do not match the modulus")
+	}
+	return key, nil
+}
+
+func ecdsaKeyBlock(key *ecdsa.PublicKey) []byte {
+	block := []byte{ecdsaCurveP256}
+	block = append(block, reversed(key.X.FillBytes(make([]byte, ecdsaCoordSize)))...)
+	return append(block, reversed(key.Y.FillBytes(make([]byte, ecdsaCoordSize)))...)
+}
+
+func parseECDSAKeyBlock(block []byte) (*ecdsa.PublicKey, error) {
+	if block[0] != ecdsaCurveP256 {
+		return nil, fmt.Errorf("unsupported ECDSA curve %d", block[0])
+	}
+	x := reversed(block[1 : 1+ecdsaCoordSize])
+	y := reversed(block[1+ecdsaCoordSize:])
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, errors.New("public key is not a P-256 point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// SigningKey signs images for Secure Boot V2
+type SigningKey struct {
+	signer   crypto.Signer
+	scheme   uint8
+	keyBlock []byte
+}
+
+// ParseSigningKey reads an RSA-3072 or ECDSA P-256 private key in PEM format
+// as generated by `espsecure.py generate_signing_key`
+func ParseSigningKey(pemData []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() != rsaKeyBits {
+			return nil, fmt.Errorf("RSA key has %d bits, Secure Boot V2 requires %d", key.N.BitLen(), rsaKeyBits)
+		}
+		return &SigningKey{signer: key, scheme: SchemeRSA3072PSS, keyBlock: rsaKeyBlock(&key.PublicKey)}, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA key uses %s, Secure Boot V2 requires P-256", key.Curve.Params().Name)
+		}
+		return &SigningKey{signer: key, scheme: SchemeECDSAP256, keyBlock: ecdsaKeyBlock(&key.PublicKey)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// Scheme returns the name of the signature scheme of the key
+func (k *SigningKey) Scheme() string {
+	return SchemeName(k.scheme)
+}
+
+// KeyDigest returns the hex encoded SHA-256 of the public key block as
+// burned into the eFuses of devices trusting the key
+func (k *SigningKey) KeyDigest() string {
+	digest := sha256.Sum256(k.keyBlock)
+	return hex.EncodeToString(digest[:])
+}
+
+// SignatureSector returns a signature sector holding a single signature
+// block over the SHA-256 digest of the padded image
+func (k *SigningKey) SignatureSector(digest []byte) ([]byte, error) {
+	if len(digest) != sha256.Size {
+		return nil, errors.New("digest is not a SHA-256")
+	}
+	block := []byte{SignatureBlockMagic, k.scheme, 0, 0}
+	block = append(block, digest...)
+	block = append(block, k.keyBlock...)
+	switch k.scheme {
+	case SchemeRSA3072PSS:
+		sig, err := k.signer.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: pssSaltLength, Hash: crypto.SHA256})
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, reversed(sig)...)
+	case SchemeECDSAP256:
+		der, err := k.signer.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		var sig struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(der, &sig); err != nil {
+			return nil, err
+		}
+		block = append(block, reversed(sig.R.FillBytes(make([]byte, ecdsaCoordSize)))...)
+		block = append(block, reversed(sig.S.FillBytes(make([]byte, ecdsaCoordSize)))...)
+	}
+	block = append(block, make([]byte, signatureCRCOffset-len(block))...)
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(block))
+	block = append(block, make([]byte, SignatureBlockSize-len(block))...)
+	return append(block, bytes.Repeat([]byte{0xFF}, SignatureSectorSize-len(block))...), nil
+}
+
+// SignImage returns the image of length bytes at the start of data padded
+// to the signature sector and signed with key like `espsecure.py
+// sign_data --version 2`. Existing signatures are replaced.
+func SignImage(data []byte, length int, key *SigningKey) ([]byte, error) {
+	if length > len(data) {
+		return nil, errors.New("image exceeds the data")
+	}
+	offset := SignatureOffset(length)
+	signed := make([]byte, offset, offset+SignatureSectorSize)
+	copy(signed, data[:length])
+	copy(signed[length:], bytes.Repeat([]byte{0xFF}, offset-length))
+	digest := sha256.Sum256(signed)
+	sector, err := key.SignatureSector(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(signed, sector...), nil
+}
@@ -0,0 +1,105 @@
+package esp_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	rsaKeyDigest   = "2ef1b3cce490ad3f87f7e240ed44e6f2e0567c3d38e31554e98962899278f550"
+	ecdsaKeyDigest = "9c0f1d9e0a8ecfc1062212c05008e903abbcf76d298358ab0b13e7d0740865da"
+)
+
+func readSigningKey(t *testing.T, name string) *esp.SigningKey {
+	t.Helper()
+	pemData, err := os.ReadFile("../test/secureboot/" + name)
+	require.NoError(t, err)
+	key, err := esp.ParseSigningKey(pemData)
+	require.NoError(t, err)
+	return key
+}
+
+func TestParseSignatures(t *testing.T) {
+	t.Parallel()
+
+	// signed with openssl: one RSA-3072 PSS and one ECDSA P-256 block
+	signed, err := os.ReadFile("../test/secureboot/bootloader-signed.bin")
+	require.NoError(t, err)
+	img, err := esp.ParseImage(signed)
+	require.NoError(t, err)
+	assert.Equal(t, 0x6000, esp.SignatureOffset(img.Length))
+
+	signatures, err := esp.ParseSignatures(signed, img.Length)
+	require.NoError(t, err)
+	require.Len(t, signatures, 2)
+	assert.Equal(t, "RSA-3072-PSS", signatures[0].Scheme)
+	assert.Equal(t, rsaKeyDigest, signatures[0].KeyDigest)
+	assert.Equal(t, "6e34905ddeae2d1d15b6888bf33cca2570f2a85bf655d385085f7f12b2259980", signatures[0].ImageDigest)
+	assert.True(t, signatures[0].Valid())
+	assert.Equal(t, "ECDSA-P256", signatures[1].Scheme)
+	assert.Equal(t, ecdsaKeyDigest, signatures[1].KeyDigest)
+	assert.True(t, signatures[1].Valid())
+
+	// the padding is signed as well
+	tampered := append([]byte{}, signed...)
+	tampered[img.Length] = 0
+	signatures, err = esp.ParseSignatures(tampered, img.Length)
+	require.NoError(t, err)
+	assert.False(t, signatures[0].DigestValid)
+	assert.True(t, signatures[0].SignatureValid)
+
+	// a forged digest breaks the signature and, unless fixed, the CRC
+	tampered = append([]byte{}, signed...)
+	tampered[0x6000+4] ^= 1
+	_, err = esp.ParseSignatures(tampered, img.Length)
+	assert.ErrorContains(t, err, "signature block 0: CRC mismatch")
+
+	signatures, err = esp.ParseSignatures(signed[:0x6000], img.Length)
+	assert.NoError(t, err)
+	assert.Empty(t, signatures)
+}
+
+func TestSignImage(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	app := firmware[0x20000:]
+	img, err := esp.ParseImage(app)
+	require.NoError(t, err)
+
+	for name, expected := range map[string]struct{ scheme, digest string }{
+		"rsa3072.pem":    {"RSA-3072-PSS", rsaKeyDigest},
+		"ecdsa-p256.pem": {"ECDSA-P256", ecdsaKeyDigest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			key := readSigningKey(t, name)
+			assert.Equal(t, expected.scheme, key.Scheme())
+			assert.Equal(t, expected.digest, key.KeyDigest())
+
+			signed, err := esp.SignImage(app, img.Length, key)
+			require.NoError(t, err)
+			assert.Equal(t, 0x10c000, len(signed))
+			assert.Equal(t, app[:img.Length], signed[:img.Length])
+
+			signatures, err := esp.ParseSignatures(signed, img.Length)
+			require.NoError(t, err)
+			require.Len(t, signatures, 1)
+			assert.Equal(t, expected.digest, signatures[0].KeyDigest)
+			assert.True(t, signatures[0].Valid())
+
+			// re-signing replaces the existing signature
+			resigned, err := esp.SignImage(signed, img.Length, key)
+			require.NoError(t, err)
+			assert.Len(t, resigned, len(signed))
+		})
+	}
+
+	_, err = esp.ParseSigningKey([]byte("not a key"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+// Package flashcrypt produces and reads pre-encrypted flash images for
+// ESP32-C6 devices with flash encryption enabled, like `espsecure.py
+// encrypt_flash_data` and `idf.py encrypted-flash` do.
+package flashcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"golang.org/x/crypto/xts"
+)
+
+// KeySize is the size of the XTS-AES-128 key of the ESP32-C6, two AES-128
+// keys as generated by `espsecure.py generate_flash_encryption_key`
+const KeySize = 32
+
+// unitSize is the data unit of the flash encryption; every unit is encrypted
+// with its flash address as tweak
+const unitSize = 0x80
+
+// blockSize is the alignment of encrypted addresses and lengths
+const blockSize = 16
+
+// crypt applies XTS-AES to data written at address in the layout of the
+// flash controller: data units are byte reversed before and after the
+// cipher, partial units are padded with zeros.
+func crypt(key []byte, address uint32, data []byte, decrypt bool) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("flash encryption key has %d bytes, expected %d", len(key), KeySize)
+	}
+	if address%blockSize != 0 || len(data)%blockSize != 0 {
+		return nil, fmt.Errorf("address 0x%x and length %d must be multiples of %d", address, len(data), blockSize)
+	}
+	if uint64(address)+uint64(len(data)) > 1<<32 {
+		return nil, errors.New("data exceeds the flash address space")
+	}
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	unit := make([]byte, unitSize)
+	for pos := 0; pos < len(data); {
+		unitAddress := (address + uint32(pos)) &^ (unitSize - 1)
+		start := int(address + uint32(pos) - unitAddress)
+		n := min(unitSize-start, len(data)-pos)
+		clear(unit)
+		copy(unit[start:], data[pos:pos+n])
+		slices.Reverse(unit)
+		if decrypt {
+			cipher.Decrypt(unit, unit, uint64(unitAddress))
+		} else {
+			cipher.Encrypt(unit, unit, uint64(unitAddress))
+		}
+		slices.Reverse(unit)
+		copy(out[pos:], unit[start:start+n])
+		pos += n
+	}
+	return out, nil
+}
+
+// Encrypt returns data encrypted for the flash at address. Address and
+// length must be multiples of 16.
+func Encrypt(key []byte, address uint32, data []byte) ([]byte, error) {
+	return crypt(key, address, data, false)
+}
+
+// Decrypt reverses Encrypt
+func Decrypt(key []byte, address uint32, data []byte) ([]byte, error) {
+	return crypt(key, address, data, true)
+}
+
+// Options locate the parts of a merged image
+type Options struct {
+	// PartitionTableOffset defaults to partition.DefaultOffset
+	PartitionTableOffset int
+}
+
+// CheckChip refuses chip families whose flash is not encrypted with the
+// XTS-AES-128 scheme of the ESP32-C6 this package implements. The other
+// families differ in key sizes, data layout or bootloader offset.
+func CheckChip(chip *esp.Chip) error {
+	switch chip {
+	case esp.ESP32C6:
+		return nil
+	case nil:
+		return errors.New("flash encryption of unknown chip families is not supported")
+	}
+	return fmt.Errorf("flash encryption of %s images is not supported", chip.Name)
+}
+
+// Region is a range of a merged image that is written encrypted
+type Region struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+}
+
+// imageExtent returns the length of the image at the start of data
+// including its signature sector, aligned to blockSize
+func imageExtent(data []byte) (int, error) {
+	img, err := esp.ParseImage(data)
+	if err != nil {
+		return 0, err
+	}
+	end := img.Length
+	if signatures, _ := esp.ParseSignatures(data, img.Length); len(signatures) > 0 {
+		end = esp.SignatureOffset(img.Length) + esp.SignatureSectorSize
+	}
+	return min(len(data), (end+blockSize-1)&^(blockSize-1)), nil
+}
+
+func erased(data []byte) bool {
+	return len(bytes.Trim(data, "\xff")) == 0
+}
+
+// regions lists the encrypted ranges of a merged image like ESP-IDF flashes
+// them: the bootloader, the partition table, otadata, the app images and
+// partitions flagged encrypted or holding NVS keys. plain returns the
+// plaintext of a range. Erased partitions are not written, except otadata
+// that is encrypted when writing an image.
+func regions(image []byte, opts Options, plain func(offset int, size int) ([]byte, error), encrypting bool) ([]Region, error) {
+	if opts.PartitionTableOffset == 0 {
+		opts.PartitionTableOffset = partition.DefaultOffset
+	}
+	bootloaderOffset := esp.ESP32C6.BootloaderOffset
+	if opts.PartitionTableOffset+partition.MaxTableSize > len(image) || bootloaderOffset >= opts.PartitionTableOffset {
+		return nil, errors.New("the image holds no partition table")
+	}
+	data, err := plain(bootloaderOffset, opts.PartitionTableOffset-bootloaderOffset)
+	if err != nil {
+		return nil, err
+	}
+	if img, err := esp.ParseImage(data); err == nil {
+		if err = CheckChip(img.Chip); err != nil {
+			return nil, err
+		}
+	}
+	extent, err := imageExtent(data)
+	if err != nil {
+		return nil, fmt.Errorf("bootloader: %w", err)
+	}
+	result := []Region{{Name: "bootloader", Offset: bootloaderOffset, Size: extent}}
+
+	if data, err = plain(opts.PartitionTableOffset, partition.MaxTableSize); err != nil {
+		return nil, err
+	}
+	table, err := partition.ParseBinary(data)
+	if err != nil {
+		return nil, fmt.Errorf("partition table: %w", err)
+	}
+	result = append(result, Region{Name: "partition table", Offset: opts.PartitionTableOffset, Size: partition.MaxTableSize})
+
+	for _, entry := range table.Entries {
+		offset := int(entry.Offset)
+		if offset >= len(image) {
+			continue
+		}
+		size := min(int(entry.Size), len(image)-offset) &^ (blockSize - 1)
+		otaData := entry.Type == partition.TypeData && entry.SubType == partition.SubTypeOTAData
+		if erased(image[offset:offset+size]) && !(otaData && encrypting) {
+			continue
+		}
+		switch {
+		case entry.Type == partition.TypeApp:
+			if data, err = plain(offset, size); err != nil {
+				return nil, err
+			}
+			if size, err = imageExtent(data); err != nil {
+				return nil, fmt.Errorf("app %s: %w", entry.Label, err)
+			}
+		case otaData, entry.Flags&partition.FlagEncrypted != 0,
+			entry.Type == partition.TypeData && entry.SubType == partition.SubTypeNVSKeys:
+		default:
+			continue
+		}
+		result = append(result, Region{Name: entry.Label, Offset: offset, Size: size})
+	}
+	return result, nil
+}
+
+// transform returns a copy of image with every region replaced by apply
+func transform(image []byte, list []Region, apply func(address uint32, data []byte) ([]byte, error)) ([]byte, []Region, error) {
+	out := bytes.Clone(image)
+	for _, region := range list {
+		data, err := apply(uint32(region.Offset), image[region.Offset:region.Offset+region.Size])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", region.Name, err)
+		}
+		copy(out[region.Offset:], data)
+	}
+	return out, list, nil
+}
+
+// EncryptImage encrypts the parts of a plaintext merged image that the
+// bootloader reads through the flash encryption, leaving everything else,
+// including erased flash, as it is. The result can be written to a device
+// in development mode without `--encrypt`.
+func EncryptImage(image []byte, key []byte, opts Options) ([]byte, []Region, error) {
+	// bootloaders of other families are not at the offset checked by regions
+	if chip := esp.BootloaderChip(image); chip != nil {
+		if err := CheckChip(chip); err != nil {
+			return nil, nil, err
+		}
+	}
+	list, err := regions(image, opts, func(offset int, size int) ([]byte, error) {
+		return image[offset : offset+size], nil
+	}, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transform(image, list, func(address uint32, data []byte) ([]byte, error) {
+		return Encrypt(key, address, data)
+	})
+}
+
+// DecryptImage reverses EncryptImage, e.g. for inspecting a flash dump of
+// an encrypted device. A wrong key fails to parse the bootloader.
+func DecryptImage(image []byte, key []byte, opts Options) ([]byte, []Region, error) {
+	list, err := regions(image, opts, func(offset int, size int) ([]byte, error) {
+		size = min(size, len(image)-offset) &^ (blockSize - 1)
+		return Decrypt(key, uint32(offset), image[offset:offset+size])
+	}, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transform(image, list, func(address uint32, data []byte) ([]byte, error) {
+		return Decrypt(key, address, data)
+	})
+}
@@ -0,0 +1,123 @@
+package flashcrypt_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey is 00 01 .. 1f
+func testKey() []byte {
+	key := make([]byte, flashcrypt.KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestEncrypt(t *testing.T) {
+	t.Parallel()
+
+	plaintext := make([]byte, 0x100)
+	for i := range plaintext {
+		plaintext[i] = byte(i*7 + 3)
+	}
+	// computed with an independent XTS implementation on AES-ECB, checked
+	// against the IEEE 1619 test vectors, in the unit layout of espsecure
+	tests := []struct {
+		address uint32
+		length  int
+		cipher  string
+	}{
+		{0x0, 0x100, "cdf65c23e1249b9755fce07e399d06c3354316196ca6d064299e9610f2f0da1ce4e7a9dc85e88f9bc723c576a197f2f9a6ccaeff665ff28969bc2b7ebc3032051c9e0639891ef90ed104108b2d543b2e5a378f48cc6290052885c8cf6c57dfcda30957df21ff9d3422070c40d67ab73f34c94d7ada00e272cd7a76414bf1cd3a13958ef06d695894dc3f7fe3e8cd1f5f8ea71274385fbc86321259da643a309caba6169ae73721d7100ece04d7cb9276b1ce4aa928721c99e9b0a6ca35b2af98a92e212774d2fce928bc62007eced6b6006a966d2d42ae5064f408cb76f28927f36b2960266d838e3270ffd05adae0df967e0a9390069cbd0ef3e8fcb554f821"},
+		{0x20000, 0x100, "1242cfc84a29946340a394a5499eea35b75366dbb16bcdb9343779b135ee138ae5cb11bc85b68529c7bac62d0cd47be6370ceaf7fbeca8150f76eecc4f9dc176e2e4db972ca34b76d9db07f6bbcde78b5f7acb6703b3f52c91e93e6d97d2945d746a9d26daa75791c9d3c7f7d7f0575d738b1cba10c0566cfcfb154de337ec63b7160f4bae3bacec7ecacf6c16d512de2a55a9aa3aac1f0edebde837af48733aa2e035be684d16fed4a07a3bc50845ca6e5c20cf7199d370ca0b2cca3c96633dcc0161d04c5024fcae9bcf44f08874fcd66f79cd4eecda1a797c91256c03ca4916983c5e97c52fb3dbe00f3ff086d104924837ca18c4c0f9925334e3a4d6f15c"},
+		// starts and ends inside a data unit
+		{0x8030, 0x60, "5abde44f8b29ec82228545b48893e8636c38fcd7306240fc865e75170e8cd68d1374ef884a41711d94c50c0bb1b50a59bff45c9ef25112370f193291032426729c8fb6414cfc254bee296de3919ed1090b267f3e32b14920bdbc1591a52c6590"},
+	}
+	for _, tt := range tests {
+		ciphertext, err := flashcrypt.Encrypt(testKey(), tt.address, plaintext[:tt.length])
+		require.NoError(t, err)
+		assert.Equal(t, tt.cipher, hex.EncodeToString(ciphertext), "0x%x", tt.address)
+		decrypted, err := flashcrypt.Decrypt(testKey(), tt.address, mustDecode(t, tt.cipher))
+		require.NoError(t, err)
+		assert.Equal(t, plaintext[:tt.length], decrypted)
+	}
+
+	_, err := flashcrypt.Encrypt(testKey()[:16], 0, plaintext)
+	assert.ErrorContains(t, err, "expected 32")
+	_, err = flashcrypt.Encrypt(testKey(), 0x8, plaintext)
+	assert.ErrorContains(t, err, "multiples of 16")
+	_, err = flashcrypt.Encrypt(testKey(), 0, plaintext[:15])
+	assert.ErrorContains(t, err, "multiples of 16")
+}
+
+func TestEncryptImage(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+
+	encrypted, regions, err := flashcrypt.EncryptImage(firmware, testKey(), flashcrypt.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []flashcrypt.Region{
+		{Name: "bootloader", Offset: 0x0, Size: 0x57e0},
+		{Name: "partition table", Offset: 0x8000, Size: 0xc00},
+		{Name: "otadata", Offset: 0xF000, Size: 0x2000},
+		{Name: "factory", Offset: 0x20000, Size: 0x10aff0},
+	}, regions)
+	sum := sha256.Sum256(encrypted)
+	assert.Equal(t, "29d9f4806ecabff4102930e3ab0c1f622f1221773ffe3ee0af4dd593bc71c584", hex.EncodeToString(sum[:]))
+	// nvs and the erased flash are written as they are
+	assert.Equal(t, firmware[0x57e0:0x8000], encrypted[0x57e0:0x8000])
+	assert.Equal(t, firmware[0x9000:0xF000], encrypted[0x9000:0xF000])
+
+	decrypted, regions, err := flashcrypt.DecryptImage(encrypted, testKey(), flashcrypt.Options{})
+	require.NoError(t, err)
+	assert.Len(t, regions, 4)
+	assert.True(t, bytes.Equal(firmware, decrypted))
+
+	wrongKey := testKey()
+	wrongKey[0] ^= 1
+	_, _, err = flashcrypt.DecryptImage(encrypted, wrongKey, flashcrypt.Options{})
+	assert.ErrorContains(t, err, "bootloader")
+}
+
+func TestEncryptImageRejectsOtherChips(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	assert.NoError(t, flashcrypt.CheckChip(esp.ESP32C6))
+	assert.ErrorContains(t, flashcrypt.CheckChip(nil), "unknown chip families")
+
+	// the ESP32-S3 bootloader is at 0x0 as well
+	s3 := bytes.Clone(firmware)
+	binary.LittleEndian.PutUint16(s3[12:], esp.ESP32S3.ID)
+	require.NoError(t, esp.SetFlashParams(s3, esp.FlashParams{}))
+	_, _, err = flashcrypt.EncryptImage(s3, testKey(), flashcrypt.Options{})
+	assert.ErrorContains(t, err, "flash encryption of ESP32-S3 images is not supported")
+
+	// the ESP32 bootloader is at 0x1000
+	esp32 := bytes.Clone(firmware)
+	copy(esp32[:0x1000], bytes.Repeat([]byte{0xFF}, 0x1000))
+	copy(esp32[0x1000:0x8000], firmware[:0x7000])
+	binary.LittleEndian.PutUint16(esp32[0x1000+12:], esp.ESP32.ID)
+	require.NoError(t, esp.SetFlashParams(esp32[0x1000:], esp.FlashParams{}))
+	_, _, err = flashcrypt.EncryptImage(esp32, testKey(), flashcrypt.Options{})
+	assert.ErrorContains(t, err, "flash encryption of ESP32 images is not supported")
+}
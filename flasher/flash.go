@@ -0,0 +1,60 @@
+package flasher
+
+import (
+	"fmt"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+)
+
+// Options controls a flashing session
+type Options struct {
+	// Offset is the flash address the image is written to
+	Offset uint32
+	// Chip is the expected chip family, e.g. "ESP32-C6". Empty accepts any chip.
+	Chip string
+	// ChipRevisions is the range of chip revisions the image runs on, nil
+	// skips the revision check
+	ChipRevisions *esp.ChipRevisionRange
+	// FlashSize is the size of the attached SPI flash in bytes
+	FlashSize uint32
+	// Compress transfers the image DEFLATE compressed
+	Compress bool
+	// Reboot starts the application after flashing
+	Reboot bool
+	// Progress is called after every written block
+	Progress func(written int, total int)
+}
+
+// Flash writes image to a chip in download mode and verifies it. It returns
+// the detected chip family.
+func Flash(loader *Loader, image []byte, opts Options) (string, error) {
+	if err := loader.Sync(10); err != nil {
+		return "", err
+	}
+	chip, err := loader.DetectChip()
+	if err != nil {
+		return "", err
+	}
+	if opts.Chip != "" && opts.Chip != chip {
+		return chip, fmt.Errorf("image is built for %s but a %s is connected", opts.Chip, chip)
+	}
+	if opts.ChipRevisions != nil {
+		rev, err := loader.ChipRevision(chip)
+		if err != nil {
+			return chip, err
+		}
+		if !opts.ChipRevisions.Contains(rev) {
+			return chip, fmt.Errorf("image runs on chip revisions %s but the %s is %s", opts.ChipRevisions, chip, rev)
+		}
+	}
+	if opts.FlashSize != 0 && uint64(opts.Offset)+uint64(len(image)) > uint64(opts.FlashSize) {
+		return chip, fmt.Errorf("image of %d bytes at 0x%x exceeds the flash size of %d bytes", len(image), opts.Offset, opts.FlashSize)
+	}
+	if err = loader.AttachFlash(opts.FlashSize); err != nil {
+		return chip, err
+	}
+	if err = loader.WriteFlash(opts.Offset, image, opts.Compress, opts.Progress); err != nil {
+		return chip, err
+	}
+	return chip, loader.Finish(opts.Reboot)
+}
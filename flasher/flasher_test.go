@@ -0,0 +1,308 @@
+//go:build linux
+
+package flasher
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master side of a new pseudo-terminal and the path of
+// its slave device.
+func openPTY(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals are not available: %v", err)
+	}
+	if err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("failed to unlock pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	require.NoError(t, err)
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// romSimulator emulates the ESP32-C6 ROM loader on the master side of a pty
+type romSimulator struct {
+	port       io.ReadWriter
+	flash      []byte
+	offset     uint32
+	blockSize  uint32
+	blocks     uint32
+	compressed bytes.Buffer
+	commands   []byte
+	// beginSize is the payload size of the last FLASH_BEGIN
+	beginSize int
+	// revision is the chip revision stored in the eFuses
+	revision uint32
+	// magic is the value of the chip detect register
+	magic uint32
+	// securityInfo answers GET_SECURITY_INFO, empty like old ROMs
+	securityInfo []byte
+}
+
+func newROMSimulator(port io.ReadWriter) *romSimulator {
+	// an ESP32-C6 v0.1
+	return &romSimulator{port: port, flash: bytes.Repeat([]byte{0xFF}, 4*1024*1024), revision: 1 << 18, magic: 0x2CE0806F}
+}
+
+func (r *romSimulator) respond(op byte, value uint32, payload []byte, status byte) {
+	packet := []byte{directionResponse, op, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(packet[4:], value)
+	packet = append(packet, payload...)
+	packet = append(packet, status, 0, 0, 0)
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(packet)-8))
+	_, _ = r.port.Write(slipEncode(packet))
+}
+
+func (r *romSimulator) run() {
+	reader := newSlipReader(r.port)
+	for {
+		frame, err := reader.ReadFrame(time.Now().Add(time.Hour))
+		if err != nil {
+			return
+		}
+		op := frame[1]
+		chk := binary.LittleEndian.Uint32(frame[4:])
+		data := frame[8:]
+		arg := func(i int) uint32 { return binary.LittleEndian.Uint32(data[4*i:]) }
+		r.commands = append(r.commands, op)
+
+		switch op {
+		case CmdSync:
+			// the ROM answers every sync request several times
+			for i := 0; i < 4; i++ {
+				r.respond(op, 0x20120707, nil, 0)
+			}
+		case CmdReadReg:
+			switch arg(0) {
+			case ChipDetectMagicReg:
+				r.respond(op, r.magic, nil, 0)
+			case 0x600B0850:
+				r.respond(op, r.revision, nil, 0)
+			default:
+				r.respond(op, 0, nil, 1)
+			}
+		case CmdSecurityInfo:
+			r.respond(op, 0, r.securityInfo, 0)
+		case CmdFlashBegin, CmdFlashDeflBegin:
+			r.blocks, r.blockSize, r.offset = arg(1), arg(2), arg(3)
+			r.beginSize = len(data)
+			r.compressed.Reset()
+			r.respond(op, 0, nil, 0)
+		case CmdFlashData, CmdFlashDeflData:
+			block := data[16:]
+			if checksum(block) != chk || uint32(len(block)) != arg(0) {
+				r.respond(op, 0, nil, 1)
+				continue
+			}
+			if op == CmdFlashData {
+				copy(r.flash[r.offset+arg(1)*r.blockSize:], block)
+			} else {
+				r.compressed.Write(block)
+				if arg(1) == r.blocks-1 {
+					inflater, err := zlib.NewReader(&r.compressed)
+					if err != nil {
+						r.respond(op, 0, nil, 1)
+						continue
+					}
+					plain, _ := io.ReadAll(inflater)
+					copy(r.flash[r.offset:], plain)
+				}
+			}
+			r.respond(op, 0, nil, 0)
+		case CmdSpiFlashMD5:
+			sum := md5.Sum(r.flash[arg(0) : arg(0)+arg(1)])
+			r.respond(op, 0, []byte(hex.EncodeToString(sum[:])), 0)
+		default:
+			r.respond(op, 0, nil, 0)
+		}
+	}
+}
+
+func testFlash(t *testing.T, compress bool) {
+	master, slave := openPTY(t)
+	defer master.Close()
+
+	sim := newROMSimulator(master)
+	done := make(chan struct{})
+	go func() {
+		sim.run()
+		close(done)
+	}()
+
+	port, err := OpenPort(slave, 115200)
+	require.NoError(t, err)
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	image := firmware[:0x30000]
+
+	var progress int
+	chip, err := Flash(NewLoader(port), image, Options{
+		Offset:        0x1000,
+		Chip:          "ESP32-C6",
+		ChipRevisions: &esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)},
+		FlashSize:     4 * 1024 * 1024,
+		Compress:      compress,
+		Progress:      func(written int, _ int) { progress = written },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ESP32-C6", chip)
+	assert.Greater(t, progress, 0)
+
+	require.NoError(t, port.Close())
+	require.NoError(t, master.Close())
+	<-done
+	assert.True(t, bytes.Equal(image, sim.flash[0x1000:0x1000+len(image)]))
+	assert.Equal(t, byte(CmdSync), sim.commands[0])
+	// the begin of chips supporting encrypted flash writes ends with the
+	// encryption flag
+	assert.Equal(t, 20, sim.beginSize)
+	if compress {
+		assert.Contains(t, sim.commands, byte(CmdFlashDeflEnd))
+	} else {
+		assert.Contains(t, sim.commands, byte(CmdFlashEnd))
+	}
+}
+
+func TestFlashCompressed(t *testing.T) {
+	testFlash(t, true)
+}
+
+func TestFlashUncompressed(t *testing.T) {
+	testFlash(t, false)
+}
+
+func TestFlashESP32(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+	sim := newROMSimulator(master)
+	sim.magic = 0x00F01D83
+	done := make(chan struct{})
+	go func() {
+		sim.run()
+		close(done)
+	}()
+
+	port, err := OpenPort(slave, 115200)
+	require.NoError(t, err)
+
+	image := bytes.Repeat([]byte{0xE9, 0x03}, 0x2000)
+	chip, err := Flash(NewLoader(port), image, Options{Offset: 0x1000, Chip: "ESP32"})
+	require.NoError(t, err)
+	assert.Equal(t, "ESP32", chip)
+
+	require.NoError(t, port.Close())
+	require.NoError(t, master.Close())
+	<-done
+	assert.True(t, bytes.Equal(image, sim.flash[0x1000:0x1000+len(image)]))
+	// the ROM of the ESP32 expects no encryption flag
+	assert.Equal(t, 16, sim.beginSize)
+}
+
+func TestFlashRejectsOtherChips(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+	go newROMSimulator(master).run()
+
+	port, err := OpenPort(slave, 115200)
+	require.NoError(t, err)
+	defer port.Close()
+
+	_, err = Flash(NewLoader(port), []byte{0xE9}, Options{Chip: "ESP32-S3"})
+	assert.ErrorContains(t, err, "a ESP32-C6 is connected")
+}
+
+func TestDetectChip(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		magic        uint32
+		securityInfo []byte
+		chip         string
+	}{
+		{"magic", 0x2CE0806F, nil, "ESP32-C6"},
+		{"ESP32-C3 ECO7 magic", 0x4361606F, nil, "ESP32-C3"},
+		{"security info without chip ID", 0x4361606F, make([]byte, 12), "ESP32-C3"},
+		// the ESP32-P4 has no chip detect magic
+		{"security info chip ID", 0, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(make([]byte, 12), 18), 1), "ESP32-P4"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			master, slave := openPTY(t)
+			defer master.Close()
+			sim := newROMSimulator(master)
+			sim.magic, sim.securityInfo = test.magic, test.securityInfo
+			go sim.run()
+
+			port, err := OpenPort(slave, 115200)
+			require.NoError(t, err)
+			defer port.Close()
+
+			loader := NewLoader(port)
+			require.NoError(t, loader.Sync(10))
+			chip, err := loader.DetectChip()
+			require.NoError(t, err)
+			assert.Equal(t, test.chip, chip)
+		})
+	}
+}
+
+func TestSlipRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	packet := []byte{0x01, slipEnd, 0x02, slipEsc, slipEscEnd, 0x03}
+	encoded := slipEncode(packet)
+	assert.Equal(t, []byte{slipEnd, 0x01, slipEsc, slipEscEnd, 0x02, slipEsc, slipEscEsc, slipEscEnd, 0x03, slipEnd}, encoded)
+
+	stream := append([]byte("ESP-ROM:esp32c6 boot log\r\n"), encoded...)
+	stream = append(stream, slipEncode([]byte{0x42})...)
+	reader := newSlipReader(bytes.NewReader(stream))
+	frame, err := reader.ReadFrame(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, packet, frame)
+	frame, err = reader.ReadFrame(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x42}, frame)
+	_, err = reader.ReadFrame(time.Now().Add(10 * time.Millisecond))
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestFlashRejectsOtherChipRevisions(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+	sim := newROMSimulator(master)
+	// v1.2
+	sim.revision = 1<<22 | 2<<18
+	go sim.run()
+
+	port, err := OpenPort(slave, 115200)
+	require.NoError(t, err)
+	defer port.Close()
+
+	loader := NewLoader(port)
+	require.NoError(t, loader.Sync(10))
+	rev, err := loader.ChipRevision("ESP32-C6")
+	require.NoError(t, err)
+	assert.Equal(t, esp.NewChipRevision(1, 2), rev)
+	_, err = loader.ChipRevision("ESP32-S3")
+	assert.ErrorContains(t, err, "not supported")
+
+	_, err = Flash(loader, []byte{0xE9}, Options{
+		Chip:          "ESP32-C6",
+		ChipRevisions: &esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)},
+	})
+	assert.ErrorContains(t, err, "image runs on chip revisions v0.0 - v0.99 but the ESP32-C6 is v1.2")
+}
@@ -0,0 +1,334 @@
+package flasher
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+)
+
+// ROM loader commands
+const (
+	CmdFlashBegin     = 0x02
+	CmdFlashData      = 0x03
+	CmdFlashEnd       = 0x04
+	CmdSync           = 0x08
+	CmdReadReg        = 0x0A
+	CmdSpiSetParams   = 0x0B
+	CmdSpiAttach      = 0x0D
+	CmdChangeBaudrate = 0x0F
+	CmdFlashDeflBegin = 0x10
+	CmdFlashDeflData  = 0x11
+	CmdFlashDeflEnd   = 0x12
+	CmdSpiFlashMD5    = 0x13
+	CmdSecurityInfo   = 0x14
+)
+
+const (
+	directionRequest  = 0x00
+	directionResponse = 0x01
+	checksumMagic     = 0xEF
+	// romStatusLength is the number of status bytes the ROM of ESP32 and
+	// later chips appends to every response
+	romStatusLength = 4
+	// FlashWriteSize is the block size used by the ROM loader
+	FlashWriteSize = 0x400
+	// ChipDetectMagicReg holds a chip specific value on all ESP chips
+	ChipDetectMagicReg = 0x40001000
+)
+
+// timeouts used by esptool for the ROM loader
+const (
+	defaultTimeout      = 3 * time.Second
+	syncTimeout         = 100 * time.Millisecond
+	eraseTimeoutPerMB   = 30 * time.Second
+	writeTimeoutPerMB   = 40 * time.Second
+	md5TimeoutPerMB     = 8 * time.Second
+	minimumChunkTimeout = defaultTimeout
+)
+
+// DeviceError is returned if the ROM reports a failed command
+type DeviceError struct {
+	Command byte
+	Status  byte
+	Code    byte
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("command 0x%02x failed with status 0x%02x, error 0x%02x", e.Command, e.Status, e.Code)
+}
+
+// Loader talks to the ESP serial ROM bootloader
+type Loader struct {
+	port    io.ReadWriter
+	reader  *slipReader
+	deflate bool
+	// chip is the family found by DetectChip
+	chip *esp.Chip
+}
+
+// NewLoader creates a loader on a port already connected to a chip in
+// download mode
+func NewLoader(port io.ReadWriter) *Loader {
+	return &Loader{port: port, reader: newSlipReader(port)}
+}
+
+func checksum(data []byte) uint32 {
+	sum := uint32(checksumMagic)
+	for _, b := range data {
+		sum ^= uint32(b)
+	}
+	return sum
+}
+
+// command sends a request and waits for the matching response. It returns the
+// value field and the payload without the status bytes.
+func (l *Loader) command(op byte, data []byte, chk uint32, timeout time.Duration) (uint32, []byte, error) {
+	packet := make([]byte, 8, 8+len(data))
+	packet[0] = directionRequest
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], chk)
+	packet = append(packet, data...)
+	if _, err := l.port.Write(slipEncode(packet)); err != nil {
+		return 0, nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		frame, err := l.reader.ReadFrame(deadline)
+		if err != nil {
+			return 0, nil, fmt.Errorf("command 0x%02x: %w", op, err)
+		}
+		if len(frame) < 8 || frame[0] != directionResponse || frame[1] != op {
+			continue
+		}
+		value := binary.LittleEndian.Uint32(frame[4:])
+		payload := frame[8:]
+		if len(payload) < romStatusLength {
+			return 0, nil, fmt.Errorf("command 0x%02x: response too short", op)
+		}
+		status := payload[len(payload)-romStatusLength:]
+		if status[0] != 0 {
+			return 0, nil, &DeviceError{Command: op, Status: status[0], Code: status[1]}
+		}
+		return value, payload[:len(payload)-romStatusLength], nil
+	}
+}
+
+func words(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], v)
+	}
+	return data
+}
+
+func timeoutPerMB(perMB time.Duration, size int) time.Duration {
+	timeout := time.Duration(float64(perMB) * float64(size) / 1e6)
+	if timeout < minimumChunkTimeout {
+		return minimumChunkTimeout
+	}
+	return timeout
+}
+
+// Sync establishes communication with the ROM loader. The ROM may need
+// several attempts after reset until the autobaud detection succeeds.
+func (l *Loader) Sync(attempts int) (err error) {
+	payload := append([]byte{0x07, 0x07, 0x12, 0x20}, bytes.Repeat([]byte{0x55}, 32)...)
+	for i := 0; i < attempts; i++ {
+		if _, _, err = l.command(CmdSync, payload, 0, syncTimeout); err == nil {
+			// the ROM answers a sync request multiple times, drop the echoes
+			for {
+				if _, err := l.reader.ReadFrame(time.Now().Add(syncTimeout)); err != nil {
+					break
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to connect to the ROM loader: %w", err)
+}
+
+// ReadReg reads a 32 bit register of the chip
+func (l *Loader) ReadReg(addr uint32) (uint32, error) {
+	value, _, err := l.command(CmdReadReg, words(addr), 0, defaultTimeout)
+	return value, err
+}
+
+// securityInfoChipID returns the chip ID reported by GET_SECURITY_INFO. The
+// ROMs of the ESP32, ESP32-S2 and early ESP32-C3 do not report it.
+func (l *Loader) securityInfoChipID() (uint32, bool) {
+	_, info, err := l.command(CmdSecurityInfo, nil, 0, defaultTimeout)
+	// flags, flash_crypt_cnt, key_purposes[7], chip_id, eco_version
+	if err != nil || len(info) < 20 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(info[12:]), true
+}
+
+// DetectChip returns the chip family of the connected device: by the chip ID
+// of the security info like esptool does, which is the only way to detect
+// an ESP32-P4, or else by the chip detect magic
+func (l *Loader) DetectChip() (string, error) {
+	if id, ok := l.securityInfoChipID(); ok && id <= 0xFFFF {
+		if chip := esp.ChipByID(uint16(id)); chip != nil {
+			l.chip = chip
+			return chip.Name, nil
+		}
+	}
+	magic, err := l.ReadReg(ChipDetectMagicReg)
+	if err != nil {
+		return "", err
+	}
+	chip := esp.ChipByMagic(magic)
+	if chip == nil {
+		return "", fmt.Errorf("unknown chip magic 0x%08x", magic)
+	}
+	l.chip = chip
+	return chip.Name, nil
+}
+
+// ChipRevision returns the revision of the connected chip of family chip,
+// read from the eFuses listed in the chip table
+func (l *Loader) ChipRevision(chip string) (esp.ChipRevision, error) {
+	family := esp.ChipByName(chip)
+	if family == nil || family.RevisionEFuse == nil {
+		return 0, fmt.Errorf("reading the chip revision of a %s is not supported", chip)
+	}
+	word, err := l.ReadReg(family.RevisionEFuse.Addr)
+	if err != nil {
+		return 0, err
+	}
+	return family.RevisionEFuse.Decode(word), nil
+}
+
+// AttachFlash attaches the SPI flash and configures its geometry. A zero
+// flashSize keeps the geometry detected by the ROM.
+func (l *Loader) AttachFlash(flashSize uint32) error {
+	if _, _, err := l.command(CmdSpiAttach, words(0, 0), 0, defaultTimeout); err != nil {
+		return err
+	}
+	if flashSize == 0 {
+		return nil
+	}
+	_, _, err := l.command(CmdSpiSetParams, words(0, flashSize, 64*1024, 4*1024, 256, 0xFFFF), 0, defaultTimeout)
+	return err
+}
+
+// ChangeBaudrate switches the ROM loader to baud. The caller has to adjust
+// the local port afterwards.
+func (l *Loader) ChangeBaudrate(baud uint32) error {
+	_, _, err := l.command(CmdChangeBaudrate, words(baud, 0), 0, defaultTimeout)
+	return err
+}
+
+// FlashMD5 returns the MD5 of the flash region as computed by the chip
+func (l *Loader) FlashMD5(offset uint32, size uint32) ([]byte, error) {
+	_, payload, err := l.command(CmdSpiFlashMD5, words(offset, size, 0, 0), 0, timeoutPerMB(md5TimeoutPerMB, int(size)))
+	if err != nil {
+		return nil, err
+	}
+	switch len(payload) {
+	case 32:
+		// the ROM loader answers with the hex encoded digest
+		return hex.DecodeString(string(payload))
+	case 16:
+		return payload, nil
+	}
+	return nil, fmt.Errorf("unexpected MD5 response of %d bytes", len(payload))
+}
+
+// WriteFlash writes data at offset and verifies the result using the MD5
+// computed by the chip. With compress set the data is transferred DEFLATE
+// compressed. progress is called after every block if not nil. The chip
+// found by DetectChip decides whether the ROM expects the encryption flag.
+func (l *Loader) WriteFlash(offset uint32, data []byte, compress bool, progress func(written int, total int)) error {
+	beginCmd, dataCmd := byte(CmdFlashBegin), byte(CmdFlashData)
+	payload := data
+	if compress {
+		var compressed bytes.Buffer
+		writer, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return err
+		}
+		if err = writer.Close(); err != nil {
+			return err
+		}
+		beginCmd, dataCmd = CmdFlashDeflBegin, CmdFlashDeflData
+		payload = compressed.Bytes()
+	}
+	l.deflate = compress
+
+	blocks := (len(payload) + FlashWriteSize - 1) / FlashWriteSize
+	eraseSize := uint32(len(data))
+	if compress {
+		eraseSize = uint32((len(data) + FlashWriteSize - 1) / FlashWriteSize * FlashWriteSize)
+	}
+	begin := words(eraseSize, uint32(blocks), FlashWriteSize, offset)
+	if l.chip != esp.ESP32 {
+		// a zero tells the ROM that the data is not encrypted, the ROM of
+		// the ESP32 cannot write encrypted data and expects no such word
+		begin = append(begin, words(0)...)
+	}
+	if _, _, err := l.command(beginCmd, begin, 0, timeoutPerMB(eraseTimeoutPerMB, int(eraseSize))); err != nil {
+		return err
+	}
+
+	for seq := 0; seq < blocks; seq++ {
+		block := payload[seq*FlashWriteSize : min((seq+1)*FlashWriteSize, len(payload))]
+		timeout := timeoutPerMB(writeTimeoutPerMB, len(block))
+		if compress {
+			// a compressed block may expand to much more flash data
+			timeout = timeoutPerMB(writeTimeoutPerMB, 4*len(block))
+		} else if len(block) < FlashWriteSize {
+			block = append(bytes.Clone(block), bytes.Repeat([]byte{0xFF}, FlashWriteSize-len(block))...)
+		}
+		request := append(words(uint32(len(block)), uint32(seq), 0, 0), block...)
+		if _, _, err := l.command(dataCmd, request, checksum(block), timeout); err != nil {
+			return fmt.Errorf("block %d/%d: %w", seq+1, blocks, err)
+		}
+		if progress != nil {
+			progress(seq+1, blocks)
+		}
+	}
+
+	digest, err := l.FlashMD5(offset, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+	expected := md5.Sum(data)
+	if !bytes.Equal(digest, expected[:]) {
+		return fmt.Errorf("MD5 of written flash %x does not match %x", digest, expected)
+	}
+	return nil
+}
+
+// Finish ends the flashing session. If reboot is set the chip starts the
+// freshly written application.
+func (l *Loader) Finish(reboot bool) error {
+	stay := uint32(1)
+	if reboot {
+		stay = 0
+	}
+	endCmd := byte(CmdFlashEnd)
+	if l.deflate {
+		endCmd = CmdFlashDeflEnd
+	}
+	_, _, err := l.command(endCmd, words(stay), 0, defaultTimeout)
+	if reboot && errors.Is(err, ErrTimeout) {
+		// the chip may reboot before answering
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package flasher
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+}
+
+// Port is a serial port in raw mode. Reads return after at most 100ms even
+// if no data arrived.
+type Port struct {
+	file *os.File
+}
+
+// OpenPort opens the serial device name with the given baud rate
+func OpenPort(name string, baud int) (*Port, error) {
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	port := &Port{file: os.NewFile(uintptr(fd), name)}
+	if err = port.SetBaudrate(baud); err != nil {
+		_ = port.Close()
+		return nil, err
+	}
+	return port, nil
+}
+
+// SetBaudrate puts the port into raw 8N1 mode at baud
+func (p *Port) SetBaudrate(baud int) error {
+	rate, ok := baudRates[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	fd := int(p.file.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("%s is not a serial port: %w", p.file.Name(), err)
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | rate
+	termios.Ispeed = rate
+	termios.Ospeed = rate
+	// return from read after 100ms without data
+	termios.Cc[unix.VMIN] = 0
+	termios.Cc[unix.VTIME] = 1
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	return p.file.Read(b)
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	return p.file.Write(b)
+}
+
+// Close closes the port
+func (p *Port) Close() error {
+	return p.file.Close()
+}
+
+func (p *Port) setModemLine(line int, active bool) error {
+	request := uint(unix.TIOCMBIC)
+	if active {
+		request = unix.TIOCMBIS
+	}
+	return unix.IoctlSetPointerInt(int(p.file.Fd()), request, line)
+}
+
+// ResetIntoBootloader performs the classic DTR/RTS reset sequence of the
+// ESP development boards: EN is pulled low via RTS while IO9/IO0 is held low
+// via DTR, so the chip starts the ROM download mode.
+func (p *Port) ResetIntoBootloader() error {
+	steps := []struct {
+		dtr, rts bool
+		delay    time.Duration
+	}{
+		{false, true, 100 * time.Millisecond},
+		{true, false, 50 * time.Millisecond},
+		{false, false, 0},
+	}
+	for _, step := range steps {
+		if err := p.setModemLine(unix.TIOCM_DTR, step.dtr); err != nil {
+			return err
+		}
+		if err := p.setModemLine(unix.TIOCM_RTS, step.rts); err != nil {
+			return err
+		}
+		time.Sleep(step.delay)
+	}
+	return nil
+}
+
+// HardReset restarts the chip into the flashed application by toggling EN
+func (p *Port) HardReset() error {
+	if err := p.setModemLine(unix.TIOCM_RTS, true); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return p.setModemLine(unix.TIOCM_RTS, false)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package flasher
+
+import "errors"
+
+// Port is a serial port. Serial access is currently only implemented on Linux.
+type Port struct{}
+
+var errUnsupported = errors.New("serial ports are only supported on linux")
+
+// OpenPort opens the serial device name with the given baud rate
+func OpenPort(_ string, _ int) (*Port, error) {
+	return nil, errUnsupported
+}
+
+// SetBaudrate changes the baud rate of the port
+func (p *Port) SetBaudrate(_ int) error { return errUnsupported }
+
+func (p *Port) Read(_ []byte) (int, error) { return 0, errUnsupported }
+
+func (p *Port) Write(_ []byte) (int, error) { return 0, errUnsupported }
+
+// Close closes the port
+func (p *Port) Close() error { return errUnsupported }
+
+// ResetIntoBootloader resets the chip into the ROM download mode
+func (p *Port) ResetIntoBootloader() error { return errUnsupported }
+
+// HardReset restarts the chip into the flashed application
+func (p *Port) HardReset() error { return errUnsupported }
@@ -0,0 +1,107 @@
+package flasher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// SLIP framing bytes
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+// ErrTimeout is returned if the device does not answer in time
+var ErrTimeout = errors.New("timeout waiting for the device")
+
+// slipEncode wraps packet into a SLIP frame
+func slipEncode(packet []byte) []byte {
+	frame := make([]byte, 0, len(packet)+2)
+	frame = append(frame, slipEnd)
+	for _, b := range packet {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, slipEnd)
+}
+
+// slipReader extracts SLIP frames from a port. Bytes outside of frames, like
+// the boot log of the ROM, are discarded. The underlying reader is expected
+// to return (0, nil) or a short read if no data arrives within a short time.
+type slipReader struct {
+	r       io.Reader
+	buf     []byte
+	pending []byte
+}
+
+func newSlipReader(r io.Reader) *slipReader {
+	return &slipReader{r: r, buf: make([]byte, 1024)}
+}
+
+// ReadFrame returns the next decoded frame or ErrTimeout once deadline passed
+func (s *slipReader) ReadFrame(deadline time.Time) ([]byte, error) {
+	for {
+		if frame, ok := s.nextFrame(); ok {
+			return frame, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		n, err := s.r.Read(s.buf)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.pending = append(s.pending, s.buf[:n]...)
+	}
+}
+
+func (s *slipReader) nextFrame() ([]byte, bool) {
+	for {
+		start := bytes.IndexByte(s.pending, slipEnd)
+		if start < 0 {
+			s.pending = s.pending[:0]
+			return nil, false
+		}
+		end := bytes.IndexByte(s.pending[start+1:], slipEnd)
+		if end < 0 {
+			s.pending = s.pending[start:]
+			return nil, false
+		}
+		raw := s.pending[start+1 : start+1+end]
+		// the closing delimiter may start the next frame
+		s.pending = s.pending[start+1+end:]
+		if len(raw) == 0 {
+			continue
+		}
+		frame := make([]byte, 0, len(raw))
+		for i := 0; i < len(raw); i++ {
+			if raw[i] == slipEsc && i+1 < len(raw) {
+				i++
+				switch raw[i] {
+				case slipEscEnd:
+					frame = append(frame, slipEnd)
+				case slipEscEsc:
+					frame = append(frame, slipEsc)
+				default:
+					frame = append(frame, slipEsc, raw[i])
+				}
+				continue
+			}
+			frame = append(frame, raw[i])
+		}
+		return frame, true
+	}
+}
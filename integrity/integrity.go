@@ -0,0 +1,331 @@
+package integrity
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// Region kinds of a report
+const (
+	KindBootloader     = "bootloader"
+	KindPartitionTable = "partition_table"
+	KindOTAData        = "otadata"
+	KindApp            = "app"
+	KindData           = "data"
+	KindGap            = "gap"
+)
+
+// Options locate the parts of a merged image
+type Options struct {
+	// BootloaderOffset is 0x0 for the ESP32-C and -S3 families
+	BootloaderOffset int
+	// PartitionTableOffset defaults to partition.DefaultOffset
+	PartitionTableOffset int
+	// MinSecureVersion is the lowest secure_version an app may carry;
+	// older apps fail as they would be rejected by anti-rollback
+	MinSecureVersion uint32
+}
+
+// ImageInfo summarizes a bootloader or app image
+type ImageInfo struct {
+	Length        int          `json:"length"`
+	Segments      int          `json:"segments"`
+	ChecksumValid bool         `json:"checksum_valid"`
+	HashAppended  bool         `json:"hash_appended"`
+	HashValid     bool         `json:"hash_valid"`
+	AppDesc       *esp.AppDesc `json:"app_desc,omitempty"`
+	// ChipRevisions is the range of chip revisions the image runs on
+	ChipRevisions esp.ChipRevisionRange `json:"chip_revisions"`
+	// SignatureOffset is the offset of the Secure Boot V2 signature sector
+	// relative to the image, 0 for unsigned images
+	SignatureOffset int             `json:"signature_offset,omitempty"`
+	Signatures      []esp.Signature `json:"signatures,omitempty"`
+}
+
+// end returns the offset behind the image and its signature sector
+func (info *ImageInfo) end() int {
+	if info.SignatureOffset != 0 {
+		return info.SignatureOffset + esp.SignatureSectorSize
+	}
+	return info.Length
+}
+
+// Region is a verified range [Offset, Offset+Size) of a merged image
+type Region struct {
+	Kind    string           `json:"kind"`
+	Name    string           `json:"name,omitempty"`
+	Offset  int              `json:"offset"`
+	Size    int              `json:"size"`
+	Valid   bool             `json:"valid"`
+	Empty   bool             `json:"empty,omitempty"`
+	Errors  []string         `json:"errors,omitempty"`
+	Image   *ImageInfo       `json:"image,omitempty"`
+	OTAData *otadata.Data    `json:"otadata,omitempty"`
+	Table   *partition.Table `json:"table,omitempty"`
+}
+
+func (r *Region) fail(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	r.Valid = false
+}
+
+// Report is the result of verifying a merged image
+type Report struct {
+	Size    int      `json:"size"`
+	Regions []Region `json:"regions"`
+	// Boot is the app partition the bootloader starts
+	Boot  *partition.Entry `json:"boot,omitempty"`
+	Valid bool             `json:"valid"`
+}
+
+// Errors lists the errors of all regions prefixed with their location
+func (r *Report) Errors() (errs []string) {
+	for _, region := range r.Regions {
+		for _, err := range region.Errors {
+			errs = append(errs, fmt.Sprintf("%s %s at 0x%x: %s", region.Kind, region.Name, region.Offset, err))
+		}
+	}
+	return
+}
+
+// Err returns nil for a valid report or an error listing all problems
+func (r *Report) Err() error {
+	if r.Valid {
+		return nil
+	}
+	return fmt.Errorf("image integrity check failed:\n  %s", strings.Join(r.Errors(), "\n  "))
+}
+
+// Verify checks every part of a merged flash image. It verifies the
+// bootloader image and the partition table with its MD5.
+// The otadata entries and every app partition in the image are checked too.
+// Signed images have their Secure Boot V2 signatures verified.
+// Apps fail below opts.MinSecureVersion or without a chip revision shared
+// with the bootloader. All bytes between the parts have to be 0xFF.
+func Verify(image []byte, opts Options) *Report {
+	if opts.PartitionTableOffset == 0 {
+		opts.PartitionTableOffset = partition.DefaultOffset
+	}
+	report := &Report{Size: len(image), Regions: []Region{}}
+	var covered [][2]int
+	cover := func(start int, end int) {
+		covered = append(covered, [2]int{start, min(end, len(image))})
+	}
+
+	bootloader := verifyImage(image, KindBootloader, "", opts.BootloaderOffset, opts.PartitionTableOffset-opts.BootloaderOffset, opts.MinSecureVersion)
+	if bootloader.Image != nil {
+		// unlike partitions the bootloader has no fixed size
+		bootloader.Size = bootloader.Image.end()
+		cover(opts.BootloaderOffset, opts.BootloaderOffset+bootloader.Size)
+	}
+	report.Regions = append(report.Regions, bootloader)
+
+	tableRegion, table := verifyTable(image, opts.PartitionTableOffset)
+	report.Regions = append(report.Regions, tableRegion)
+	cover(tableRegion.Offset, tableRegion.Offset+tableRegion.Size)
+
+	if table != nil {
+		var data *otadata.Data
+		otaSlots := len(otadata.OTASlots(table))
+		for _, entry := range table.Entries {
+			offset, size := int(entry.Offset), int(entry.Size)
+			if offset >= len(image) {
+				continue
+			}
+			var region Region
+			switch {
+			case entry.Type == partition.TypeApp:
+				region = verifyImage(image, KindApp, entry.Label, offset, size, opts.MinSecureVersion)
+				if region.Image != nil {
+					cover(offset, offset+region.Image.end())
+					if bootloader.Image != nil {
+						app, boot := region.Image.ChipRevisions, bootloader.Image.ChipRevisions
+						if overlap := app.Intersect(boot); overlap.Min > overlap.Max {
+							region.fail("runs on chip revisions %s, the bootloader on %s", app, boot)
+						}
+					}
+				}
+			case entry.Type == partition.TypeData && entry.SubType == partition.SubTypeOTAData:
+				region = verifyOTAData(image, entry, otaSlots)
+				cover(offset, offset+size)
+				data = region.OTAData
+			default:
+				region = Region{Kind: KindData, Name: entry.Label, Offset: offset, Size: size, Valid: true, Empty: erased(image, offset, offset+size)}
+				cover(offset, offset+size)
+			}
+			report.Regions = append(report.Regions, region)
+		}
+		if boot, err := otadata.BootPartition(table, data); err == nil {
+			report.Boot = &boot
+		}
+	}
+
+	report.Regions = append(report.Regions, verifyGaps(image, covered)...)
+	sort.SliceStable(report.Regions, func(i, j int) bool { return report.Regions[i].Offset < report.Regions[j].Offset })
+	report.Valid = true
+	for _, region := range report.Regions {
+		report.Valid = report.Valid && region.Valid
+	}
+	return report
+}
+
+// erased reports whether image[start:end] only holds 0xFF, treating bytes
+// beyond the end of the image as erased
+func erased(image []byte, start int, end int) bool {
+	end = min(end, len(image))
+	return start >= end || len(bytes.Trim(image[start:end], "\xff")) == 0
+}
+
+func verifyImage(image []byte, kind string, name string, offset int, size int, minSecureVersion uint32) Region {
+	region := Region{Kind: kind, Name: name, Offset: offset, Size: size, Valid: true}
+	if offset >= len(image) {
+		region.fail("missing, the image ends at 0x%x", len(image))
+		return region
+	}
+	if kind == KindApp && erased(image, offset, offset+size) {
+		region.Empty = true
+		return region
+	}
+	img, err := esp.ParseImage(image[offset:])
+	if err != nil {
+		region.fail("%s", err)
+		return region
+	}
+	region.Image = &ImageInfo{
+		Length:        img.Length,
+		Segments:      len(img.Segments),
+		ChecksumValid: img.ChecksumValid(),
+		HashAppended:  img.HashAppended,
+		HashValid:     img.HashValid(),
+		AppDesc:       img.AppDesc,
+		ChipRevisions: img.Header.ChipRevisions(),
+	}
+	if !img.ChecksumValid() {
+		region.fail("checksum mismatch: stored %02x, computed %02x", img.StoredChecksum, img.ComputedChecksum)
+	}
+	if img.HashAppended && !img.HashValid() {
+		region.fail("appended SHA-256 mismatch")
+	}
+	signatures, err := esp.ParseSignatures(image[offset:min(len(image), offset+size)], img.Length)
+	if err != nil {
+		region.fail("%s", err)
+	}
+	if len(signatures) > 0 || err != nil {
+		region.Image.SignatureOffset = esp.SignatureOffset(img.Length)
+	}
+	region.Image.Signatures = signatures
+	for i, signature := range signatures {
+		switch {
+		case !signature.DigestValid:
+			region.fail("signature block %d: image digest mismatch", i)
+		case !signature.SignatureValid:
+			region.fail("signature block %d: %s signature does not verify", i, signature.Scheme)
+		}
+	}
+	if end := region.Image.end(); end > size {
+		region.fail("image of %d bytes exceeds its %d bytes of space", end, size)
+	}
+	if kind == KindApp && img.AppDesc == nil {
+		region.fail("no app descriptor")
+	}
+	if kind == KindApp && img.AppDesc != nil && img.AppDesc.SecureVersion < minSecureVersion {
+		region.fail("secure_version %d is below the minimum %d", img.AppDesc.SecureVersion, minSecureVersion)
+	}
+	return region
+}
+
+func verifyTable(image []byte, offset int) (Region, *partition.Table) {
+	region := Region{Kind: KindPartitionTable, Offset: offset, Size: partition.MaxTableSize, Valid: true}
+	if offset+partition.MaxTableSize > len(image) {
+		region.fail("missing, the image ends at 0x%x", len(image))
+		return region, nil
+	}
+	raw := image[offset : offset+partition.MaxTableSize]
+	table, err := partition.ParseBinary(raw)
+	if err != nil {
+		region.fail("%s", err)
+		return region, nil
+	}
+	region.Table = table
+	if !table.HasMD5 {
+		region.fail("no MD5 row")
+	}
+	if err := table.CheckOverlaps(uint32(offset)); err != nil {
+		region.fail("%s", err)
+	}
+	if !erased(raw, table.Size(), len(raw)) {
+		region.fail("data behind the end of the table")
+	}
+	return region, table
+}
+
+func verifyOTAData(image []byte, entry partition.Entry, otaSlots int) Region {
+	offset, size := int(entry.Offset), int(entry.Size)
+	region := Region{Kind: KindOTAData, Name: entry.Label, Offset: offset, Size: size, Valid: true}
+	if size < otadata.Size {
+		region.fail("partition of %d bytes is too small for otadata", size)
+		return region
+	}
+	if offset+otadata.Size > len(image) {
+		region.fail("truncated, the image ends at 0x%x", len(image))
+		return region
+	}
+	data, err := otadata.Parse(image[offset:])
+	if err != nil {
+		region.fail("%s", err)
+		return region
+	}
+	region.OTAData = data
+	region.Empty = data.Entries[0].Empty() && data.Entries[1].Empty()
+	for i, e := range data.Entries {
+		if e.Empty() {
+			continue
+		}
+		if !e.CRCValid() {
+			region.fail("entry %d: CRC %08x does not match sequence %d", i, e.CRC, e.Seq)
+			continue
+		}
+		if otaSlots == 0 {
+			region.fail("entry %d: sequence %d selects an OTA slot but the table has no OTA partitions", i, e.Seq)
+		}
+	}
+	if a, b := data.Entries[0], data.Entries[1]; a.Valid() && b.Valid() && a.Seq == b.Seq {
+		region.fail("both entries carry sequence %d", a.Seq)
+	}
+	for sector := 0; sector < 2; sector++ {
+		start := offset + sector*otadata.SectorSize + otadata.EntrySize
+		if !erased(image, start, offset+(sector+1)*otadata.SectorSize) {
+			region.fail("sector %d holds data behind its entry", sector)
+		}
+	}
+	return region
+}
+
+// verifyGaps reports every range not covered by a part, which must be erased
+func verifyGaps(image []byte, covered [][2]int) (gaps []Region) {
+	sort.Slice(covered, func(i, j int) bool { return covered[i][0] < covered[j][0] })
+	pos := 0
+	check := func(end int) {
+		if end <= pos {
+			return
+		}
+		region := Region{Kind: KindGap, Offset: pos, Size: end - pos, Valid: true, Empty: true}
+		if rest := bytes.TrimLeft(image[pos:end], "\xff"); len(rest) > 0 {
+			region.Empty = false
+			region.fail("non-erased data at 0x%x", end-len(rest))
+		}
+		gaps = append(gaps, region)
+	}
+	for _, r := range covered {
+		check(r[0])
+		pos = max(pos, r[1])
+	}
+	check(len(image))
+	return
+}
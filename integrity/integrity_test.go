@@ -0,0 +1,181 @@
+package integrity_test
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/integrity"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	return firmware
+}
+
+func regionAt(t *testing.T, report *integrity.Report, offset int) integrity.Region {
+	t.Helper()
+	for _, region := range report.Regions {
+		if region.Offset == offset {
+			return region
+		}
+	}
+	require.Failf(t, "no region", "at 0x%x", offset)
+	return integrity.Region{}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	firmware := readFixture(t)
+	report := integrity.Verify(firmware, integrity.Options{})
+	require.True(t, report.Valid, report.Errors())
+	assert.NoError(t, report.Err())
+
+	kinds := map[int]string{}
+	for _, region := range report.Regions {
+		kinds[region.Offset] = region.Kind
+	}
+	assert.Equal(t, map[int]string{
+		0x0:     integrity.KindBootloader,
+		0x57e0:  integrity.KindGap,
+		0x8000:  integrity.KindPartitionTable,
+		0x8c00:  integrity.KindGap,
+		0x9000:  integrity.KindData,
+		0xF000:  integrity.KindOTAData,
+		0x11000: integrity.KindData,
+		0x12000: integrity.KindGap,
+		0x20000: integrity.KindApp,
+	}, kinds)
+
+	app := regionAt(t, report, 0x20000)
+	assert.Equal(t, "factory", app.Name)
+	require.NotNil(t, app.Image.AppDesc)
+	assert.Equal(t, "wifi_station", app.Image.AppDesc.ProjectName)
+	assert.True(t, regionAt(t, report, 0xF000).Empty)
+}
+
+func TestVerifyCorruption(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		offset int
+		modify func([]byte)
+		err    string
+	}{
+		{"bootloader", 0x0, func(b []byte) { b[0x100] ^= 0x01 }, "checksum mismatch"},
+		{"table md5", 0x8000, func(b []byte) { b[0x8000+0x0c] ^= 0x01 }, "MD5 mismatch"},
+		{"behind table", 0x8000, func(b []byte) { b[0x8800] = 0x00 }, "data behind the end of the table"},
+		{"gap", 0x12000, func(b []byte) { b[0x1f000] = 0x00 }, "non-erased data at 0x1f000"},
+		{"otadata crc", 0xF000, func(b []byte) {
+			binary.LittleEndian.PutUint32(b[0xF000:], 1)
+			binary.LittleEndian.PutUint32(b[0xF000+28:], 0)
+		}, "CRC 00000000 does not match sequence 1"},
+		{"otadata without ota slots", 0xF000, func(b []byte) {
+			binary.LittleEndian.PutUint32(b[0xF000:], 1)
+			binary.LittleEndian.PutUint32(b[0xF000+28:], otadata.SeqCRC(1))
+		}, "the table has no OTA partitions"},
+		{"app", 0x20000, func(b []byte) { b[0x20000+0x100] ^= 0x01 }, "checksum mismatch"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			firmware := readFixture(t)
+			tt.modify(firmware)
+			report := integrity.Verify(firmware, integrity.Options{})
+			assert.False(t, report.Valid)
+			region := regionAt(t, report, tt.offset)
+			assert.False(t, region.Valid)
+			require.NotEmpty(t, region.Errors)
+			assert.Contains(t, region.Errors[0], tt.err)
+			assert.ErrorContains(t, report.Err(), tt.err)
+		})
+	}
+}
+
+func TestVerifyTruncatedApp(t *testing.T) {
+	t.Parallel()
+
+	firmware := readFixture(t)
+	// a table grown by an OTA slot behind the end of the file is fine, an
+	// app partition that is only partly contained is not
+	table := firmware[partition.DefaultOffset : partition.DefaultOffset+partition.MaxTableSize]
+	binary.LittleEndian.PutUint32(table[3*partition.EntrySize+8:], 0x10000)
+	sum := md5.Sum(table[:5*partition.EntrySize])
+	copy(table[5*partition.EntrySize+16:], sum[:])
+
+	report := integrity.Verify(firmware, integrity.Options{})
+	assert.False(t, report.Valid)
+	assert.Contains(t, regionAt(t, report, 0x20000).Errors[0], "exceeds its 65536 bytes of space")
+}
+
+func TestVerifySecureVersion(t *testing.T) {
+	t.Parallel()
+
+	// the fixture app has secure_version 0
+	firmware := readFixture(t)
+	report := integrity.Verify(firmware, integrity.Options{MinSecureVersion: 1})
+	assert.False(t, report.Valid)
+	assert.Equal(t, []string{"secure_version 0 is below the minimum 1"}, regionAt(t, report, 0x20000).Errors)
+	assert.True(t, regionAt(t, report, 0x0).Valid)
+}
+
+func TestVerifyChipRevisions(t *testing.T) {
+	t.Parallel()
+
+	firmware := readFixture(t)
+	report := integrity.Verify(firmware, integrity.Options{})
+	require.True(t, report.Valid)
+	expected := esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)}
+	assert.Equal(t, expected, regionAt(t, report, 0x0).Image.ChipRevisions)
+	assert.Equal(t, expected, regionAt(t, report, 0x20000).Image.ChipRevisions)
+
+	// an app for v1.0 and later never boots with a bootloader for v0.x
+	binary.LittleEndian.PutUint16(firmware[0x20000+15:], 100)
+	binary.LittleEndian.PutUint16(firmware[0x20000+17:], 0xFFFF)
+	report = integrity.Verify(firmware, integrity.Options{})
+	assert.False(t, report.Valid)
+	assert.Contains(t, regionAt(t, report, 0x20000).Errors, "runs on chip revisions v1.0 and later, the bootloader on v0.0 - v0.99")
+}
+
+func TestVerifySignatures(t *testing.T) {
+	t.Parallel()
+
+	firmware := readFixture(t)
+	bootloader, err := os.ReadFile("../test/secureboot/bootloader-signed.bin")
+	require.NoError(t, err)
+	copy(firmware, bootloader)
+	pemData, err := os.ReadFile("../test/secureboot/ecdsa-p256.pem")
+	require.NoError(t, err)
+	key, err := esp.ParseSigningKey(pemData)
+	require.NoError(t, err)
+	app, err := esp.SignImage(firmware[0x20000:], 0x10aff0, key)
+	require.NoError(t, err)
+	firmware = append(firmware[:0x20000], app...)
+
+	report := integrity.Verify(firmware, integrity.Options{})
+	require.True(t, report.Valid, report.Errors())
+	region := regionAt(t, report, 0x0)
+	assert.Equal(t, 0x7000, region.Size)
+	assert.Len(t, region.Image.Signatures, 2)
+	region = regionAt(t, report, 0x20000)
+	assert.Equal(t, 0x10b000, region.Image.SignatureOffset)
+	require.Len(t, region.Image.Signatures, 1)
+	assert.Equal(t, key.KeyDigest(), region.Image.Signatures[0].KeyDigest)
+
+	// patching without re-signing invalidates the signature
+	firmware[0x20000+0x1000] ^= 0x01
+	report = integrity.Verify(firmware, integrity.Options{})
+	assert.False(t, report.Valid)
+	assert.ErrorContains(t, report.Err(), "signature block 0: image digest mismatch")
+}
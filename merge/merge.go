@@ -0,0 +1,188 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// Part is an input file placed at a flash offset
+type Part struct {
+	Offset uint32
+	Name   string
+	Data   []byte
+}
+
+func (p Part) end() uint64 {
+	return uint64(p.Offset) + uint64(len(p.Data))
+}
+
+// Options controls how parts are merged
+type Options struct {
+	// Flash rewrites the flash parameters of the bootloader header
+	Flash esp.FlashParams
+	// PartitionTableOffset defaults to partition.DefaultOffset
+	PartitionTableOffset uint32
+	// BootSlot generates otadata booting the app partition factory or
+	// ota_<n>, replacing an otadata part
+	BootSlot string
+	// Chip places the bootloader at its bootloader offset; nil takes the
+	// chip family from the header of the first part
+	Chip *esp.Chip
+}
+
+// BootloaderOffset returns the flash offset of the second stage bootloader
+// of chip. Unknown chips get 0x0, the offset of the ESP32-C and -S3 families.
+func BootloaderOffset(chip *esp.Chip) uint32 {
+	if chip == nil {
+		return 0
+	}
+	return uint32(chip.BootloaderOffset)
+}
+
+// Merge assembles parts into a single flash image like `esptool.py merge_bin`.
+// Gaps between parts are filled with 0xFF. Every part is validated: the
+// bootloader and app partitions must be intact ESP images and, if a partition
+// table is part of the merge, every other part must fit into a partition.
+func Merge(parts []Part, opts Options) ([]byte, error) {
+	if len(parts) == 0 {
+		return nil, errors.New("nothing to merge")
+	}
+	if opts.PartitionTableOffset == 0 {
+		opts.PartitionTableOffset = partition.DefaultOffset
+	}
+
+	parts = append([]Part{}, parts...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Offset < parts[j].Offset })
+	for i := 1; i < len(parts); i++ {
+		if parts[i-1].end() > uint64(parts[i].Offset) {
+			return nil, fmt.Errorf("%s at 0x%x overlaps with %s at 0x%x", parts[i].Name, parts[i].Offset, parts[i-1].Name, parts[i-1].Offset)
+		}
+	}
+
+	var table *partition.Table
+	for _, part := range parts {
+		if part.Offset != opts.PartitionTableOffset {
+			continue
+		}
+		var err error
+		if table, err = partition.ParseBinary(part.Data); err != nil {
+			return nil, fmt.Errorf("%s: %w", part.Name, err)
+		}
+		if err = table.CheckOverlaps(opts.PartitionTableOffset); err != nil {
+			return nil, fmt.Errorf("%s: %w", part.Name, err)
+		}
+	}
+
+	chip := opts.Chip
+	if chip == nil {
+		if img, err := esp.ParseImage(parts[0].Data); err == nil {
+			chip = img.Chip
+		}
+	}
+	bootloaderOffset := BootloaderOffset(chip)
+
+	if opts.BootSlot != "" {
+		var err error
+		if parts, err = withBootSlot(parts, table, opts.BootSlot); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, part := range parts {
+		if err := validatePart(part, table, bootloaderOffset, opts.PartitionTableOffset); err != nil {
+			return nil, err
+		}
+		if part.Offset == bootloaderOffset && opts.Flash != (esp.FlashParams{}) {
+			parts[i].Data = bytes.Clone(part.Data)
+			if err := esp.SetFlashParams(parts[i].Data, opts.Flash); err != nil {
+				return nil, fmt.Errorf("%s: %w", part.Name, err)
+			}
+		}
+	}
+
+	merged := bytes.Repeat([]byte{0xFF}, int(parts[len(parts)-1].end()))
+	for _, part := range parts {
+		copy(merged[part.Offset:], part.Data)
+	}
+	return merged, nil
+}
+
+// withBootSlot replaces the otadata part of parts by otadata booting slot
+func withBootSlot(parts []Part, table *partition.Table, slot string) ([]Part, error) {
+	if table == nil {
+		return nil, errors.New("a boot slot requires a partition table")
+	}
+	n, err := otadata.ParseSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	location, ok := otadata.Find(table)
+	if !ok {
+		return nil, errors.New("the partition table has no otadata partition")
+	}
+	entry, err := otadata.SlotPartition(table, n)
+	if err != nil {
+		return nil, err
+	}
+	data := otadata.ForSlot(n)
+	if boot, err := otadata.BootPartition(table, data); err != nil || boot != entry {
+		return nil, fmt.Errorf("the bootloader cannot select %s with this partition table", slot)
+	}
+
+	result := []Part{}
+	hasApp := false
+	for _, part := range parts {
+		hasApp = hasApp || part.Offset == entry.Offset
+		if part.Offset != location.Offset {
+			result = append(result, part)
+		}
+	}
+	if !hasApp {
+		return nil, fmt.Errorf("no app image is merged into boot slot %s at 0x%x", slot, entry.Offset)
+	}
+	result = append(result, Part{Offset: location.Offset, Name: "otadata for " + slot, Data: data.Encode()})
+	sort.Slice(result, func(i, j int) bool { return result[i].Offset < result[j].Offset })
+	return result, nil
+}
+
+func validatePart(part Part, table *partition.Table, bootloaderOffset uint32, tableOffset uint32) error {
+	switch {
+	case part.Offset == bootloaderOffset:
+		if err := validateImage(part.Data); err != nil {
+			return fmt.Errorf("%s: bootloader %w", part.Name, err)
+		}
+		return nil
+	case part.Offset == tableOffset:
+		return nil
+	case table == nil:
+		return nil
+	}
+
+	entry, ok := table.Containing(part.Offset, uint32(len(part.Data)))
+	if !ok {
+		return fmt.Errorf("%s at 0x%x (%d bytes) does not fit into any partition", part.Name, part.Offset, len(part.Data))
+	}
+	if entry.Type == partition.TypeApp && entry.Offset == part.Offset {
+		if err := validateImage(part.Data); err != nil {
+			return fmt.Errorf("%s: app partition %q %w", part.Name, entry.Label, err)
+		}
+	}
+	return nil
+}
+
+func validateImage(data []byte) error {
+	img, err := esp.ParseImage(data)
+	if err != nil {
+		return fmt.Errorf("image is invalid: %w", err)
+	}
+	if !img.Valid() {
+		return errors.New("image fails its checksum or hash verification")
+	}
+	return nil
+}
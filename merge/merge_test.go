@@ -0,0 +1,124 @@
+package merge_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/merge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixtureParts splits the merged test firmware into the files produced by
+// the ESP-IDF build.
+func fixtureParts(t *testing.T) ([]byte, []merge.Part) {
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	return firmware, []merge.Part{
+		{Offset: 0x0, Name: "bootloader.bin", Data: firmware[0x0:0x57e0]},
+		{Offset: 0x8000, Name: "partition-table.bin", Data: firmware[0x8000:0x8c00]},
+		{Offset: 0xF000, Name: "ota_data_initial.bin", Data: firmware[0xF000:0x11000]},
+		{Offset: 0x20000, Name: "wifi_station.bin", Data: firmware[0x20000:]},
+	}
+}
+
+// TestMergeReassemblesFixture merges the parts split from the test firmware,
+// given out of order, back into the firmware
+func TestMergeReassemblesFixture(t *testing.T) {
+	t.Parallel()
+
+	firmware, parts := fixtureParts(t)
+	merged, err := merge.Merge([]merge.Part{parts[3], parts[1], parts[0], parts[2]}, merge.Options{})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(firmware, merged))
+}
+
+func TestMergeRewritesFlashParams(t *testing.T) {
+	t.Parallel()
+
+	firmware, parts := fixtureParts(t)
+	merged, err := merge.Merge(parts, merge.Options{Flash: esp.FlashParams{Mode: "dout", Size: "4MB"}})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x03, 0x20}, merged[2:4])
+	assert.Equal(t, []byte{0x02, 0x30}, firmware[2:4], "input must not be modified")
+
+	img, err := esp.ParseImage(merged)
+	require.NoError(t, err)
+	assert.True(t, img.Valid())
+
+	_, err = merge.Merge(parts, merge.Options{Flash: esp.FlashParams{Size: "3MB"}})
+	assert.ErrorContains(t, err, "unknown flash size")
+}
+
+func TestMergeBootloaderOffsetOfChip(t *testing.T) {
+	t.Parallel()
+
+	// an ESP32 keeps its bootloader at 0x1000
+	firmware, parts := fixtureParts(t)
+	bootloader := bytes.Clone(firmware[0x0:0x57e0])
+	binary.LittleEndian.PutUint16(bootloader[12:], esp.ESP32.ID)
+	require.NoError(t, esp.SetFlashParams(bootloader, esp.FlashParams{}))
+	parts[0] = merge.Part{Offset: 0x1000, Name: "bootloader.bin", Data: bootloader}
+
+	merged, err := merge.Merge(parts, merge.Options{Flash: esp.FlashParams{Mode: "dout"}})
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0xFF}, 0x1000), merged[:0x1000])
+	assert.Equal(t, uint8(0x03), merged[0x1002])
+
+	corrupt := bytes.Clone(bootloader)
+	corrupt[0x100] ^= 0x01
+	parts[0].Data = corrupt
+	_, err = merge.Merge(parts, merge.Options{Chip: esp.ESP32})
+	assert.ErrorContains(t, err, "bootloader image fails")
+	_, err = merge.Merge(parts, merge.Options{})
+	assert.ErrorContains(t, err, "bootloader image fails", "the chip is taken from the header")
+}
+
+func TestMergeRejectsInvalidLayouts(t *testing.T) {
+	t.Parallel()
+
+	_, parts := fixtureParts(t)
+
+	overlapping := append([]merge.Part{}, parts...)
+	overlapping[2] = merge.Part{Offset: 0x8800, Name: "overlap.bin", Data: make([]byte, 0x1000)}
+	_, err := merge.Merge(overlapping, merge.Options{})
+	assert.ErrorContains(t, err, "overlaps with partition-table.bin")
+
+	outside := append([]merge.Part{}, parts...)
+	outside[2] = merge.Part{Offset: 0x11000, Name: "outside.bin", Data: make([]byte, 0x2000)}
+	_, err = merge.Merge(outside, merge.Options{})
+	assert.ErrorContains(t, err, "does not fit into any partition")
+
+	corrupt := append([]merge.Part{}, parts...)
+	app := bytes.Clone(parts[3].Data)
+	app[0x1000] ^= 0x01
+	corrupt[3] = merge.Part{Offset: 0x20000, Name: "app.bin", Data: app}
+	_, err = merge.Merge(corrupt, merge.Options{})
+	assert.ErrorContains(t, err, "app partition \"factory\"")
+
+	table := append([]merge.Part{}, parts...)
+	tableData := bytes.Clone(parts[1].Data)
+	tableData[0x10] = 'X'
+	table[1] = merge.Part{Offset: 0x8000, Name: "partition-table.bin", Data: tableData}
+	_, err = merge.Merge(table, merge.Options{})
+	assert.ErrorContains(t, err, "MD5 mismatch")
+}
+
+func TestMergeBootSlot(t *testing.T) {
+	t.Parallel()
+
+	firmware, parts := fixtureParts(t)
+	// erased otadata is generated in place of ota_data_initial.bin
+	withoutOTAData := append(parts[:2:2], parts[3])
+	merged, err := merge.Merge(withoutOTAData, merge.Options{BootSlot: "factory"})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(firmware, merged))
+
+	_, err = merge.Merge(parts, merge.Options{BootSlot: "ota_0"})
+	assert.ErrorContains(t, err, "no ota_0 partition")
+	_, err = merge.Merge(parts[3:], merge.Options{BootSlot: "factory"})
+	assert.ErrorContains(t, err, "requires a partition table")
+}
@@ -0,0 +1,276 @@
+package otadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// otadata layout: two sectors, each starting with an esp_ota_select_entry_t
+const (
+	EntrySize  = 32
+	SectorSize = 0x1000
+	Size       = 2 * SectorSize
+	LabelSize  = 20
+	// EmptySeq marks an erased entry
+	EmptySeq = 0xFFFFFFFF
+)
+
+// State is the esp_ota_img_states_t of an entry
+type State uint32
+
+// OTA image states
+const (
+	StateNew           State = 0x0
+	StatePendingVerify State = 0x1
+	StateValid         State = 0x2
+	StateInvalid       State = 0x3
+	StateAborted       State = 0x4
+	StateUndefined     State = 0xFFFFFFFF
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StatePendingVerify:
+		return "pending_verify"
+	case StateValid:
+		return "valid"
+	case StateInvalid:
+		return "invalid"
+	case StateAborted:
+		return "aborted"
+	case StateUndefined:
+		return "undefined"
+	}
+	return fmt.Sprintf("0x%x", uint32(s))
+}
+
+// MarshalText encodes the state by name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Entry is an esp_ota_select_entry_t
+type Entry struct {
+	Seq   uint32 `json:"seq"`
+	Label string `json:"label,omitempty"`
+	State State  `json:"state"`
+	CRC   uint32 `json:"crc"`
+}
+
+// emptyEntry is an erased esp_ota_select_entry_t
+var emptyEntry = Entry{Seq: EmptySeq, State: StateUndefined, CRC: 0xFFFFFFFF}
+
+// SeqCRC returns the CRC32 the bootloader expects for seq
+func SeqCRC(seq uint32) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], seq)
+	return crc32.Update(0xFFFFFFFF, crc32.IEEETable, buf[:])
+}
+
+// Empty reports whether the entry is erased
+func (e Entry) Empty() bool {
+	return e.Seq == EmptySeq
+}
+
+// CRCValid reports whether the stored CRC matches the sequence number
+func (e Entry) CRCValid() bool {
+	return e.CRC == SeqCRC(e.Seq)
+}
+
+// Valid reports whether the bootloader considers the entry
+func (e Entry) Valid() bool {
+	return !e.Empty() && e.CRCValid() && e.State != StateInvalid && e.State != StateAborted
+}
+
+// Data is the content of the otadata partition
+type Data struct {
+	Entries [2]Entry `json:"entries"`
+}
+
+func parseEntry(raw []byte) Entry {
+	return Entry{
+		Seq:   binary.LittleEndian.Uint32(raw[0:]),
+		Label: string(bytes.TrimRight(raw[4:4+LabelSize], "\x00\xff")),
+		State: State(binary.LittleEndian.Uint32(raw[24:])),
+		CRC:   binary.LittleEndian.Uint32(raw[28:]),
+	}
+}
+
+// Parse decodes the two entries of an otadata partition
+func Parse(data []byte) (*Data, error) {
+	if len(data) < Size {
+		return nil, fmt.Errorf("otadata needs 0x%x bytes, got 0x%x", Size, len(data))
+	}
+	return &Data{Entries: [2]Entry{
+		parseEntry(data[0:EntrySize]),
+		parseEntry(data[SectorSize : SectorSize+EntrySize]),
+	}}, nil
+}
+
+// encode writes e to raw, leaving erased entries untouched
+func (e Entry) encode(raw []byte) {
+	if e == emptyEntry {
+		return
+	}
+	binary.LittleEndian.PutUint32(raw[0:], e.Seq)
+	if e.Label != "" {
+		label := make([]byte, LabelSize)
+		copy(label, e.Label)
+		copy(raw[4:], label)
+	}
+	binary.LittleEndian.PutUint32(raw[24:], uint32(e.State))
+	binary.LittleEndian.PutUint32(raw[28:], e.CRC)
+}
+
+// Encode returns the otadata partition content holding d
+func (d *Data) Encode() []byte {
+	data := bytes.Repeat([]byte{0xFF}, Size)
+	d.Entries[0].encode(data[0:EntrySize])
+	d.Entries[1].encode(data[SectorSize : SectorSize+EntrySize])
+	return data
+}
+
+// Active returns the entry the bootloader follows, the valid entry with the
+// highest sequence number
+func (d *Data) Active() (Entry, bool) {
+	var active Entry
+	found := false
+	for _, e := range d.Entries {
+		if e.Valid() && (!found || e.Seq > active.Seq) {
+			active, found = e, true
+		}
+	}
+	return active, found
+}
+
+// Factory selects the factory app partition. Erased otadata makes the
+// bootloader start the factory app, or ota_0 if there is none.
+const Factory = -1
+
+// ForSlot returns otadata booting OTA slot n, or the factory app for Factory
+func ForSlot(n int) *Data {
+	data := &Data{Entries: [2]Entry{emptyEntry, emptyEntry}}
+	if n != Factory {
+		seq := uint32(n) + 1
+		data.Entries[0] = Entry{Seq: seq, State: StateUndefined, CRC: SeqCRC(seq)}
+	}
+	return data
+}
+
+// ParseSlot parses a slot name, "factory" or "ota_<n>"
+func ParseSlot(name string) (int, error) {
+	if name == "factory" {
+		return Factory, nil
+	}
+	if number, ok := strings.CutPrefix(name, "ota_"); ok {
+		if n, err := strconv.Atoi(number); err == nil && n >= 0 && n < partition.SubTypeTest-partition.SubTypeOTA0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid boot slot %q, expected factory or ota_<n>", name)
+}
+
+// SlotName returns the name of the app partition entry as used by ParseSlot
+func SlotName(entry partition.Entry) string {
+	switch {
+	case entry.SubType == partition.SubTypeFactory:
+		return "factory"
+	case entry.SubType >= partition.SubTypeOTA0 && entry.SubType < partition.SubTypeTest:
+		return fmt.Sprintf("ota_%d", entry.SubType-partition.SubTypeOTA0)
+	case entry.SubType == partition.SubTypeTest:
+		return "test"
+	}
+	return fmt.Sprintf("0x%02x", entry.SubType)
+}
+
+// OTASlots returns the OTA app partitions of table ordered by slot
+func OTASlots(table *partition.Table) []partition.Entry {
+	var slots []partition.Entry
+	for _, entry := range table.Entries {
+		if entry.Type == partition.TypeApp && entry.SubType >= partition.SubTypeOTA0 && entry.SubType < partition.SubTypeTest {
+			slots = append(slots, entry)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].SubType < slots[j].SubType })
+	return slots
+}
+
+// SlotPartition returns the app partition of table for slot n or Factory
+func SlotPartition(table *partition.Table, n int) (partition.Entry, error) {
+	subType := uint8(partition.SubTypeFactory)
+	if n != Factory {
+		subType = uint8(partition.SubTypeOTA0 + n)
+	}
+	for _, entry := range table.Entries {
+		if entry.Type == partition.TypeApp && entry.SubType == subType {
+			return entry, nil
+		}
+	}
+	name := "factory"
+	if n != Factory {
+		name = fmt.Sprintf("ota_%d", n)
+	}
+	return partition.Entry{}, fmt.Errorf("the partition table has no %s partition", name)
+}
+
+// BootPartition returns the app partition of table the bootloader starts
+// given the otadata d, which is nil if the table has no otadata partition.
+// Like the bootloader, the active entry selects OTA slot (seq-1) modulo the
+// number of OTA slots; without one the factory app or else ota_0 is started.
+func BootPartition(table *partition.Table, d *Data) (partition.Entry, error) {
+	slots := OTASlots(table)
+	if d != nil && len(slots) > 0 {
+		if active, ok := d.Active(); ok {
+			return slots[(active.Seq-1)%uint32(len(slots))], nil
+		}
+	}
+	if factory, err := SlotPartition(table, Factory); err == nil {
+		return factory, nil
+	}
+	if len(slots) > 0 {
+		return slots[0], nil
+	}
+	return partition.Entry{}, errors.New("the partition table has no app partition")
+}
+
+// Find returns the otadata partition of table
+func Find(table *partition.Table) (partition.Entry, bool) {
+	for _, entry := range table.Entries {
+		if entry.Type == partition.TypeData && entry.SubType == partition.SubTypeOTAData {
+			return entry, true
+		}
+	}
+	return partition.Entry{}, false
+}
+
+// BootPartitionOf reads the partition table at tableOffset and the otadata
+// of a merged image and returns the app partition it boots
+func BootPartitionOf(image []byte, tableOffset int) (partition.Entry, error) {
+	if tableOffset+partition.MaxTableSize > len(image) {
+		return partition.Entry{}, errors.New("the image does not contain a partition table")
+	}
+	table, err := partition.ParseBinary(image[tableOffset : tableOffset+partition.MaxTableSize])
+	if err != nil {
+		return partition.Entry{}, err
+	}
+	var data *Data
+	if entry, ok := Find(table); ok {
+		if int(entry.Offset)+Size > len(image) {
+			return partition.Entry{}, errors.New("the image does not contain the otadata partition")
+		}
+		if data, err = Parse(image[entry.Offset:]); err != nil {
+			return partition.Entry{}, err
+		}
+	}
+	return BootPartition(table, data)
+}
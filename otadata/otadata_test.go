@@ -0,0 +1,104 @@
+package otadata_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte{0xFF}, otadata.Size)
+	parsed, err := otadata.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, parsed.Entries[0].Empty())
+	assert.False(t, parsed.Entries[0].Valid())
+
+	entry := data[otadata.SectorSize:]
+	binary.LittleEndian.PutUint32(entry, 3)
+	copy(entry[4:4+otadata.LabelSize], make([]byte, otadata.LabelSize))
+	binary.LittleEndian.PutUint32(entry[24:], uint32(otadata.StateValid))
+	binary.LittleEndian.PutUint32(entry[28:], otadata.SeqCRC(3))
+	parsed, err = otadata.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, otadata.Entry{Seq: 3, State: otadata.StateValid, CRC: 0xed4a5011}, parsed.Entries[1])
+	assert.True(t, parsed.Entries[1].Valid())
+	// as written by otatool.py for the first OTA update
+	assert.Equal(t, uint32(0x4743989a), otadata.SeqCRC(1))
+
+	_, err = otadata.Parse(data[:otadata.SectorSize])
+	assert.Error(t, err)
+}
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, slot := range []int{otadata.Factory, 0, 1} {
+		data := otadata.ForSlot(slot)
+		encoded := data.Encode()
+		require.Len(t, encoded, otadata.Size)
+		parsed, err := otadata.Parse(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, data, parsed)
+	}
+	assert.Equal(t, bytes.Repeat([]byte{0xFF}, otadata.Size), otadata.ForSlot(otadata.Factory).Encode())
+
+	data := &otadata.Data{Entries: [2]otadata.Entry{
+		{Seq: 4, Label: "app", State: otadata.StateValid, CRC: otadata.SeqCRC(4)},
+		{Seq: 5, State: otadata.StateAborted, CRC: otadata.SeqCRC(5)},
+	}}
+	parsed, err := otadata.Parse(data.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, data, parsed)
+	active, ok := parsed.Active()
+	require.True(t, ok)
+	assert.Equal(t, uint32(4), active.Seq)
+}
+
+func TestBootPartition(t *testing.T) {
+	t.Parallel()
+
+	factory := partition.Entry{Label: "factory", Type: partition.TypeApp, SubType: partition.SubTypeFactory, Offset: 0x10000, Size: 0x100000}
+	ota0 := partition.Entry{Label: "ota_0", Type: partition.TypeApp, SubType: partition.SubTypeOTA0, Offset: 0x110000, Size: 0x100000}
+	ota1 := partition.Entry{Label: "ota_1", Type: partition.TypeApp, SubType: partition.SubTypeOTA0 + 1, Offset: 0x210000, Size: 0x100000}
+	table := &partition.Table{Entries: []partition.Entry{factory, ota0, ota1}}
+
+	tests := []struct {
+		data *otadata.Data
+		boot partition.Entry
+	}{
+		{nil, factory},
+		{otadata.ForSlot(otadata.Factory), factory},
+		{otadata.ForSlot(0), ota0},
+		{otadata.ForSlot(1), ota1},
+		// the sequence number wraps around the OTA slots
+		{otadata.ForSlot(2), ota0},
+		{&otadata.Data{Entries: [2]otadata.Entry{{Seq: 7, CRC: 0}, {Seq: 2, CRC: otadata.SeqCRC(2)}}}, ota1},
+	}
+	for _, tt := range tests {
+		boot, err := otadata.BootPartition(table, tt.data)
+		require.NoError(t, err)
+		assert.Equal(t, tt.boot, boot)
+	}
+
+	boot, err := otadata.BootPartition(&partition.Table{Entries: []partition.Entry{ota0, ota1}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ota0, boot)
+
+	for name, slot := range map[string]int{"factory": otadata.Factory, "ota_0": 0, "ota_15": 15} {
+		parsed, err := otadata.ParseSlot(name)
+		require.NoError(t, err)
+		assert.Equal(t, slot, parsed)
+	}
+	for _, name := range []string{"", "ota_", "ota_16", "ota_-1", "test"} {
+		_, err := otadata.ParseSlot(name)
+		assert.Error(t, err, name)
+	}
+	assert.Equal(t, "ota_1", otadata.SlotName(ota1))
+}
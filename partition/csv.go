@@ -0,0 +1,255 @@
+package partition
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Partition flags
+const (
+	FlagEncrypted = 1 << 0
+	FlagReadOnly  = 1 << 1
+)
+
+// Offset alignment required by the bootloader for each partition type
+const (
+	AppAlignment  = 0x10000
+	DataAlignment = 0x1000
+)
+
+// ReservedSize is the flash space reserved for the table in front of the
+// first partition with an automatic offset
+const ReservedSize = 0x1000
+
+var typeNames = map[string]uint8{
+	"app":  TypeApp,
+	"data": TypeData,
+}
+
+var dataSubTypeNames = map[string]uint8{
+	"ota":       SubTypeOTAData,
+	"phy":       SubTypePhy,
+	"nvs":       SubTypeNVS,
+	"coredump":  SubTypeCoreDump,
+	"nvs_keys":  SubTypeNVSKeys,
+	"efuse":     0x05,
+	"undefined": 0x06,
+	"esphttpd":  0x80,
+	"fat":       0x81,
+	"spiffs":    0x82,
+	"littlefs":  0x83,
+}
+
+var flagNames = map[string]uint32{
+	"encrypted": FlagEncrypted,
+	"readonly":  FlagReadOnly,
+}
+
+// alignment returns the offset alignment of partitions of type partitionType
+func alignment(partitionType uint8) uint32 {
+	if partitionType == TypeApp {
+		return AppAlignment
+	}
+	return DataAlignment
+}
+
+// parseInt parses decimal or 0x prefixed numbers with an optional K or M suffix
+func parseInt(value string) (uint32, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(strings.ToUpper(value), "K"):
+		multiplier, value = 1024, value[:len(value)-1]
+	case strings.HasSuffix(strings.ToUpper(value), "M"):
+		multiplier, value = 1024*1024, value[:len(value)-1]
+	}
+	n, err := strconv.ParseUint(value, 0, 32)
+	if err != nil || n*multiplier > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return uint32(n * multiplier), nil
+}
+
+func parseType(value string) (uint8, error) {
+	if t, ok := typeNames[value]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid type %q", value)
+	}
+	return uint8(n), nil
+}
+
+func parseSubType(partitionType uint8, value string) (uint8, error) {
+	if value == "" {
+		return 0, nil
+	}
+	switch partitionType {
+	case TypeApp:
+		switch {
+		case value == "factory":
+			return SubTypeFactory, nil
+		case value == "test":
+			return SubTypeTest, nil
+		case strings.HasPrefix(value, "ota_"):
+			n, err := strconv.ParseUint(value[len("ota_"):], 10, 8)
+			if err != nil || n >= SubTypeTest-SubTypeOTA0 {
+				return 0, fmt.Errorf("invalid app subtype %q", value)
+			}
+			return SubTypeOTA0 + uint8(n), nil
+		}
+	case TypeData:
+		if subType, ok := dataSubTypeNames[value]; ok {
+			return subType, nil
+		}
+	}
+	n, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subtype %q", value)
+	}
+	return uint8(n), nil
+}
+
+func parseFlags(value string) (uint32, error) {
+	var flags uint32
+	for _, name := range strings.Split(value, ":") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		flag, ok := flagNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// ParseCSV reads a partition table in the CSV format of ESP-IDF's
+// gen_esp32part.py. Empty offsets are placed behind the previous partition,
+// starting ReservedSize bytes behind the table at tableOffset. The table gets
+// an MD5 row; it is not validated, see Validate.
+func ParseCSV(r io.Reader, tableOffset uint32) (*Table, error) {
+	table := &Table{HasMD5: true}
+	next := tableOffset + ReservedSize
+	scanner := bufio.NewScanner(r)
+	var errs []error
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 5 {
+			errs = append(errs, fmt.Errorf("line %d: expected name, type, subtype, offset, size and flags", line))
+			continue
+		}
+		for len(fields) < 6 {
+			fields = append(fields, "")
+		}
+
+		entry := Entry{Label: fields[0]}
+		var err error
+		if entry.Type, err = parseType(fields[1]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		if entry.SubType, err = parseSubType(entry.Type, fields[2]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		if fields[3] == "" {
+			align := alignment(entry.Type)
+			entry.Offset = (next + align - 1) / align * align
+		} else if entry.Offset, err = parseInt(fields[3]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: offset: %w", line, err))
+			continue
+		}
+		if entry.Size, err = parseInt(fields[4]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: size: %w", line, err))
+			continue
+		}
+		if entry.Flags, err = parseFlags(fields[5]); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		table.Entries = append(table.Entries, entry)
+		next = entry.End()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if len(table.Entries) == 0 {
+		return nil, errors.New("partition table is empty")
+	}
+	return table, nil
+}
+
+func typeName(partitionType uint8) string {
+	for name, t := range typeNames {
+		if t == partitionType {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%02x", partitionType)
+}
+
+func subTypeName(partitionType uint8, subType uint8) string {
+	switch partitionType {
+	case TypeApp:
+		switch {
+		case subType == SubTypeFactory:
+			return "factory"
+		case subType == SubTypeTest:
+			return "test"
+		case subType >= SubTypeOTA0 && subType < SubTypeTest:
+			return fmt.Sprintf("ota_%d", subType-SubTypeOTA0)
+		}
+	case TypeData:
+		for name, t := range dataSubTypeNames {
+			if t == subType {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("0x%02x", subType)
+}
+
+func sizeText(size uint32) string {
+	switch {
+	case size != 0 && size%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", size/(1024*1024))
+	case size != 0 && size%1024 == 0:
+		return fmt.Sprintf("%dK", size/1024)
+	}
+	return fmt.Sprintf("0x%x", size)
+}
+
+// CSV returns the table in the CSV format read by ParseCSV
+func (t *Table) CSV() string {
+	var b strings.Builder
+	b.WriteString("# ESP-IDF Partition Table\n")
+	b.WriteString("# Name, Type, SubType, Offset, Size, Flags\n")
+	for _, entry := range t.Entries {
+		var flags []string
+		for _, name := range []string{"encrypted", "readonly"} {
+			if entry.Flags&flagNames[name] != 0 {
+				flags = append(flags, name)
+			}
+		}
+		fmt.Fprintf(&b, "%s,%s,%s,0x%x,%s,%s\n", entry.Label, typeName(entry.Type),
+			subTypeName(entry.Type, entry.SubType), entry.Offset, sizeText(entry.Size), strings.Join(flags, ":"))
+	}
+	return b.String()
+}
@@ -0,0 +1,219 @@
+package partition
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Partition table format constants
+const (
+	DefaultOffset = 0x8000
+	MaxTableSize  = 0xC00
+	EntrySize     = 32
+	EntryMagic    = 0x50AA
+	MD5Magic      = 0xEBEB
+	LabelSize     = 16
+)
+
+// Partition types
+const (
+	TypeApp  = 0x00
+	TypeData = 0x01
+)
+
+// Well known partition subtypes
+const (
+	SubTypeFactory  = 0x00
+	SubTypeOTA0     = 0x10
+	SubTypeTest     = 0x20
+	SubTypeOTAData  = 0x00
+	SubTypePhy      = 0x01
+	SubTypeNVS      = 0x02
+	SubTypeCoreDump = 0x03
+	SubTypeNVSKeys  = 0x04
+)
+
+// Entry is a single partition of the table
+type Entry struct {
+	Label   string `json:"label"`
+	Type    uint8  `json:"type"`
+	SubType uint8  `json:"subtype"`
+	Offset  uint32 `json:"offset"`
+	Size    uint32 `json:"size"`
+	Flags   uint32 `json:"flags"`
+}
+
+// End returns the first offset behind the partition
+func (e Entry) End() uint32 {
+	return e.Offset + e.Size
+}
+
+// Table is a parsed partition table
+type Table struct {
+	Entries []Entry `json:"entries"`
+	HasMD5  bool    `json:"has_md5"`
+}
+
+// Size returns the number of bytes the binary table occupies in front of its
+// 0xFFFF terminator
+func (t *Table) Size() int {
+	rows := len(t.Entries)
+	if t.HasMD5 {
+		rows++
+	}
+	return rows * EntrySize
+}
+
+// ParseBinary parses a binary partition table as written to flash. If the
+// table carries an MD5 row the checksum is verified.
+func ParseBinary(data []byte) (*Table, error) {
+	if len(data) > MaxTableSize {
+		data = data[:MaxTableSize]
+	}
+	table := &Table{}
+	for offset := 0; offset+EntrySize <= len(data); offset += EntrySize {
+		row := data[offset : offset+EntrySize]
+		switch binary.LittleEndian.Uint16(row) {
+		case EntryMagic:
+			if table.HasMD5 {
+				return nil, fmt.Errorf("partition entry at 0x%x follows the MD5 row", offset)
+			}
+			table.Entries = append(table.Entries, Entry{
+				Type:    row[2],
+				SubType: row[3],
+				Offset:  binary.LittleEndian.Uint32(row[4:]),
+				Size:    binary.LittleEndian.Uint32(row[8:]),
+				Label:   string(bytes.TrimRight(row[12:12+LabelSize], "\x00")),
+				Flags:   binary.LittleEndian.Uint32(row[28:]),
+			})
+		case MD5Magic:
+			sum := md5.Sum(data[:offset])
+			if !bytes.Equal(row[16:], sum[:]) {
+				return nil, fmt.Errorf("partition table MD5 mismatch: stored %x, computed %x", row[16:], sum)
+			}
+			table.HasMD5 = true
+		case 0xFFFF:
+			if len(table.Entries) == 0 {
+				return nil, errors.New("partition table is empty")
+			}
+			return table, nil
+		default:
+			return nil, fmt.Errorf("invalid partition table magic at 0x%x", offset)
+		}
+	}
+	return nil, errors.New("partition table is not terminated")
+}
+
+// Binary encodes the table as written to flash, padded with 0xFF to
+// MaxTableSize
+func (t *Table) Binary() ([]byte, error) {
+	if t.Size()+EntrySize > MaxTableSize {
+		return nil, fmt.Errorf("%d partitions do not fit into the partition table", len(t.Entries))
+	}
+	data := bytes.Repeat([]byte{0xFF}, MaxTableSize)
+	for i, entry := range t.Entries {
+		if len(entry.Label) > LabelSize {
+			return nil, fmt.Errorf("partition name %q is longer than %d bytes", entry.Label, LabelSize)
+		}
+		row := data[i*EntrySize : (i+1)*EntrySize]
+		binary.LittleEndian.PutUint16(row, EntryMagic)
+		row[2], row[3] = entry.Type, entry.SubType
+		binary.LittleEndian.PutUint32(row[4:], entry.Offset)
+		binary.LittleEndian.PutUint32(row[8:], entry.Size)
+		label := make([]byte, LabelSize)
+		copy(label, entry.Label)
+		copy(row[12:], label)
+		binary.LittleEndian.PutUint32(row[28:], entry.Flags)
+	}
+	if t.HasMD5 {
+		offset := len(t.Entries) * EntrySize
+		binary.LittleEndian.PutUint16(data[offset:], MD5Magic)
+		sum := md5.Sum(data[:offset])
+		copy(data[offset+16:], sum[:])
+	}
+	return data, nil
+}
+
+// Validate reports every problem of a table placed at tableOffset: names,
+// offset and size alignment, overlaps and duplicate names or subtypes.
+func (t *Table) Validate(tableOffset uint32) error {
+	var errs []error
+	if t.Size()+EntrySize > MaxTableSize {
+		errs = append(errs, fmt.Errorf("%d partitions do not fit into the partition table", len(t.Entries)))
+	}
+	names := map[string]bool{}
+	apps := map[uint8]string{}
+	for _, entry := range t.Entries {
+		switch {
+		case entry.Label == "":
+			errs = append(errs, fmt.Errorf("partition at 0x%x has no name", entry.Offset))
+		case len(entry.Label) > LabelSize:
+			errs = append(errs, fmt.Errorf("partition name %q is longer than %d bytes", entry.Label, LabelSize))
+		case names[entry.Label]:
+			errs = append(errs, fmt.Errorf("partition name %q is used twice", entry.Label))
+		}
+		names[entry.Label] = true
+		if align := alignment(entry.Type); entry.Offset%align != 0 {
+			errs = append(errs, fmt.Errorf("partition %q: offset 0x%x is not aligned to 0x%x", entry.Label, entry.Offset, align))
+		}
+		if entry.Size == 0 {
+			errs = append(errs, fmt.Errorf("partition %q is empty", entry.Label))
+		}
+		if entry.Type == TypeApp {
+			if entry.Size%DataAlignment != 0 {
+				errs = append(errs, fmt.Errorf("partition %q: app size 0x%x is not a multiple of 0x%x", entry.Label, entry.Size, DataAlignment))
+			}
+			if other, ok := apps[entry.SubType]; ok {
+				errs = append(errs, fmt.Errorf("partitions %q and %q are both app partitions of subtype 0x%02x", other, entry.Label, entry.SubType))
+			}
+			apps[entry.SubType] = entry.Label
+		}
+		if uint64(entry.Offset)+uint64(entry.Size) > 0xFFFFFFFF {
+			errs = append(errs, fmt.Errorf("partition %q exceeds the 4 GiB address space", entry.Label))
+		}
+	}
+	if err := t.CheckOverlaps(tableOffset); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// CheckOverlaps returns an error if two partitions share flash space or a
+// partition overlaps with the partition table itself at tableOffset.
+func (t *Table) CheckOverlaps(tableOffset uint32) error {
+	entries := append([]Entry{}, t.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	for i, entry := range entries {
+		if entry.Offset < tableOffset+MaxTableSize && tableOffset < entry.End() {
+			return fmt.Errorf("partition %q overlaps with the partition table at 0x%x", entry.Label, tableOffset)
+		}
+		if i > 0 && entries[i-1].End() > entry.Offset {
+			return fmt.Errorf("partition %q overlaps with partition %q", entry.Label, entries[i-1].Label)
+		}
+	}
+	return nil
+}
+
+// Find returns the partition starting at offset
+func (t *Table) Find(offset uint32) (Entry, bool) {
+	for _, entry := range t.Entries {
+		if entry.Offset == offset {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Containing returns the partition covering the flash range [offset, offset+size)
+func (t *Table) Containing(offset uint32, size uint32) (Entry, bool) {
+	for _, entry := range t.Entries {
+		if offset >= entry.Offset && uint64(offset)+uint64(size) <= uint64(entry.End()) {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
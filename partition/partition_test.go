@@ -0,0 +1,105 @@
+package partition_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBinary(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+
+	table, err := partition.ParseBinary(firmware[partition.DefaultOffset : partition.DefaultOffset+partition.MaxTableSize])
+	require.NoError(t, err)
+	assert.True(t, table.HasMD5)
+	require.Equal(t, 5, len(table.Entries))
+	assert.Equal(t, partition.Entry{Label: "factory", Type: partition.TypeApp, SubType: partition.SubTypeFactory, Offset: 0x20000, Size: 0x200000}, table.Entries[3])
+	assert.NoError(t, table.CheckOverlaps(partition.DefaultOffset))
+
+	entry, ok := table.Containing(0xF000, 0x2000)
+	assert.True(t, ok)
+	assert.Equal(t, "otadata", entry.Label)
+	_, ok = table.Containing(0xF000, 0x2001)
+	assert.False(t, ok)
+
+	table.Entries[1].Size = 0x2001
+	assert.ErrorContains(t, table.CheckOverlaps(partition.DefaultOffset), "overlaps with partition \"otadata\"")
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	raw := firmware[partition.DefaultOffset : partition.DefaultOffset+partition.MaxTableSize]
+	table, err := partition.ParseBinary(raw)
+	require.NoError(t, err)
+	require.NoError(t, table.Validate(partition.DefaultOffset))
+
+	encoded, err := table.Binary()
+	require.NoError(t, err)
+	assert.Equal(t, raw, encoded)
+
+	assert.Equal(t, `# ESP-IDF Partition Table
+# Name, Type, SubType, Offset, Size, Flags
+nvs,data,nvs,0x9000,24K,
+otadata,data,ota,0xf000,8K,
+phy_init,data,phy,0x11000,4K,
+factory,app,factory,0x20000,2M,
+factory_cfg,data,0x40,0x220000,8K,
+`, table.CSV())
+	parsed, err := partition.ParseCSV(strings.NewReader(table.CSV()), partition.DefaultOffset)
+	require.NoError(t, err)
+	assert.Equal(t, table, parsed)
+}
+
+func TestParseCSV(t *testing.T) {
+	t.Parallel()
+
+	// partitions_two_ota.csv of ESP-IDF with automatic offsets
+	csv := `# Name,   Type, SubType, Offset,   Size, Flags
+nvs,      data, nvs,     ,        0x4000,
+otadata,  data, ota,     ,        0x2000,
+phy_init, data, phy,     ,        0x1000,
+factory,  app,  factory, ,        1M,
+ota_0,    app,  ota_0,   ,        1M,
+ota_1,    app,  ota_1,   ,        1M, encrypted:readonly
+`
+	table, err := partition.ParseCSV(strings.NewReader(csv), partition.DefaultOffset)
+	require.NoError(t, err)
+	require.NoError(t, table.Validate(partition.DefaultOffset))
+	offsets := []uint32{}
+	for _, entry := range table.Entries {
+		offsets = append(offsets, entry.Offset)
+	}
+	assert.Equal(t, []uint32{0x9000, 0xd000, 0xf000, 0x10000, 0x110000, 0x210000}, offsets)
+	assert.Equal(t, partition.Entry{Label: "ota_1", Type: partition.TypeApp, SubType: partition.SubTypeOTA0 + 1, Offset: 0x210000, Size: 0x100000, Flags: partition.FlagEncrypted | partition.FlagReadOnly}, table.Entries[5])
+
+	_, err = partition.ParseCSV(strings.NewReader("nvs, data, nvs, 0x9000\nfactory, app, ota_16, , 1M\napp, bogus, , , 1M\n"), partition.DefaultOffset)
+	assert.ErrorContains(t, err, "line 1: expected name")
+	assert.ErrorContains(t, err, `line 2: invalid app subtype "ota_16"`)
+	assert.ErrorContains(t, err, `line 3: invalid type "bogus"`)
+
+	table, err = partition.ParseCSV(strings.NewReader(`
+nvs,      data, nvs,     0x9000,  0x6000,
+a_name_longer_than_16, data, phy, 0xf000, 0x1000,
+factory,  app,  factory, 0x18000, 0x100800,
+test,     app,  factory, 0x120000, 1M,
+nvs,      data, nvs,     0x7000,  0x2000,
+`), partition.DefaultOffset)
+	require.NoError(t, err)
+	err = table.Validate(partition.DefaultOffset)
+	assert.ErrorContains(t, err, "longer than 16 bytes")
+	assert.ErrorContains(t, err, `partition "factory": offset 0x18000 is not aligned to 0x10000`)
+	assert.ErrorContains(t, err, "app size 0x100800 is not a multiple of 0x1000")
+	assert.ErrorContains(t, err, `partitions "factory" and "test" are both app partitions`)
+	assert.ErrorContains(t, err, `partition name "nvs" is used twice`)
+	assert.ErrorContains(t, err, "overlaps with the partition table")
+}
@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var devicesBucket = []byte("devices")
+
+// BoltStore persists devices in an embedded bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(devicesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func putDevice(bucket *bolt.Bucket, device Device) error {
+	value, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(device.ID), value)
+}
+
+func getDevice(bucket *bolt.Bucket, id string) (device Device, err error) {
+	value := bucket.Get([]byte(id))
+	if value == nil {
+		return device, ErrNotFound
+	}
+	err = json.Unmarshal(value, &device)
+	return
+}
+
+func (b *BoltStore) Put(device Device) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putDevice(tx.Bucket(devicesBucket), device)
+	})
+}
+
+func (b *BoltStore) Get(id string) (device Device, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		device, err = getDevice(tx.Bucket(devicesBucket), id)
+		return err
+	})
+	return
+}
+
+func (b *BoltStore) List(query Query) ([]Device, error) {
+	devices := []Device{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(devicesBucket).ForEach(func(_, value []byte) error {
+			var device Device
+			if err := json.Unmarshal(value, &device); err != nil {
+				return err
+			}
+			if query.Matches(&device) {
+				devices = append(devices, device)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+func (b *BoltStore) Revoke(id string, at time.Time) (device Device, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucket)
+		device, err = getDevice(bucket, id)
+		if err != nil || device.RevokedAt != nil {
+			return err
+		}
+		device.RevokedAt = &at
+		device.UpdatedAt = at
+		return putDevice(bucket, device)
+	})
+	return
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
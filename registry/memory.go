@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps devices in memory only
+type MemoryStore struct {
+	mu      sync.RWMutex
+	devices map[string]Device
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{devices: map[string]Device{}}
+}
+
+func (m *MemoryStore) Put(device Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices[device.ID] = device
+	return nil
+}
+
+func (m *MemoryStore) Get(id string) (Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	device, ok := m.devices[id]
+	if !ok {
+		return Device{}, ErrNotFound
+	}
+	return device, nil
+}
+
+func (m *MemoryStore) List(query Query) ([]Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	devices := []Device{}
+	for _, device := range m.devices {
+		if query.Matches(&device) {
+			devices = append(devices, device)
+		}
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+func (m *MemoryStore) Revoke(id string, at time.Time) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[id]
+	if !ok {
+		return Device{}, ErrNotFound
+	}
+	if device.RevokedAt == nil {
+		device.RevokedAt = &at
+		device.UpdatedAt = at
+		m.devices[id] = device
+	}
+	return device, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
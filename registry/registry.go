@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned if no device with the requested ID is registered
+var ErrNotFound = errors.New("device not found")
+
+// Device is a provisioned bridge
+type Device struct {
+	ID              string     `json:"id"`
+	MCU             string     `json:"mcu"`
+	FirmwareVersion string     `json:"firmware_version"`
+	LiquidAddress   string     `json:"liquid_address,omitempty"`
+	DirURI          string     `json:"dir_uri,omitempty"`
+	OutputHash      string     `json:"output_hash"`
+	PublicKey       string     `json:"public_key,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the device got revoked
+func (d *Device) Revoked() bool {
+	return d.RevokedAt != nil
+}
+
+// Query filters devices. Empty fields match every device; Text matches a
+// substring of any of the text fields.
+type Query struct {
+	MCU             string
+	FirmwareVersion string
+	LiquidAddress   string
+	DirURI          string
+	Text            string
+	IncludeRevoked  bool
+}
+
+// Matches reports whether device fulfills the query
+func (q Query) Matches(device *Device) bool {
+	if device.Revoked() && !q.IncludeRevoked {
+		return false
+	}
+	if (q.MCU != "" && q.MCU != device.MCU) ||
+		(q.FirmwareVersion != "" && q.FirmwareVersion != device.FirmwareVersion) ||
+		(q.LiquidAddress != "" && q.LiquidAddress != device.LiquidAddress) ||
+		(q.DirURI != "" && q.DirURI != device.DirURI) {
+		return false
+	}
+	if q.Text == "" {
+		return true
+	}
+	for _, field := range []string{device.ID, device.MCU, device.FirmwareVersion, device.LiquidAddress, device.DirURI, device.OutputHash, device.PublicKey} {
+		if strings.Contains(strings.ToLower(field), strings.ToLower(q.Text)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists devices. Implementations have to be safe for concurrent use.
+type Store interface {
+	// Put inserts or replaces a device
+	Put(device Device) error
+	// Get returns the device with id or ErrNotFound
+	Get(id string) (Device, error)
+	// List returns all devices matching query ordered by creation time
+	List(query Query) ([]Device, error)
+	// Revoke marks the device with id as revoked at the given time
+	Revoke(id string, at time.Time) (Device, error)
+	// Close releases the resources of the store
+	Close() error
+}
+
+func sortDevices(devices []Device) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].CreatedAt.Before(devices[j].CreatedAt)
+	})
+}
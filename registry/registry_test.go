@@ -0,0 +1,78 @@
+package registry_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store registry.Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	devices := []registry.Device{
+		{ID: "a1", MCU: "esp32c6", FirmwareVersion: "v0.1.3", LiquidAddress: "tlq1qq", DirURI: "https://hub-1", OutputHash: "aa", CreatedAt: now, UpdatedAt: now},
+		{ID: "b2", MCU: "esp32c6", FirmwareVersion: "v0.1.4", DirURI: "https://hub-2", OutputHash: "bb", CreatedAt: now.Add(time.Minute), UpdatedAt: now},
+		{ID: "c3", MCU: "esp32s3", FirmwareVersion: "v0.1.4", OutputHash: "cc", CreatedAt: now.Add(2 * time.Minute), UpdatedAt: now},
+	}
+	for _, device := range devices {
+		require.NoError(t, store.Put(device))
+	}
+
+	device, err := store.Get("b2")
+	require.NoError(t, err)
+	assert.Equal(t, devices[1], device)
+	_, err = store.Get("unknown")
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+
+	all, err := store.List(registry.Query{})
+	require.NoError(t, err)
+	assert.Equal(t, devices, all)
+
+	found, err := store.List(registry.Query{MCU: "esp32c6", FirmwareVersion: "v0.1.4"})
+	require.NoError(t, err)
+	assert.Equal(t, []registry.Device{devices[1]}, found)
+
+	found, err = store.List(registry.Query{Text: "HUB-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []registry.Device{devices[0]}, found)
+
+	revoked, err := store.Revoke("a1", now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, revoked.Revoked())
+	_, err = store.Revoke("unknown", now)
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+
+	active, err := store.List(registry.Query{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(active))
+	all, err = store.List(registry.Query{IncludeRevoked: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(all))
+	assert.True(t, all[0].Revoked())
+
+	require.NoError(t, store.Close())
+}
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+	testStore(t, registry.NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "registry.db")
+	store, err := registry.OpenBoltStore(path)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	reopened, err := registry.OpenBoltStore(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	device, err := reopened.Get("a1")
+	require.NoError(t, err)
+	assert.True(t, device.Revoked())
+}
@@ -0,0 +1,498 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// Overlay replaces the bytes of a base firmware starting at Offset
+type Overlay struct {
+	Offset int
+	Data   []byte
+}
+
+// Build is a firmware represented as an immutable, shared base with sorted,
+// non-overlapping overlays. It is never materialized unless Bytes is called.
+type Build struct {
+	base     []byte
+	overlays []Overlay
+}
+
+// NewBuild sorts overlays and returns the build of base with them applied
+func NewBuild(base []byte, overlays []Overlay) *Build {
+	sort.Slice(overlays, func(i, j int) bool { return overlays[i].Offset < overlays[j].Offset })
+	return &Build{base: base, overlays: overlays}
+}
+
+// Len returns the size of the firmware
+func (b *Build) Len() int {
+	return len(b.base)
+}
+
+// OverlaySize returns the number of bytes held by the build itself
+func (b *Build) OverlaySize() int64 {
+	var size int64
+	for _, overlay := range b.overlays {
+		size += int64(len(overlay.Data))
+	}
+	return size
+}
+
+// writeRange writes the firmware bytes [start, end) to w
+func (b *Build) writeRange(w io.Writer, start int, end int) (written int64, err error) {
+	write := func(data []byte) bool {
+		var n int
+		n, err = w.Write(data)
+		written += int64(n)
+		return err == nil
+	}
+	pos := start
+	for _, overlay := range b.overlays {
+		overlayEnd := overlay.Offset + len(overlay.Data)
+		if overlayEnd <= pos {
+			continue
+		}
+		if overlay.Offset >= end {
+			break
+		}
+		if overlay.Offset > pos && !write(b.base[pos:overlay.Offset]) {
+			return
+		}
+		from := max(pos, overlay.Offset)
+		to := min(end, overlayEnd)
+		if !write(overlay.Data[from-overlay.Offset : to-overlay.Offset]) {
+			return
+		}
+		pos = to
+	}
+	if pos < end {
+		write(b.base[pos:end])
+	}
+	return
+}
+
+// WriteTo streams the firmware to w
+func (b *Build) WriteTo(w io.Writer) (int64, error) {
+	return b.writeRange(w, 0, len(b.base))
+}
+
+// Bytes materializes the firmware
+func (b *Build) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(b.base))
+	_, _ = b.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// Digests returns the hex encoded MD5 and SHA-256 of the firmware, computed
+// in a single pass
+func (b *Build) Digests() (md5Hex string, sha256Hex string) {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	_, _ = b.WriteTo(io.MultiWriter(md5Hash, sha256Hash))
+	return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil))
+}
+
+// FirmwareBuilder builds firmwares from a base without copying it. Everything
+// that does not depend on the request, i.e. the slot offsets, the checksums of
+// the app images and their SHA-256 states up to the first slot, is computed
+// once.
+type FirmwareBuilder struct {
+	// Digest is the SHA-256 of the base firmware
+	Digest []byte
+	base   []byte
+	// apps are the app images every build patches; the slots of the first
+	// one decide what a build can hold
+	apps []*appImage
+	// signingKey re-signs builds for Secure Boot V2, nil keeps the
+	// signature sector of the base
+	signingKey *esp.SigningKey
+	// encryptionKey encrypts builds requesting encryption without a key of
+	// their own
+	encryptionKey []byte
+	// table is the partition table of a merged base, nil for a bare app image
+	table *partition.Table
+	// contents are the partitions of the base holding data, each with the
+	// length up to its last non-erased byte
+	contents []partitionContent
+}
+
+type partitionContent struct {
+	entry  partition.Entry
+	length int
+}
+
+// appImage is an app image of the base prepared for patching
+type appImage struct {
+	offset    int
+	img       *esp.Image
+	slots     map[string]int
+	hashStart int
+	// hashState is the SHA-256 state after the image bytes up to hashStart
+	hashState []byte
+}
+
+func newAppImage(base []byte, offset int) (*appImage, error) {
+	if offset < 0 || offset >= len(base) {
+		return nil, fmt.Errorf("application offset 0x%x is outside of the image", offset)
+	}
+	img, err := esp.ParseImage(base[offset:])
+	if err != nil {
+		return nil, err
+	}
+	app := &appImage{
+		offset:    offset,
+		img:       img,
+		slots:     map[string]int{},
+		hashStart: img.ChecksumOffset,
+	}
+	for _, location := range FindSlots(base[offset : offset+img.Length]) {
+		app.slots[location.Slot.Name] = offset + location.Offset
+		app.hashStart = min(app.hashStart, location.Offset)
+	}
+	h := sha256.New()
+	h.Write(base[offset : offset+app.hashStart])
+	if app.hashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// NewFirmwareBuilder prepares builds patching the application images at
+// offsets of base, e.g. the factory app and an OTA slot holding the same
+// firmware. base must not be modified afterwards.
+func NewFirmwareBuilder(base []byte, offsets ...int) (*FirmwareBuilder, error) {
+	if len(offsets) == 0 {
+		return nil, errors.New("no application offset given")
+	}
+	digest := sha256.Sum256(base)
+	builder := &FirmwareBuilder{Digest: digest[:], base: base}
+	for i, offset := range offsets {
+		if slices.Contains(offsets[:i], offset) {
+			return nil, fmt.Errorf("application offset 0x%x is given twice", offset)
+		}
+		app, err := newAppImage(base, offset)
+		if err != nil {
+			if len(offsets) > 1 {
+				err = fmt.Errorf("app at 0x%x: %w", offset, err)
+			}
+			return nil, err
+		}
+		builder.apps = append(builder.apps, app)
+	}
+	if len(base) >= partition.DefaultOffset+partition.MaxTableSize {
+		// only merged images can select their boot slot or partition table
+		builder.table, _ = partition.ParseBinary(base[partition.DefaultOffset:])
+	}
+	if builder.table != nil {
+		for _, entry := range builder.table.Entries {
+			if int(entry.Offset) >= len(base) {
+				continue
+			}
+			content := base[entry.Offset:min(len(base), int(entry.End()))]
+			if length := len(bytes.TrimRight(content, "\xff")); length > 0 {
+				builder.contents = append(builder.contents, partitionContent{entry: entry, length: length})
+			}
+		}
+	}
+	return builder, nil
+}
+
+// SetSigningKey makes every build carry Secure Boot V2 signatures of the
+// patched app images made with key, since patching invalidates the
+// signatures of the base. The signature sectors have to fit into the base.
+func (fb *FirmwareBuilder) SetSigningKey(key *esp.SigningKey) error {
+	for _, app := range fb.apps {
+		end := app.offset + esp.SignatureOffset(app.img.Length) + esp.SignatureSectorSize
+		if end > len(fb.base) {
+			return fmt.Errorf("the signature sector of the app at 0x%x exceeds the firmware", app.offset)
+		}
+		if fb.table != nil {
+			if _, ok := fb.table.Containing(uint32(app.offset), uint32(end-app.offset)); !ok {
+				return fmt.Errorf("the signature sector of the app at 0x%x exceeds its partition", app.offset)
+			}
+		}
+	}
+	fb.signingKey = key
+	return nil
+}
+
+// SetFlashEncryptionKey sets the XTS-AES-128 key of builds requesting flash
+// encryption without a per-device key
+func (fb *FirmwareBuilder) SetFlashEncryptionKey(key []byte) error {
+	if len(key) != flashcrypt.KeySize {
+		return fmt.Errorf("flash encryption key has %d bytes, expected %d", len(key), flashcrypt.KeySize)
+	}
+	fb.encryptionKey = key
+	return nil
+}
+
+// imageHash returns the SHA-256 of the build from the start of app up to
+// end, resuming the precomputed state of the base
+func (app *appImage) imageHash(build *Build, end int) ([]byte, error) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(app.hashState); err != nil {
+		return nil, err
+	}
+	if _, err := build.writeRange(h, app.offset+app.hashStart, end); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// HasSlot reports whether every app of the base reserves slot
+func (fb *FirmwareBuilder) HasSlot(slot Slot) bool {
+	for _, app := range fb.apps {
+		if _, ok := app.slots[slot.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestError reports a request the firmware cannot be built for, unlike
+// the other errors of Build that are failures of the service
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Build validates req and returns the patched firmware with fixed checksum,
+// appended hash and, with a signing key, a new signature. Builds requesting
+// encryption are encrypted last. Requests the firmware cannot be built for
+// are refused with a RequestError.
+func (fb *FirmwareBuilder) Build(req *FirmwareRequest) (*Build, error) {
+	if err := req.Validate(); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	certificates, err := ValidateCertificates(req.CACert, req.ClientCert, req.ClientKey, time.Now())
+	if err != nil {
+		return nil, &RequestError{Err: err}
+	}
+
+	var overlays []Overlay
+	// values are refused unless every app reserves their slot, so a
+	// request is never served without a part of it
+	add := func(slot Slot, value []byte) error {
+		if len(value) == 0 {
+			return nil
+		}
+		for _, app := range fb.apps {
+			offset, ok := app.slots[slot.Name]
+			if !ok {
+				return &RequestError{Err: fmt.Errorf("firmware does not reserve a %s slot", slot.Name)}
+			}
+			data := make([]byte, slot.Size())
+			copy(data, value)
+			overlays = append(overlays, Overlay{Offset: offset, Data: data})
+		}
+		return nil
+	}
+	for _, value := range []struct {
+		slot  Slot
+		value string
+	}{
+		{SSIDSlot, req.SSID},
+		{PasswordSlot, req.PWD},
+		{LiquidAddressSlot, req.LiquidAddress},
+		{DirAuthTokenSlot, req.DirAuthToken},
+		{DirURISlot, req.DirURI},
+	} {
+		if err := add(value.slot, []byte(value.value)); err != nil {
+			return nil, err
+		}
+	}
+	if certificates != nil {
+		for _, value := range []struct {
+			slot    Slot
+			entries [][]byte
+		}{
+			{CACertSlot, certificates.CACerts},
+			{ClientCertSlot, certificates.ClientCerts},
+			{ClientKeySlot, [][]byte{certificates.ClientKey}},
+		} {
+			if len(value.entries) == 0 || len(value.entries[0]) == 0 {
+				continue
+			}
+			encoded, err := encodeDERSlot(value.slot, value.entries)
+			if err != nil {
+				return nil, &RequestError{Err: err}
+			}
+			if err = add(value.slot, encoded); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if req.Identity != nil {
+		if err := add(DeviceIdentitySlot, req.Identity.encode()); err != nil {
+			return nil, err
+		}
+	}
+	table := fb.table
+	if req.PartitionTable != "" {
+		if table, err = fb.partitionTable(req.PartitionTable); err != nil {
+			return nil, &RequestError{Err: err}
+		}
+		encoded, err := table.Binary()
+		if err != nil {
+			return nil, err
+		}
+		overlays = append(overlays, Overlay{Offset: partition.DefaultOffset, Data: encoded})
+	}
+	if req.BootSlot != "" {
+		overlay, err := fb.bootSlotOverlay(table, req.BootSlot)
+		if err != nil {
+			return nil, &RequestError{Err: err}
+		}
+		overlays = append(overlays, overlay)
+	}
+
+	// the XOR checksum only changes by the bytes replaced inside segments
+	checksums := make([]Overlay, len(fb.apps))
+	for n, app := range fb.apps {
+		checksum := app.img.ComputedChecksum
+		for _, overlay := range overlays {
+			for _, segment := range app.img.Segments {
+				start := max(overlay.Offset, app.offset+segment.Offset)
+				end := min(overlay.Offset+len(overlay.Data), app.offset+segment.Offset+int(segment.DataLen))
+				for i := start; i < end; i++ {
+					checksum ^= fb.base[i] ^ overlay.Data[i-overlay.Offset]
+				}
+			}
+		}
+		checksums[n] = Overlay{Offset: app.offset + app.img.ChecksumOffset, Data: []byte{checksum}}
+	}
+	build := NewBuild(fb.base, append(overlays, checksums...))
+
+	// every app image only covers its own overlays, so hashes and
+	// signatures of one app do not depend on the others
+	for i, app := range fb.apps {
+		checksumOffset := checksums[i].Offset
+		if app.img.HashAppended {
+			hash, err := app.imageHash(build, checksumOffset+1)
+			if err != nil {
+				return nil, err
+			}
+			build = NewBuild(fb.base, append(build.overlays, Overlay{Offset: checksumOffset + 1, Data: hash}))
+		}
+		if fb.signingKey != nil {
+			signatureOffset := app.offset + esp.SignatureOffset(app.img.Length)
+			digest, err := app.imageHash(build, signatureOffset)
+			if err != nil {
+				return nil, err
+			}
+			sector, err := fb.signingKey.SignatureSector(digest)
+			if err != nil {
+				return nil, err
+			}
+			build = NewBuild(fb.base, append(build.overlays, Overlay{Offset: signatureOffset, Data: sector}))
+		}
+	}
+	if req.Encrypt || req.FlashEncryptionKey != "" {
+		return fb.encrypt(build, req)
+	}
+	return build, nil
+}
+
+// encrypt returns build pre-encrypted with the key of req or the configured
+// one. Encryption changes the whole image, so the result holds a full copy.
+func (fb *FirmwareBuilder) encrypt(build *Build, req *FirmwareRequest) (*Build, error) {
+	key := fb.encryptionKey
+	if req.FlashEncryptionKey != "" {
+		var err error
+		if key, err = req.flashEncryptionKey(); err != nil {
+			return nil, &RequestError{Err: err}
+		}
+	}
+	if key == nil {
+		return nil, &RequestError{Err: errors.New("encrypt: no flash_encryption_key given and none configured")}
+	}
+	if fb.table == nil {
+		return nil, &RequestError{Err: errors.New("encrypt: the firmware has no partition table")}
+	}
+	if err := flashcrypt.CheckChip(fb.apps[0].img.Chip); err != nil {
+		return nil, &RequestError{Err: fmt.Errorf("encrypt: %w", err)}
+	}
+	encrypted, _, err := flashcrypt.EncryptImage(build.Bytes(), key, flashcrypt.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	return NewBuild(fb.base, []Overlay{{Offset: 0, Data: encrypted}}), nil
+}
+
+// partitionTable parses the CSV partition table replacing the one of the
+// base. Every partition of the base holding data has to keep its place, type
+// and subtype and still fit.
+func (fb *FirmwareBuilder) partitionTable(csv string) (*partition.Table, error) {
+	if fb.table == nil {
+		return nil, errors.New("partition_table: the firmware has no partition table")
+	}
+	table, err := parsePartitionTable(csv)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, content := range fb.contents {
+		entry, ok := table.Find(content.entry.Offset)
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("partition_table: no partition at 0x%x holds the %q partition of the firmware", content.entry.Offset, content.entry.Label))
+		case entry.Type != content.entry.Type || entry.SubType != content.entry.SubType:
+			errs = append(errs, fmt.Errorf("partition_table: %q at 0x%x changes the type of the %q partition of the firmware", entry.Label, entry.Offset, content.entry.Label))
+		case int(entry.Size) < content.length:
+			errs = append(errs, fmt.Errorf("partition_table: %q at 0x%x is smaller than the %d bytes the firmware stores there", entry.Label, entry.Offset, content.length))
+		}
+	}
+	return table, errors.Join(errs...)
+}
+
+// bootSlotOverlay returns the otadata making the bootloader start the app in
+// the named slot of table, which has to hold an app image in the base
+func (fb *FirmwareBuilder) bootSlotOverlay(table *partition.Table, name string) (Overlay, error) {
+	n, err := otadata.ParseSlot(name)
+	if err != nil {
+		return Overlay{}, err
+	}
+	if table == nil {
+		return Overlay{}, errors.New("boot_slot: the firmware has no partition table")
+	}
+	location, ok := otadata.Find(table)
+	if !ok || int(location.Offset)+otadata.Size > len(fb.base) {
+		return Overlay{}, errors.New("boot_slot: the firmware has no otadata partition")
+	}
+	entry, err := otadata.SlotPartition(table, n)
+	if err != nil {
+		return Overlay{}, fmt.Errorf("boot_slot: %w", err)
+	}
+	data := otadata.ForSlot(n)
+	if boot, err := otadata.BootPartition(table, data); err != nil || boot != entry {
+		return Overlay{}, fmt.Errorf("boot_slot: the bootloader cannot select %s with this partition table", name)
+	}
+	if int(entry.Offset) >= len(fb.base) {
+		return Overlay{}, fmt.Errorf("boot_slot: %s holds no app image", name)
+	}
+	if _, err := esp.ParseImage(fb.base[entry.Offset:]); err != nil {
+		return Overlay{}, fmt.Errorf("boot_slot: %s holds no app image: %w", name, err)
+	}
+	return Overlay{Offset: int(location.Offset), Data: data.Encode()}, nil
+}
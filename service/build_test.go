@@ -0,0 +1,375 @@
+package service_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/rddl-network/dirigera2mqtt/integrity"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyAndPatch is the reference build pipeline, patching a full copy of the
+// base and fixing the checksum and hash of its app
+func copyAndPatch(t testing.TB, base []byte, req *service.FirmwareRequest) []byte {
+	bundle, err := service.ValidateCertificates(req.CACert, req.ClientCert, req.ClientKey, time.Now())
+	require.NoError(t, err)
+	firmware := service.PatchFirmware(bytes.Clone(base), req.SSID, req.PWD, req.LiquidAddress, req.DirAuthToken, req.DirURI, config.DefaultAppOffset)
+	if bundle != nil {
+		patchDERSlot(t, firmware, service.CACertSlot, bundle.CACerts...)
+		if len(bundle.ClientCerts) > 0 {
+			patchDERSlot(t, firmware, service.ClientCertSlot, bundle.ClientCerts...)
+			patchDERSlot(t, firmware, service.ClientKeySlot, bundle.ClientKey)
+		}
+	}
+	if req.Identity != nil {
+		identity := append(bytes.Clone(req.Identity.ID), req.Identity.PrivateKey.Seed()...)
+		patchSlot(firmware, service.DeviceIdentitySlot, append(identity, req.Identity.PublicKey()...))
+	}
+	return service.ComputeAndSetFirmwareChecksum(firmware, config.DefaultAppOffset)
+}
+
+// patchSlot overwrites the first placeholder of slot in firmware with value,
+// padded with zeros. Empty values leave the placeholder untouched.
+func patchSlot(firmware []byte, slot service.Slot, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	if i := bytes.Index(firmware, []byte(slot.Pattern)); i >= 0 {
+		copy(firmware[i:i+slot.Size()], make([]byte, slot.Size()))
+		copy(firmware[i:i+slot.Size()], value)
+	}
+}
+
+// patchDERSlot patches slot with DER blobs in the encoding of the firmware
+func patchDERSlot(t testing.TB, firmware []byte, slot service.Slot, entries ...[]byte) {
+	encoded, err := service.EncodeDERSlot(slot, entries)
+	require.NoError(t, err)
+	patchSlot(firmware, slot, encoded)
+}
+
+func TestFirmwareBuilder(t *testing.T) {
+	t.Parallel()
+
+	validUntil := time.Now().Add(24 * time.Hour)
+	ca := createTestCert(t, "broker ca", nil, true, validUntil)
+	client := createTestCert(t, "bridge", ca, false, validUntil)
+	identity, err := service.NewDeviceIdentity()
+	require.NoError(t, err)
+
+	base := baseWithAllSlots(t)
+	original := bytes.Clone(base)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	digest := sha256.Sum256(base)
+	assert.Equal(t, digest[:], builder.Digest)
+
+	requests := []*service.FirmwareRequest{
+		{},
+		{SSID: "mynetwork", PWD: "mypassword"},
+		{SSID: "mynetwork", PWD: "mypassword", LiquidAddress: "tlq1qq", DirAuthToken: "token", DirURI: "https://dirigera.local:8443"},
+		{SSID: "mynetwork", CACert: ca.certPEM, ClientCert: client.certPEM, ClientKey: client.keyPEM},
+		{SSID: "mynetwork", PWD: "mypassword", Identity: identity},
+	}
+	for _, req := range requests {
+		expected := copyAndPatch(t, base, req)
+		build, err := builder.Build(req)
+		require.NoError(t, err)
+		assert.Equal(t, len(expected), build.Len())
+		assert.True(t, bytes.Equal(expected, build.Bytes()), "request %+v", req)
+		assert.True(t, service.VerifyBinaryIntegrity(build.Bytes(), config.DefaultAppOffset))
+
+		md5Hex, sha256Hex := build.Digests()
+		md5Sum, sha256Sum := md5.Sum(expected), sha256.Sum256(expected)
+		assert.Equal(t, hex.EncodeToString(md5Sum[:]), md5Hex)
+		assert.Equal(t, hex.EncodeToString(sha256Sum[:]), sha256Hex)
+	}
+	assert.True(t, bytes.Equal(original, base), "the base is never modified")
+
+	_, err = builder.Build(&service.FirmwareRequest{DirURI: "dirigera.local"})
+	assert.ErrorContains(t, err, "dir_uri")
+	var invalid *service.RequestError
+	assert.ErrorAs(t, err, &invalid)
+}
+
+func TestFirmwareBuilderMissingSlots(t *testing.T) {
+	t.Parallel()
+
+	validUntil := time.Now().Add(24 * time.Hour)
+	ca := createTestCert(t, "broker ca", nil, true, validUntil)
+	client := createTestCert(t, "bridge", ca, false, validUntil)
+	identity, err := service.NewDeviceIdentity()
+	require.NoError(t, err)
+
+	// the test firmware reserves no certificate and identity slots
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.False(t, builder.HasSlot(service.CACertSlot))
+
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", CACert: ca.certPEM})
+	assert.EqualError(t, err, "firmware does not reserve a ca_cert slot")
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", CACert: ca.certPEM, ClientCert: client.certPEM, ClientKey: client.keyPEM})
+	assert.EqualError(t, err, "firmware does not reserve a ca_cert slot")
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", Identity: identity})
+	assert.EqualError(t, err, "firmware does not reserve a device_identity slot")
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", DirURI: "https://dirigera.local"})
+	assert.NoError(t, err)
+}
+
+// shortWriter accepts a limited number of bytes
+type shortWriter struct{ left int }
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n := w.left
+		w.left = 0
+		return n, io.ErrShortWrite
+	}
+	w.left -= len(p)
+	return len(p), nil
+}
+
+func TestBuildWriteTo(t *testing.T) {
+	t.Parallel()
+
+	base := bytes.Repeat([]byte{0xFF}, 16)
+	build := service.NewBuild(base, []service.Overlay{{Offset: 10, Data: []byte{1, 2}}, {Offset: 2, Data: []byte{3, 4, 5}}})
+	assert.Equal(t, []byte{0xFF, 0xFF, 3, 4, 5, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2, 0xFF, 0xFF, 0xFF, 0xFF}, build.Bytes())
+	assert.Equal(t, int64(5), build.OverlaySize())
+
+	n, err := build.WriteTo(&shortWriter{left: 4})
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+	assert.Equal(t, int64(4), n)
+}
+
+func BenchmarkBuildCopy(b *testing.B) {
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(b, err)
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", DirURI: "https://dirigera.local:8443"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		firmware := copyAndPatch(b, base, req)
+		md5.Sum(firmware)
+	}
+}
+
+func BenchmarkBuildStreaming(b *testing.B) {
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(b, err)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(b, err)
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", DirURI: "https://dirigera.local:8443"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		build, err := builder.Build(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		hash := md5.New()
+		if _, err := build.WriteTo(io.MultiWriter(hash, io.Discard)); err != nil {
+			b.Fatal(err)
+		}
+		hash.Sum(nil)
+	}
+}
+
+// baseWithOTASlot turns the factory_cfg partition of the test firmware into
+// an ota_0 partition holding a copy of the factory app
+func baseWithOTASlot(t *testing.T) []byte {
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	table := firmware[partition.DefaultOffset : partition.DefaultOffset+partition.MaxTableSize]
+	row := table[4*partition.EntrySize : 5*partition.EntrySize]
+	row[2], row[3] = partition.TypeApp, partition.SubTypeOTA0
+	binary.LittleEndian.PutUint32(row[4:], 0x220000)
+	binary.LittleEndian.PutUint32(row[8:], 0x200000)
+	copy(row[12:28], append([]byte("ota_0"), make([]byte, 11)...))
+	sum := md5.Sum(table[:5*partition.EntrySize])
+	copy(table[5*partition.EntrySize+16:], sum[:])
+
+	app := firmware[config.DefaultAppOffset:]
+	base := append(firmware, bytes.Repeat([]byte{0xFF}, 0x220000-len(firmware))...)
+	return append(base, app...)
+}
+
+func TestFirmwareBuilderBootSlot(t *testing.T) {
+	t.Parallel()
+
+	base := baseWithOTASlot(t)
+	require.True(t, integrity.Verify(base, integrity.Options{}).Valid)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+
+	for _, slot := range []string{"ota_0", "factory"} {
+		build, err := builder.Build(&service.FirmwareRequest{SSID: "mynetwork", BootSlot: slot})
+		require.NoError(t, err)
+		firmware := build.Bytes()
+		report := integrity.Verify(firmware, integrity.Options{})
+		require.True(t, report.Valid, report.Errors())
+		assert.Equal(t, slot, otadata.SlotName(*report.Boot))
+
+		inspected, err := service.InspectFirmware(base, firmware, config.DefaultAppOffset, false)
+		require.NoError(t, err)
+		assert.Equal(t, slot, inspected.BootSlot)
+	}
+
+	_, err = builder.Build(&service.FirmwareRequest{BootSlot: "ota_1"})
+	assert.ErrorContains(t, err, "no ota_1 partition")
+	_, err = builder.Build(&service.FirmwareRequest{BootSlot: "recovery"})
+	assert.ErrorContains(t, err, "invalid boot slot")
+
+	// the slot has to hold an app image
+	fixture, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	builder, err = service.NewFirmwareBuilder(base[:len(fixture)], config.DefaultAppOffset)
+	require.NoError(t, err)
+	_, err = builder.Build(&service.FirmwareRequest{BootSlot: "ota_0"})
+	assert.ErrorContains(t, err, "ota_0 holds no app image")
+}
+
+func TestFirmwareBuilderPartitionTable(t *testing.T) {
+	t.Parallel()
+
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+
+	// nvs grows into the space of otadata and phy_init, which are erased
+	custom := `nvs,         data, nvs,     0x9000,   0x9000,
+otadata,     data, ota,     0x12000,  0x2000,
+factory,     app,  factory, 0x20000,  2M,
+factory_cfg, data, 0x40,    0x220000, 8K,
+ota_0,       app,  ota_0,   0x230000, 1M,
+`
+	build, err := builder.Build(&service.FirmwareRequest{SSID: "mynetwork", PartitionTable: custom, BootSlot: "factory"})
+	require.NoError(t, err)
+	firmware := build.Bytes()
+	report := integrity.Verify(firmware, integrity.Options{})
+	require.True(t, report.Valid, report.Errors())
+	table, err := partition.ParseBinary(firmware[partition.DefaultOffset:])
+	require.NoError(t, err)
+	require.Len(t, table.Entries, 5)
+	assert.Equal(t, uint32(0x9000), table.Entries[0].Size)
+
+	_, err = builder.Build(&service.FirmwareRequest{PartitionTable: "factory, app, factory, 0x30000, 2M,\n"})
+	assert.ErrorContains(t, err, `no partition at 0x20000 holds the "factory" partition`)
+	_, err = builder.Build(&service.FirmwareRequest{PartitionTable: "factory, app, factory, 0x20000, 1M,\n"})
+	assert.ErrorContains(t, err, "is smaller than")
+	_, err = builder.Build(&service.FirmwareRequest{PartitionTable: "factory, app, factory, 0x28000, 1M,\n"})
+	assert.ErrorContains(t, err, "is not aligned to 0x10000")
+}
+
+func TestFirmwareBuilderSigning(t *testing.T) {
+	t.Parallel()
+
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	pemData, err := os.ReadFile("../test/secureboot/rsa3072.pem")
+	require.NoError(t, err)
+	key, err := esp.ParseSigningKey(pemData)
+	require.NoError(t, err)
+
+	// the fixture ends with the app, leaving no room for the signature
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.ErrorContains(t, builder.SetSigningKey(key), "exceeds the firmware")
+
+	base = append(base, bytes.Repeat([]byte{0xFF}, 0x12c000-len(base))...)
+	builder, err = service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	require.NoError(t, builder.SetSigningKey(key))
+	build, err := builder.Build(&service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword"})
+	require.NoError(t, err)
+	firmware := build.Bytes()
+	report := integrity.Verify(firmware, integrity.Options{})
+	require.True(t, report.Valid, report.Errors())
+
+	signatures, err := esp.ParseSignatures(firmware[config.DefaultAppOffset:], 0x10aff0)
+	require.NoError(t, err)
+	require.Len(t, signatures, 1)
+	assert.True(t, signatures[0].Valid())
+	assert.Equal(t, key.KeyDigest(), signatures[0].KeyDigest)
+}
+
+func TestFirmwareBuilderEncryption(t *testing.T) {
+	t.Parallel()
+
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	builder, err := service.NewFirmwareBuilder(base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	key := bytes.Repeat([]byte{0x5a}, flashcrypt.KeySize)
+
+	plain, err := builder.Build(&service.FirmwareRequest{SSID: "mynetwork"})
+	require.NoError(t, err)
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", Encrypt: true})
+	assert.ErrorContains(t, err, "no flash_encryption_key given and none configured")
+	_, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", FlashEncryptionKey: "5a5a"})
+	assert.ErrorContains(t, err, "flash_encryption_key: must be 64 hex digits")
+
+	// a per-device key
+	build, err := builder.Build(&service.FirmwareRequest{SSID: "mynetwork", FlashEncryptionKey: hex.EncodeToString(key)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(base)), build.OverlaySize())
+	decrypted, _, err := flashcrypt.DecryptImage(build.Bytes(), key, flashcrypt.Options{})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(plain.Bytes(), decrypted))
+
+	// the configured key
+	require.NoError(t, builder.SetFlashEncryptionKey(key))
+	build, err = builder.Build(&service.FirmwareRequest{SSID: "mynetwork", Encrypt: true})
+	require.NoError(t, err)
+	decrypted, _, err = flashcrypt.DecryptImage(build.Bytes(), key, flashcrypt.Options{})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(plain.Bytes(), decrypted))
+}
+
+func TestFirmwareBuilderAppOffsets(t *testing.T) {
+	t.Parallel()
+
+	base := baseWithAllSlots(t)
+	app := base[config.DefaultAppOffset:]
+	second := (len(base) + 0xFFFF) &^ 0xFFFF
+	twoApps := append(bytes.Clone(base), bytes.Repeat([]byte{0xFF}, second-len(base))...)
+	twoApps = append(twoApps, app...)
+
+	builder, err := service.NewFirmwareBuilder(twoApps, config.DefaultAppOffset, second)
+	require.NoError(t, err)
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", DirURI: "https://dirigera.local:8443"}
+	build, err := builder.Build(req)
+	require.NoError(t, err)
+	firmware := build.Bytes()
+	assert.True(t, service.VerifyBinaryIntegrity(firmware, config.DefaultAppOffset))
+	assert.True(t, service.VerifyBinaryIntegrity(firmware, second))
+
+	// both apps are patched the same way as a single one
+	expected := copyAndPatch(t, base, req)[config.DefaultAppOffset:]
+	assert.True(t, bytes.Equal(expected, firmware[config.DefaultAppOffset:config.DefaultAppOffset+len(app)]))
+	assert.True(t, bytes.Equal(expected, firmware[second:]))
+
+	_, err = service.NewFirmwareBuilder(twoApps)
+	assert.ErrorContains(t, err, "no application offset")
+	_, err = service.NewFirmwareBuilder(twoApps, second, second)
+	assert.ErrorContains(t, err, "given twice")
+	_, err = service.NewFirmwareBuilder(twoApps, config.DefaultAppOffset, second+0x10)
+	assert.ErrorContains(t, err, fmt.Sprintf("app at 0x%x", second+0x10))
+}
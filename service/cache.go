@@ -0,0 +1,136 @@
+package service
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CacheStats reports the effectiveness of the build cache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// CachedBuild is a firmware built before together with its digests
+type CachedBuild struct {
+	Build  *Build
+	MD5    string
+	SHA256 string
+}
+
+type cacheEntry struct {
+	key   string
+	build *CachedBuild
+}
+
+// BuildCache is a least recently used cache of built firmwares bounded by the
+// total size of their overlays; the base firmware is shared by all builds.
+// Keys are derived with a random per process HMAC key, so request values,
+// including secrets, never appear in them.
+type BuildCache struct {
+	mu       sync.Mutex
+	hmacKey  []byte
+	maxBytes int64
+	entries  map[string]*list.Element
+	lru      *list.List
+	stats    CacheStats
+}
+
+// NewBuildCache creates a cache holding up to maxBytes of firmware
+func NewBuildCache(maxBytes int64) (*BuildCache, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &BuildCache{
+		hmacKey:  key,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		stats:    CacheStats{MaxBytes: maxBytes},
+	}, nil
+}
+
+// Key derives the cache key of building req on the firmware with the SHA-256
+// digest firmwareHash. The profile reference is not part of the key, only
+// the values req got from it.
+func (b *BuildCache) Key(firmwareHash []byte, req *FirmwareRequest) string {
+	fields := *req
+	fields.Profile = ""
+	fields.NoCache = false
+	// the target revision is checked, it does not change the build
+	fields.ChipRevision = ""
+	encoded, _ := json.Marshal(&fields)
+	mac := hmac.New(sha256.New, b.hmacKey)
+	mac.Write(encoded)
+	return hex.EncodeToString(firmwareHash) + "-" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get returns the build cached under key
+func (b *BuildCache) Get(key string) (*CachedBuild, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	element, ok := b.entries[key]
+	if !ok {
+		b.stats.Misses++
+		return nil, false
+	}
+	b.stats.Hits++
+	b.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).build, true
+}
+
+// Put caches build under key and evicts the least recently used builds
+// exceeding the size limit. Builds larger than the limit are not cached.
+func (b *BuildCache) Put(key string, build *CachedBuild) {
+	size := build.Build.OverlaySize()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size > b.maxBytes {
+		return
+	}
+	if element, ok := b.entries[key]; ok {
+		b.remove(element)
+	}
+	b.entries[key] = b.lru.PushFront(&cacheEntry{key: key, build: build})
+	b.stats.Bytes += size
+	for b.stats.Bytes > b.maxBytes {
+		b.remove(b.lru.Back())
+		b.stats.Evictions++
+	}
+}
+
+func (b *BuildCache) remove(element *list.Element) {
+	entry := b.lru.Remove(element).(*cacheEntry)
+	delete(b.entries, entry.key)
+	b.stats.Bytes -= entry.build.Build.OverlaySize()
+}
+
+// Stats returns the current cache statistics
+func (b *BuildCache) Stats() CacheStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Entries = b.lru.Len()
+	return stats
+}
+
+func (s *Dirigera2MQTT) getBuildCacheStats(c *gin.Context) {
+	if s.buildCache == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "stats": s.buildCache.Stats()})
+}
@@ -0,0 +1,66 @@
+package service_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCacheKey(t *testing.T) {
+	t.Parallel()
+
+	cache, err := service.NewBuildCache(1024)
+	require.NoError(t, err)
+	digest := bytes.Repeat([]byte{0xAB}, 32)
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword"}
+
+	key := cache.Key(digest, req)
+	assert.True(t, strings.HasPrefix(key, strings.Repeat("ab", 32)))
+	assert.NotContains(t, key, "mypassword")
+	assert.Equal(t, key, cache.Key(digest, &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", Profile: "site-a", NoCache: true, ChipRevision: "v0.1"}))
+	assert.NotEqual(t, key, cache.Key(digest, &service.FirmwareRequest{SSID: "mynetwork", PWD: "otherpassword"}))
+	assert.NotEqual(t, key, cache.Key(bytes.Repeat([]byte{0xCD}, 32), req))
+
+	other, err := service.NewBuildCache(1024)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other.Key(digest, req))
+}
+
+func TestBuildCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	cache, err := service.NewBuildCache(250)
+	require.NoError(t, err)
+	build := func(size int) *service.CachedBuild {
+		return &service.CachedBuild{Build: service.NewBuild(nil, []service.Overlay{{Data: make([]byte, size)}})}
+	}
+
+	cache.Put("a", build(100))
+	cache.Put("b", build(100))
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	cache.Put("c", build(100))
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok, "least recently used entry is evicted")
+	_, ok = cache.Get("a")
+	assert.True(t, ok)
+	_, ok = cache.Get("c")
+	assert.True(t, ok)
+
+	cache.Put("huge", build(300))
+	_, ok = cache.Get("huge")
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(200), stats.Bytes)
+	assert.Equal(t, int64(250), stats.MaxBytes)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CertificateBundle holds the DER encoded TLS material embedded into the
+// firmware for MQTT over TLS.
+type CertificateBundle struct {
+	CACerts     [][]byte
+	ClientCerts [][]byte
+	ClientKey   []byte
+}
+
+// ValidateCertificates parses the PEM encoded CA certificate(s), client
+// certificate chain and client key of a build request. It checks that every
+// certificate is valid at now, that the client certificate chains up to the
+// given CA and that the client key matches the client certificate.
+// A nil bundle is returned if no TLS material was supplied.
+func ValidateCertificates(caPEM string, certPEM string, keyPEM string, now time.Time) (*CertificateBundle, error) {
+	if caPEM == "" && certPEM == "" && keyPEM == "" {
+		return nil, nil
+	}
+	if caPEM == "" {
+		return nil, errors.New("a CA certificate is required for MQTT over TLS")
+	}
+	if (certPEM == "") != (keyPEM == "") {
+		return nil, errors.New("client certificate and client key must be provided together")
+	}
+
+	caCerts, err := parseCertificates("CA certificate", caPEM, now)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	for _, cert := range caCerts {
+		if !cert.IsCA {
+			return nil, fmt.Errorf("CA certificate %q is not a certificate authority", cert.Subject.CommonName)
+		}
+		roots.AddCert(cert)
+	}
+
+	bundle := &CertificateBundle{}
+	for _, cert := range caCerts {
+		bundle.CACerts = append(bundle.CACerts, cert.Raw)
+	}
+	if certPEM == "" {
+		return bundle, nil
+	}
+
+	clientCerts, err := parseCertificates("client certificate", certPEM, now)
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range clientCerts[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = clientCerts[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("client certificate chain is invalid: %w", err)
+	}
+
+	keyPair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("client key does not match client certificate: %w", err)
+	}
+	bundle.ClientKey, err = x509.MarshalPKCS8PrivateKey(keyPair.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported client key: %w", err)
+	}
+	for _, cert := range clientCerts {
+		bundle.ClientCerts = append(bundle.ClientCerts, cert.Raw)
+	}
+	return bundle, nil
+}
+
+func parseCertificates(kind string, data string, now time.Time) (certs []*x509.Certificate, err error) {
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: unexpected PEM block %q", kind, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("%s %q is not valid at %s (valid from %s to %s)", kind, cert.Subject.CommonName,
+				now.UTC().Format(time.RFC3339), cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("%s: trailing data after PEM blocks", kind)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate found", kind)
+	}
+	return certs, nil
+}
+
+// encodeDERSlot converts DER blobs to the storage form expected by the
+// firmware: each entry is prefixed by its little-endian uint16 length and the
+// list is terminated by a zero length.
+func encodeDERSlot(slot Slot, entries [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		if len(entry) > 0xFFFF {
+			return nil, fmt.Errorf("%s entry of %d bytes cannot be encoded", slot.Name, len(entry))
+		}
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(len(entry)))
+		buf.Write(entry)
+	}
+	buf.Write([]byte{0, 0})
+	if buf.Len() > slot.Size() {
+		return nil, fmt.Errorf("%s needs %d bytes but only %d bytes are reserved in the firmware", slot.Name, buf.Len(), slot.Size())
+	}
+	return buf.Bytes(), nil
+}
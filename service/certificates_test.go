@@ -0,0 +1,130 @@
+package service_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+func createTestCert(t *testing.T, name string, parent *testCert, isCA bool, notAfter time.Time) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestValidateCertificates(t *testing.T) {
+	t.Parallel()
+
+	validUntil := time.Now().Add(24 * time.Hour)
+	ca := createTestCert(t, "broker ca", nil, true, validUntil)
+	client := createTestCert(t, "bridge", ca, false, validUntil)
+	otherCA := createTestCert(t, "other ca", nil, true, validUntil)
+	foreignClient := createTestCert(t, "foreign", otherCA, false, validUntil)
+	expiredClient := createTestCert(t, "expired", ca, false, time.Now().Add(-time.Minute))
+
+	bundle, err := service.ValidateCertificates("", "", "", time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, bundle)
+
+	bundle, err = service.ValidateCertificates(ca.certPEM, "", "", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{ca.cert.Raw}, bundle.CACerts)
+	assert.Empty(t, bundle.ClientCerts)
+
+	bundle, err = service.ValidateCertificates(ca.certPEM, client.certPEM, client.keyPEM, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{client.cert.Raw}, bundle.ClientCerts)
+	assert.NotEmpty(t, bundle.ClientKey)
+
+	_, err = service.ValidateCertificates(client.certPEM, "", "", time.Now())
+	assert.ErrorContains(t, err, "not a certificate authority")
+
+	_, err = service.ValidateCertificates(ca.certPEM, client.certPEM, "", time.Now())
+	assert.ErrorContains(t, err, "must be provided together")
+
+	_, err = service.ValidateCertificates(ca.certPEM, client.certPEM, foreignClient.keyPEM, time.Now())
+	assert.ErrorContains(t, err, "does not match")
+
+	_, err = service.ValidateCertificates(ca.certPEM, foreignClient.certPEM, foreignClient.keyPEM, time.Now())
+	assert.ErrorContains(t, err, "chain is invalid")
+
+	_, err = service.ValidateCertificates(ca.certPEM, expiredClient.certPEM, expiredClient.keyPEM, time.Now())
+	assert.ErrorContains(t, err, "is not valid at")
+
+	_, err = service.ValidateCertificates(ca.certPEM+"garbage", "", "", time.Now())
+	assert.ErrorContains(t, err, "trailing data")
+}
+
+func TestBuildCertificates(t *testing.T) {
+	t.Parallel()
+
+	validUntil := time.Now().Add(24 * time.Hour)
+	ca := createTestCert(t, "broker ca", nil, true, validUntil)
+	client := createTestCert(t, "bridge", ca, false, validUntil)
+
+	base := baseWithAllSlots(t)
+	req := &service.FirmwareRequest{CACert: ca.certPEM, ClientCert: client.certPEM, ClientKey: client.keyPEM}
+	patched, err := service.BuildFirmware(base, req, config.DefaultAppOffset)
+	require.NoError(t, err)
+
+	offset := bytes.Index(base, []byte(service.CACertSlot.Pattern))
+	require.Positive(t, offset)
+	caSlot := patched[offset : offset+service.CACertSlot.Size()]
+	length := binary.LittleEndian.Uint16(caSlot)
+	assert.Equal(t, ca.cert.Raw, caSlot[2:2+length])
+	assert.Equal(t, []byte{0, 0}, caSlot[2+length:4+length])
+	assert.False(t, bytes.Contains(patched, []byte("MQTT CLIENT KEY")))
+
+	large := createTestCert(t, strings.Repeat("x", service.CACertSlot.Size()), nil, true, validUntil)
+	req = &service.FirmwareRequest{CACert: large.certPEM}
+	_, err = service.BuildFirmware(base, req, config.DefaultAppOffset)
+	assert.ErrorContains(t, err, "reserved in the firmware")
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rddl-network/dirigera2mqtt/registry"
+)
+
+// recordDevice registers a firmware built from fw with the SHA-256
+// outputHash in the registry under the identity embedded by req
+func (s *Dirigera2MQTT) recordDevice(fw *mcuFirmware, req *FirmwareRequest, outputHash string) (*registry.Device, error) {
+	now := time.Now().UTC()
+	device := registry.Device{
+		ID:            req.Identity.DeviceID(),
+		MCU:           fw.Name,
+		PublicKey:     hex.EncodeToString(req.Identity.PublicKey()),
+		LiquidAddress: req.LiquidAddress,
+		DirURI:        req.DirURI,
+		OutputHash:    outputHash,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if desc := fw.appDesc(); desc != nil {
+		device.FirmwareVersion = desc.Version
+	}
+	if err := s.registry.Put(device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// listDevices returns the registered devices. The query parameters mcu,
+// version, liquid_address and dir_uri filter on exact values, q searches
+// all fields and include_revoked=true adds revoked devices.
+func (s *Dirigera2MQTT) listDevices(c *gin.Context) {
+	devices, err := s.registry.List(registry.Query{
+		MCU:             c.Query("mcu"),
+		FirmwareVersion: c.Query("version"),
+		LiquidAddress:   c.Query("liquid_address"),
+		DirURI:          c.Query("dir_uri"),
+		Text:            c.Query("q"),
+		IncludeRevoked:  c.Query("include_revoked") == "true",
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+func (s *Dirigera2MQTT) getDevice(c *gin.Context) {
+	device, err := s.registry.Get(c.Param("id"))
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+func (s *Dirigera2MQTT) revokeDevice(c *gin.Context) {
+	device, err := s.registry.Revoke(c.Param("id"), time.Now().UTC())
+	if err != nil {
+		deviceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+func deviceError(c *gin.Context, err error) {
+	if errors.Is(err, registry.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+)
+
+// Regions a differing byte range can be attributed to
+const (
+	RegionHeader        = "header"
+	RegionSegmentHeader = "segment_header"
+	RegionSlot          = "slot"
+	RegionChecksum      = "checksum"
+	RegionSHA256        = "sha256"
+	RegionUnexpected    = "unexpected"
+)
+
+// DiffRange is a range of bytes [Start, End) that differs between the base
+// firmware and an image. Offsets are absolute positions in the files.
+type DiffRange struct {
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Region   string `json:"region"`
+	Slot     string `json:"slot,omitempty"`
+	Segment  int    `json:"segment"`
+	Expected bool   `json:"expected"`
+}
+
+// DiffReport lists all differences of an application image to its base
+type DiffReport struct {
+	Ranges     []DiffRange `json:"ranges"`
+	Unexpected int         `json:"unexpected"`
+}
+
+type diffLayout struct {
+	img   *esp.Image
+	slots []SlotLocation
+}
+
+// region attributes the image relative position i to a region and segment
+func (l *diffLayout) region(i int) (region string, slot string, segment int) {
+	segment = -1
+	for n, seg := range l.img.Segments {
+		if i >= seg.Offset-esp.SegmentHeaderSize && i < seg.Offset+int(seg.DataLen) {
+			segment = n
+			if i < seg.Offset {
+				return RegionSegmentHeader, "", segment
+			}
+		}
+	}
+	switch {
+	case i < esp.ImageHeaderSize:
+		return RegionHeader, "", segment
+	case i == l.img.ChecksumOffset:
+		return RegionChecksum, "", segment
+	case l.img.HashAppended && i >= l.img.Length-esp.HashSize && i < l.img.Length:
+		return RegionSHA256, "", segment
+	}
+	for _, location := range l.slots {
+		if i >= location.Offset && i < location.Offset+location.Slot.Size() {
+			return RegionSlot, location.Slot.Name, segment
+		}
+	}
+	return RegionUnexpected, "", segment
+}
+
+// DiffFirmware compares the application image at offset of image with the
+// one of base. Every differing byte range is attributed to a placeholder
+// slot, the checksum byte or the SHA-256 trailer; anything else, including
+// header changes, is flagged as unexpected.
+func DiffFirmware(base []byte, image []byte, offset int) (*DiffReport, error) {
+	if offset < 0 || offset >= len(base) || offset >= len(image) {
+		return nil, fmt.Errorf("application offset 0x%x is outside of the image", offset)
+	}
+	baseImg, err := esp.ParseImage(base[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("base firmware: %w", err)
+	}
+	img, err := esp.ParseImage(image[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("image: %w", err)
+	}
+
+	baseApp := base[offset : offset+baseImg.Length]
+	app := image[offset : offset+img.Length]
+	layout := &diffLayout{img: baseImg, slots: FindSlots(baseApp)}
+
+	report := &DiffReport{Ranges: []DiffRange{}}
+	var current *DiffRange
+	for i := 0; i < max(len(baseApp), len(app)); i++ {
+		if i < len(baseApp) && i < len(app) && baseApp[i] == app[i] {
+			current = nil
+			continue
+		}
+		region, slot, segment := RegionUnexpected, "", -1
+		if i < len(baseApp) {
+			region, slot, segment = layout.region(i)
+		}
+		if current != nil && current.Region == region && current.Slot == slot && current.Segment == segment && current.End == offset+i {
+			current.End++
+			continue
+		}
+		report.Ranges = append(report.Ranges, DiffRange{
+			Start:    offset + i,
+			End:      offset + i + 1,
+			Region:   region,
+			Slot:     slot,
+			Segment:  segment,
+			Expected: region == RegionSlot || region == RegionChecksum || region == RegionSHA256,
+		})
+		current = &report.Ranges[len(report.Ranges)-1]
+	}
+	for _, r := range report.Ranges {
+		if !r.Expected {
+			report.Unexpected++
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,54 @@
+package service_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffFirmware(t *testing.T) {
+	t.Parallel()
+
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+
+	report, err := service.DiffFirmware(base, base, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.Empty(t, report.Ranges)
+
+	patched, err := service.BuildFirmware(base, &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword"}, config.DefaultAppOffset)
+	require.NoError(t, err)
+	report, err = service.DiffFirmware(base, patched, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Unexpected)
+
+	regions := map[string]bool{}
+	for _, r := range report.Ranges {
+		regions[r.Region+":"+r.Slot] = true
+		assert.True(t, r.Expected)
+	}
+	assert.True(t, regions["slot:ssid"])
+	assert.True(t, regions["slot:pwd"])
+	assert.True(t, regions["checksum:"])
+	assert.True(t, regions["sha256:"])
+	assert.False(t, regions["slot:dir_uri"])
+
+	patched[config.DefaultAppOffset+0x40000] ^= 0x01
+	patched[config.DefaultAppOffset+0x3] = 0x20
+	report, err = service.DiffFirmware(base, patched, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Unexpected)
+	var unexpected []service.DiffRange
+	for _, r := range report.Ranges {
+		if !r.Expected {
+			unexpected = append(unexpected, r)
+		}
+	}
+	assert.Equal(t, service.DiffRange{Start: config.DefaultAppOffset + 3, End: config.DefaultAppOffset + 4, Region: service.RegionHeader, Segment: -1}, unexpected[0])
+	assert.Equal(t, service.RegionUnexpected, unexpected[1].Region)
+	assert.Equal(t, 2, unexpected[1].Segment)
+}
@@ -0,0 +1,4 @@
+package service
+
+// EncodeDERSlot exposes encodeDERSlot to the tests of package service_test
+var EncodeDERSlot = encodeDERSlot
@@ -5,6 +5,10 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/integrity"
+	"github.com/rddl-network/dirigera2mqtt/partition"
 )
 
 func ComputeAndSetFirmwareChecksum(patchedBinary []byte, offset int) (correctedBinaryPatch []byte) {
@@ -58,13 +62,7 @@ func VerifyBinaryIntegrity(binary []byte, offset int) bool {
 	if isHashAppended {
 		isHashValid = ValidateHash(binary, chkOffset)
 	}
-	if binary[chkOffset] == binaryChecksum && isHashValid {
-		fmt.Printf("The integrity of the file got verified. The checksum is: %x\n", binaryChecksum)
-		return true
-	}
-
-	fmt.Printf("Attention: File integrity check FAILED. The files checksum is: %x, the computed checksum is: %x\n", binary[chkOffset], binaryChecksum)
-	return false
+	return binary[chkOffset] == binaryChecksum && isHashValid
 }
 
 func patchValue(pattern string, value string, firmware []byte) (patchedFirmware []byte) {
@@ -83,24 +81,19 @@ func PatchFirmware(firmware []byte, ssid string, pwd string, LiquidAddress strin
 
 	patchedFirmware := firmware[offset:]
 	if ssid != "" {
-		ssidPattern := "WIFI SSID                                                       "
-		patchedFirmware = patchValue(ssidPattern, ssid, patchedFirmware)
+		patchedFirmware = patchValue(SSIDSlot.Pattern, ssid, patchedFirmware)
 	}
 	if pwd != "" {
-		pwdPattern := "WIFI PASSWORD                                                   "
-		patchedFirmware = patchValue(pwdPattern, pwd, patchedFirmware)
+		patchedFirmware = patchValue(PasswordSlot.Pattern, pwd, patchedFirmware)
 	}
 	if LiquidAddress != "" {
-		liquidAddrPattern := "LIQUID ADDRESS                                                  "
-		patchedFirmware = patchValue(liquidAddrPattern, LiquidAddress, patchedFirmware)
+		patchedFirmware = patchValue(LiquidAddressSlot.Pattern, LiquidAddress, patchedFirmware)
 	}
 	if DirAuthToken != "" {
-		dirAuthPattern := "DIRIGERA TOKEN                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                  "
-		patchedFirmware = patchValue(dirAuthPattern, DirAuthToken, patchedFirmware)
+		patchedFirmware = patchValue(DirAuthTokenSlot.Pattern, DirAuthToken, patchedFirmware)
 	}
 	if DirURI != "" {
-		dirURIPattern := "DIRIGERA URI                                                    "
-		patchedFirmware = patchValue(dirURIPattern, DirURI, patchedFirmware)
+		patchedFirmware = patchValue(DirURISlot.Pattern, DirURI, patchedFirmware)
 	}
 
 	copy(firmware[offset:], patchedFirmware[:])
@@ -108,20 +101,147 @@ func PatchFirmware(firmware []byte, ssid string, pwd string, LiquidAddress strin
 	return firmware[:]
 }
 
-func loadFirmware(filename string) []byte {
+// BuildFirmware patches a copy of the base firmware with the values of req
+// and fixes the checksum and appended hash of the application image at offset.
+func BuildFirmware(base []byte, req *FirmwareRequest, offset int) ([]byte, error) {
+	builder, err := NewFirmwareBuilder(base, offset)
+	if err != nil {
+		return nil, err
+	}
+	build, err := builder.Build(req)
+	if err != nil {
+		return nil, err
+	}
+	return build.Bytes(), nil
+}
+
+// replaceApp returns a copy of firmware with the app partition at offset
+// holding the image converted from elfData. Flash parameters and chip
+// revisions are taken over from the replaced app image.
+func replaceApp(firmware []byte, offset int, elfData []byte) ([]byte, error) {
+	table, err := partition.ParseBinary(firmware[partition.DefaultOffset:])
+	if err != nil {
+		return nil, fmt.Errorf("partition table: %w", err)
+	}
+	entry, ok := table.Find(uint32(offset))
+	if !ok || entry.Type != partition.TypeApp {
+		return nil, fmt.Errorf("no app partition at 0x%x", offset)
+	}
+	old, err := esp.ParseImage(firmware[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("app at 0x%x: %w", offset, err)
+	}
+	image, err := esp.ELFToImage(elfData, esp.ELFOptions{
+		SpiMode:         old.Header.SpiMode,
+		SpiSpeedSize:    old.Header.SpiSpeedSize,
+		MinChipRev:      old.Header.MinChipRev,
+		MinChipRevFull:  old.Header.MinChipRevFull,
+		MaxChipRevFull:  old.Header.MaxChipRevFull,
+		ELFSHA256Offset: esp.AppELFSHA256Offset,
+		OmitHash:        !old.HashAppended,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > int(entry.Size) {
+		return nil, fmt.Errorf("app image of %d bytes exceeds partition %s of %d bytes", len(image), entry.Label, entry.Size)
+	}
+
+	result := make([]byte, max(len(firmware), offset+len(image)))
+	copy(result, firmware)
+	end := min(len(result), int(entry.End()))
+	copy(result[offset:end], bytes.Repeat([]byte{0xFF}, end-offset))
+	copy(result[offset:], image)
+	return result, nil
+}
+
+// loadSigningKey reads a Secure Boot V2 signing key in PEM format
+func loadSigningKey(filename string) (*esp.SigningKey, error) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
-		panic("could not read firmware " + filename)
+		return nil, fmt.Errorf("could not read signing key: %w", err)
 	}
+	return esp.ParseSigningKey(content)
+}
 
-	if !VerifyBinaryIntegrity(content, 0x0) {
-		panic("given firmware integrity check 1 failed: " + filename)
+// reserveSignatureSector extends firmware with erased flash up to the end of
+// the signature sector of the app image at offset
+func reserveSignatureSector(firmware []byte, offset int) ([]byte, error) {
+	img, err := esp.ParseImage(firmware[offset:])
+	if err != nil {
+		return nil, err
 	}
-	if !VerifyBinaryIntegrity(content, 0x20000) {
-		panic("given firmware integrity check 2 failed: " + filename)
+	end := offset + esp.SignatureOffset(img.Length) + esp.SignatureSectorSize
+	if end <= len(firmware) {
+		return firmware, nil
 	}
+	return append(firmware, bytes.Repeat([]byte{0xFF}, end-len(firmware))...), nil
+}
 
-	return content
+// loadFirmware reads a merged firmware image and verifies all of its parts,
+// including the secure_version of its apps against minSecureVersion.
+// A non-empty appELF replaces the app image at appOffset.
+func loadFirmware(filename string, appELF string, appOffset int, minSecureVersion uint32) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read firmware: %w", err)
+	}
+	if appELF != "" {
+		elfData, err := os.ReadFile(appELF)
+		if err != nil {
+			return nil, fmt.Errorf("could not read app ELF: %w", err)
+		}
+		if content, err = replaceApp(content, appOffset, elfData); err != nil {
+			return nil, fmt.Errorf("%s: %w", appELF, err)
+		}
+	}
+	report := integrity.Verify(content, integrity.Options{
+		BootloaderOffset: bootloaderOffset(content, appOffset),
+		MinSecureVersion: minSecureVersion,
+	})
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// bootloaderOffset returns the flash offset of the bootloader of the chip
+// family the app at appOffset is built for, 0 for unknown chips
+func bootloaderOffset(firmware []byte, appOffset int) int {
+	if appOffset < 0 || appOffset >= len(firmware) {
+		return 0
+	}
+	app, err := esp.ParseImage(firmware[appOffset:])
+	if err != nil || app.Chip == nil {
+		return 0
+	}
+	return app.Chip.BootloaderOffset
+}
+
+// ChipRevisions returns the chip revisions the bootloader and the apps at
+// appOffsets of a merged firmware run on. The bootloader is expected at the
+// offset of the chip family of the first app.
+func ChipRevisions(firmware []byte, appOffsets ...int) (esp.ChipRevisionRange, error) {
+	revisions := esp.ChipRevisionRange{Max: esp.NoMaxChipRevision}
+	for _, offset := range appOffsets {
+		if offset < 0 || offset >= len(firmware) {
+			return revisions, fmt.Errorf("app offset 0x%x is outside of the firmware", offset)
+		}
+		app, err := esp.ParseImage(firmware[offset:])
+		if err != nil {
+			return revisions, fmt.Errorf("app at 0x%x: %w", offset, err)
+		}
+		revisions = revisions.Intersect(app.Header.ChipRevisions())
+	}
+	offset := 0
+	if len(appOffsets) > 0 {
+		offset = bootloaderOffset(firmware, appOffsets[0])
+	}
+	bootloader, err := esp.ParseImage(firmware[offset:])
+	if err != nil {
+		return revisions, fmt.Errorf("bootloader at 0x%x: %w", offset, err)
+	}
+	return revisions.Intersect(bootloader.Header.ChipRevisions()), nil
 }
 
 func toInt(bytes []byte, offset int) int {
@@ -1,11 +1,18 @@
 package service_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
 	"testing"
 
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/integrity"
 	"github.com/rddl-network/dirigera2mqtt/service"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFirmwareIntegrityVerification(t *testing.T) {
@@ -42,3 +49,50 @@ func TestFirmwareHandling(t *testing.T) {
 	valid = service.VerifyBinaryIntegrity(correctedFirmware, offset)
 	assert.True(t, valid)
 }
+
+func TestChipRevisions(t *testing.T) {
+	t.Parallel()
+
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	revisions, err := service.ChipRevisions(firmware, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.Equal(t, esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)}, revisions)
+	_, err = service.ChipRevisions(firmware, len(firmware))
+	assert.ErrorContains(t, err, "outside of the firmware")
+
+	req := &service.FirmwareRequest{}
+	assert.NoError(t, req.CheckChipRevision(revisions))
+	req.ChipRevision = "v0.1"
+	assert.NoError(t, req.CheckChipRevision(revisions))
+	req.ChipRevision = "v1.0"
+	err = req.CheckChipRevision(revisions)
+	assert.EqualError(t, err, "chip revision v1.0 is not supported, the firmware runs on v0.0 - v0.99")
+	var unsupported *esp.UnsupportedChipRevisionError
+	assert.ErrorAs(t, err, &unsupported)
+	req.ChipRevision = "rev1"
+	err = req.CheckChipRevision(revisions)
+	assert.ErrorContains(t, err, "chip_revision: invalid chip revision")
+	assert.False(t, errors.As(err, &unsupported))
+	assert.ErrorContains(t, req.Validate(), "chip_revision")
+}
+
+func TestChipRevisionsBootloaderOffset(t *testing.T) {
+	t.Parallel()
+
+	// an ESP32 firmware keeps its bootloader at 0x1000
+	firmware, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	esp32 := bytes.Clone(firmware)
+	copy(esp32[:0x1000], bytes.Repeat([]byte{0xFF}, 0x1000))
+	copy(esp32[0x1000:0x8000], firmware[:0x7000])
+	for _, offset := range []int{0x1000, config.DefaultAppOffset} {
+		binary.LittleEndian.PutUint16(esp32[offset+12:], esp.ESP32.ID)
+		esp32 = service.ComputeAndSetFirmwareChecksum(esp32, offset)
+	}
+
+	revisions, err := service.ChipRevisions(esp32, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.Equal(t, esp.NewChipRevision(0, 99), revisions.Max)
+	assert.NoError(t, integrity.Verify(esp32, integrity.Options{BootloaderOffset: esp.ESP32.BootloaderOffset}).Err())
+}
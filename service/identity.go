@@ -0,0 +1,66 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// DeviceIDSize is the number of random bytes of a device ID
+const DeviceIDSize = 16
+
+// DeviceIdentity is the unique identity generated for every built firmware.
+// It is stored in DeviceIdentitySlot as the raw device ID followed by the
+// Ed25519 seed (RFC 8032 private key) and the public key.
+type DeviceIdentity struct {
+	ID         []byte
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewDeviceIdentity generates a random device ID and Ed25519 keypair
+func NewDeviceIdentity() (*DeviceIdentity, error) {
+	id := make([]byte, DeviceIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceIdentity{ID: id, PrivateKey: key}, nil
+}
+
+// DeviceID returns the device ID in hex
+func (d *DeviceIdentity) DeviceID() string {
+	return hex.EncodeToString(d.ID)
+}
+
+// PublicKey returns the public key of the device
+func (d *DeviceIdentity) PublicKey() ed25519.PublicKey {
+	return d.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+func (d *DeviceIdentity) encode() []byte {
+	encoded := make([]byte, 0, DeviceIDSize+ed25519.SeedSize+ed25519.PublicKeySize)
+	encoded = append(encoded, d.ID...)
+	encoded = append(encoded, d.PrivateKey.Seed()...)
+	return append(encoded, d.PublicKey()...)
+}
+
+// decodeDeviceIdentity reverses DeviceIdentity.encode
+func decodeDeviceIdentity(raw []byte) (*DeviceIdentity, error) {
+	size := DeviceIDSize + ed25519.SeedSize + ed25519.PublicKeySize
+	if len(raw) < size {
+		return nil, errors.New("device identity is truncated")
+	}
+	identity := &DeviceIdentity{
+		ID:         bytes.Clone(raw[:DeviceIDSize]),
+		PrivateKey: ed25519.NewKeyFromSeed(raw[DeviceIDSize : DeviceIDSize+ed25519.SeedSize]),
+	}
+	if !bytes.Equal(identity.PublicKey(), raw[DeviceIDSize+ed25519.SeedSize:size]) {
+		return nil, errors.New("device identity public key does not match its private key")
+	}
+	return identity, nil
+}
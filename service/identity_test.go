@@ -0,0 +1,66 @@
+package service_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// baseWithAllSlots reserves the device identity and certificate slots the
+// test firmware lacks, overwriting data of its first segment
+func baseWithAllSlots(t *testing.T) []byte {
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	slots := service.DeviceIdentitySlot.Pattern + service.CACertSlot.Pattern + service.ClientCertSlot.Pattern + service.ClientKeySlot.Pattern
+	copy(base[config.DefaultAppOffset+0x10000:], slots)
+	return service.ComputeAndSetFirmwareChecksum(base, config.DefaultAppOffset)
+}
+
+func TestDeviceIdentity(t *testing.T) {
+	t.Parallel()
+
+	base := baseWithAllSlots(t)
+	require.True(t, bytes.Contains(base, []byte(service.DeviceIdentitySlot.Pattern)))
+
+	identity, err := service.NewDeviceIdentity()
+	require.NoError(t, err)
+	other, err := service.NewDeviceIdentity()
+	require.NoError(t, err)
+	assert.NotEqual(t, identity.DeviceID(), other.DeviceID())
+	assert.Equal(t, service.DeviceIDSize*2, len(identity.DeviceID()))
+
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", Identity: identity}
+	patched, err := service.BuildFirmware(base, req, config.DefaultAppOffset)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(patched, []byte(service.DeviceIdentitySlot.Pattern)))
+	assert.True(t, bytes.Contains(patched, append(bytes.Clone(identity.ID), identity.PrivateKey.Seed()...)))
+
+	report, err := service.InspectFirmware(base, patched, config.DefaultAppOffset, false)
+	require.NoError(t, err)
+	assert.True(t, report.Consistent)
+	for _, slot := range report.Slots {
+		if slot.Name == service.DeviceIdentitySlot.Name {
+			assert.True(t, slot.Provisioned)
+			assert.Contains(t, slot.Value, identity.DeviceID())
+			assert.Contains(t, slot.Value, hex.EncodeToString(identity.PublicKey()))
+			assert.False(t, strings.Contains(slot.Value, hex.EncodeToString(identity.PrivateKey.Seed())))
+		}
+	}
+
+	message := []byte("telemetry")
+	assert.True(t, ed25519.Verify(identity.PublicKey(), message, ed25519.Sign(identity.PrivateKey, message)))
+
+	original, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(original, []byte(service.DeviceIdentitySlot.Pattern)))
+	_, err = service.BuildFirmware(original, req, config.DefaultAppOffset)
+	assert.ErrorContains(t, err, "device_identity")
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+const maskedValue = "********"
+
+// SlotValue is the provisioned value of a placeholder slot
+type SlotValue struct {
+	Name        string `json:"name"`
+	Offset      int    `json:"offset"`
+	Size        int    `json:"size"`
+	Provisioned bool   `json:"provisioned"`
+	Value       string `json:"value,omitempty"`
+	Masked      bool   `json:"masked,omitempty"`
+}
+
+// InspectReport describes how an image was provisioned
+type InspectReport struct {
+	AppDesc       *esp.AppDesc `json:"app_desc,omitempty"`
+	BootSlot      string       `json:"boot_slot,omitempty"`
+	Slots         []SlotValue  `json:"slots"`
+	ChecksumValid bool         `json:"checksum_valid"`
+	HashAppended  bool         `json:"hash_appended"`
+	HashValid     bool         `json:"hash_valid"`
+	Consistent    bool         `json:"consistent"`
+}
+
+// InspectFirmware extracts the provisioned settings of image by reading the
+// placeholder slots found in the matching base firmware. Both images carry
+// the application image at offset. Secret values are masked unless reveal is
+// set.
+func InspectFirmware(base []byte, image []byte, offset int, reveal bool) (*InspectReport, error) {
+	if offset < 0 || offset >= len(base) || offset >= len(image) {
+		return nil, errors.New("application offset is outside of the image")
+	}
+	baseImg, err := esp.ParseImage(base[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("base firmware: %w", err)
+	}
+	img, err := esp.ParseImage(image[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("image: %w", err)
+	}
+	if img.Length != baseImg.Length {
+		return nil, fmt.Errorf("image does not match the base firmware: size %d, expected %d", img.Length, baseImg.Length)
+	}
+
+	report := &InspectReport{
+		AppDesc:       img.AppDesc,
+		Slots:         []SlotValue{},
+		ChecksumValid: img.ChecksumValid(),
+		HashAppended:  img.HashAppended,
+		HashValid:     img.HashValid(),
+		Consistent:    img.Valid(),
+	}
+	// only merged images and full flash dumps carry the otadata
+	if boot, err := otadata.BootPartitionOf(image, partition.DefaultOffset); err == nil {
+		report.BootSlot = otadata.SlotName(boot)
+	}
+	for _, location := range FindSlots(base[offset : offset+baseImg.Length]) {
+		slot := location.Slot
+		start := offset + location.Offset
+		raw := image[start : start+slot.Size()]
+		value := SlotValue{Name: slot.Name, Offset: start, Size: slot.Size()}
+		if !bytes.Equal(raw, []byte(slot.Pattern)) {
+			value.Provisioned = true
+			value.Value, err = decodeSlotValue(slot, raw, reveal)
+			if err != nil {
+				return nil, fmt.Errorf("slot %s: %w", slot.Name, err)
+			}
+			value.Masked = slot.Secret && !reveal
+		}
+		report.Slots = append(report.Slots, value)
+	}
+	return report, nil
+}
+
+func decodeSlotValue(slot Slot, raw []byte, reveal bool) (string, error) {
+	if slot == DeviceIdentitySlot {
+		// the device ID and public key are not secret, only the seed is
+		identity, err := decodeDeviceIdentity(raw)
+		if err != nil {
+			return "", err
+		}
+		value := fmt.Sprintf("id %s, public key %s", identity.DeviceID(), hex.EncodeToString(identity.PublicKey()))
+		if reveal {
+			value += ", seed " + hex.EncodeToString(identity.PrivateKey.Seed())
+		}
+		return value, nil
+	}
+	if slot.Secret && !reveal {
+		return maskedValue, nil
+	}
+	switch slot {
+	case CACertSlot, ClientCertSlot:
+		entries, err := decodeDERSlot(raw)
+		if err != nil {
+			return "", err
+		}
+		var names []string
+		for _, entry := range entries {
+			cert, err := x509.ParseCertificate(entry)
+			if err != nil {
+				return "", err
+			}
+			names = append(names, cert.Subject.String())
+		}
+		return strings.Join(names, "; "), nil
+	case ClientKeySlot:
+		entries, err := decodeDERSlot(raw)
+		if err != nil || len(entries) == 0 {
+			return "", errors.New("no key stored")
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: entries[0]})), nil
+	}
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+	return string(raw), nil
+}
+
+// decodeDERSlot reverses encodeDERSlot
+func decodeDERSlot(raw []byte) (entries [][]byte, err error) {
+	for len(raw) >= 2 {
+		length := int(binary.LittleEndian.Uint16(raw))
+		if length == 0 {
+			return entries, nil
+		}
+		if 2+length > len(raw) {
+			return nil, errors.New("corrupt DER entry length")
+		}
+		entries = append(entries, raw[2:2+length])
+		raw = raw[2+length:]
+	}
+	return nil, errors.New("DER list is not terminated")
+}
@@ -0,0 +1,56 @@
+package service_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectFirmware(t *testing.T) {
+	t.Parallel()
+
+	base, err := os.ReadFile("../test/energy-intelligence-bridge.bin")
+	require.NoError(t, err)
+	req := &service.FirmwareRequest{SSID: "mynetwork", PWD: "mypassword", DirURI: "https://dirigera.local:8443"}
+	patched, err := service.BuildFirmware(base, req, config.DefaultAppOffset)
+	require.NoError(t, err)
+
+	report, err := service.InspectFirmware(base, patched, config.DefaultAppOffset, false)
+	require.NoError(t, err)
+	assert.True(t, report.Consistent)
+	assert.Equal(t, "v0.1.3-2-g2470f4a-dirty", report.AppDesc.Version)
+
+	values := map[string]service.SlotValue{}
+	for _, slot := range report.Slots {
+		values[slot.Name] = slot
+	}
+	assert.Equal(t, "mynetwork", values["ssid"].Value)
+	assert.Equal(t, "https://dirigera.local:8443", values["dir_uri"].Value)
+	assert.True(t, values["pwd"].Masked)
+	assert.NotContains(t, values["pwd"].Value, "mypassword")
+	assert.False(t, values["liquid_address"].Provisioned)
+	assert.Empty(t, values["liquid_address"].Value)
+
+	report, err = service.InspectFirmware(base, patched, config.DefaultAppOffset, true)
+	require.NoError(t, err)
+	for _, slot := range report.Slots {
+		if slot.Name == "pwd" {
+			assert.Equal(t, "mypassword", slot.Value)
+			assert.False(t, slot.Masked)
+		}
+	}
+
+	patched[config.DefaultAppOffset+0x40000] ^= 0x01
+	report, err = service.InspectFirmware(base, patched, config.DefaultAppOffset, false)
+	require.NoError(t, err)
+	assert.False(t, report.ChecksumValid)
+	assert.False(t, report.HashValid)
+	assert.False(t, report.Consistent)
+
+	_, err = service.InspectFirmware(base, patched[:config.DefaultAppOffset+0x1000], config.DefaultAppOffset, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+)
+
+// mcuFirmware is an enabled MCU of the registry. The other fields are set
+// once its firmware is loaded.
+type mcuFirmware struct {
+	config.MCU
+	base []byte
+	// app is the primary app image of base
+	app *esp.Image
+	// revisions are the chip revisions the bootloader and all apps run on
+	revisions esp.ChipRevisionRange
+	builder   *FirmwareBuilder
+}
+
+// appDesc returns the application descriptor of the primary app, nil if the
+// firmware is not loaded or the app carries none
+func (fw *mcuFirmware) appDesc() *esp.AppDesc {
+	if fw.app == nil {
+		return nil
+	}
+	return fw.app.AppDesc
+}
+
+// enabledMCUs returns the enabled MCUs of the registry in configuration order
+func enabledMCUs(cfg *config.Config) ([]*mcuFirmware, error) {
+	mcus, err := cfg.MCUs()
+	if err != nil {
+		return nil, err
+	}
+	var enabled []*mcuFirmware
+	for _, mcu := range mcus {
+		if mcu.IsEnabled() {
+			enabled = append(enabled, &mcuFirmware{MCU: mcu})
+		}
+	}
+	if len(enabled) == 0 {
+		return nil, errors.New("the MCU registry enables no MCU")
+	}
+	return enabled, nil
+}
+
+// firmwareFor returns the enabled MCU called name
+func (s *Dirigera2MQTT) firmwareFor(name string) (*mcuFirmware, bool) {
+	for _, fw := range s.mcus {
+		if fw.Name == name {
+			return fw, true
+		}
+	}
+	return nil, false
+}
+
+// LoadFirmwares loads and verifies the base firmware of every enabled MCU
+// and prepares its builds. Run loads them before serving.
+func (s *Dirigera2MQTT) LoadFirmwares() error {
+	for _, fw := range s.mcus {
+		if err := s.loadMCU(fw); err != nil {
+			return fmt.Errorf("%s: %w", fw.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Dirigera2MQTT) loadMCU(fw *mcuFirmware) error {
+	if err := validateSchema(fw.Schema); err != nil {
+		return err
+	}
+	firmware, err := loadFirmware(fw.Firmware, fw.AppELF, fw.AppOffset(), uint32(fw.MinSecureVersion))
+	if err != nil {
+		return fmt.Errorf("%s: %w", fw.Firmware, err)
+	}
+	var key *esp.SigningKey
+	if fw.SigningKey != "" {
+		if key, err = loadSigningKey(fw.SigningKey); err != nil {
+			return fmt.Errorf("%s: %w", fw.SigningKey, err)
+		}
+		for _, offset := range fw.AppOffsets {
+			if firmware, err = reserveSignatureSector(firmware, offset); err != nil {
+				return fmt.Errorf("%s: %w", fw.Firmware, err)
+			}
+		}
+	}
+	builder, err := NewFirmwareBuilder(firmware, fw.AppOffsets...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fw.Firmware, err)
+	}
+	revisions, err := ChipRevisions(firmware, fw.AppOffsets...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fw.Firmware, err)
+	}
+	if key != nil {
+		if err = builder.SetSigningKey(key); err != nil {
+			return fmt.Errorf("%s: %w", fw.Firmware, err)
+		}
+		s.logger.Info("msg", "signing builds", "mcu", fw.Name, "scheme", key.Scheme(), "key_digest", key.KeyDigest())
+	}
+	if fw.FlashEncryptionKey != "" {
+		key, err := os.ReadFile(fw.FlashEncryptionKey)
+		if err == nil {
+			err = builder.SetFlashEncryptionKey(key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", fw.FlashEncryptionKey, err)
+		}
+	}
+	fw.base, fw.builder, fw.revisions = firmware, builder, revisions
+	// the builder parsed the primary app already
+	fw.app = builder.apps[0].img
+	chip := "unknown chip"
+	if fw.app.Chip != nil {
+		chip = fw.app.Chip.Name
+	}
+	s.logger.Info("msg", "loaded firmware", "mcu", fw.Name, "chip", chip, "revisions", revisions.String(), "file", fw.Firmware)
+	return nil
+}
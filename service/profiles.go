@@ -0,0 +1,277 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrProfileNotFound is returned for requests to unknown profiles
+	ErrProfileNotFound = errors.New("profile not found")
+	// ErrInvalidProfileName is returned for names that cannot be stored
+	ErrInvalidProfileName = errors.New("invalid profile name")
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Profile holds default request values shared by the devices of a customer
+// or site
+type Profile struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Defaults    FirmwareRequest `json:"defaults"`
+}
+
+// ProfileStore keeps profiles as JSON files in a directory
+type ProfileStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewProfileStore creates the profile directory if needed
+func NewProfileStore(dir string) (*ProfileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &ProfileStore{dir: dir}, nil
+}
+
+func (p *ProfileStore) path(name string) (string, error) {
+	if !profileNamePattern.MatchString(name) {
+		return "", fmt.Errorf("%w %q, use up to 64 letters, digits, '-' or '_'", ErrInvalidProfileName, name)
+	}
+	return filepath.Join(p.dir, name+".json"), nil
+}
+
+// Get returns the profile name or ErrProfileNotFound
+func (p *ProfileStore) Get(name string) (*Profile, error) {
+	path, err := p.path(name)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return readProfile(path)
+}
+
+func readProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", filepath.Base(path), err)
+	}
+	return &profile, nil
+}
+
+// List returns all profiles ordered by name
+func (p *ProfileStore) List() ([]Profile, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	paths, err := filepath.Glob(filepath.Join(p.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	profiles := []Profile{}
+	for _, path := range paths {
+		profile, err := readProfile(path)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, *profile)
+	}
+	return profiles, nil
+}
+
+// Put validates and stores profile, replacing a profile of the same name
+func (p *ProfileStore) Put(profile *Profile) error {
+	path, err := p.path(profile.Name)
+	if err != nil {
+		return err
+	}
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// write to a temporary file first so readers never see a partial profile
+	tmp, err := os.CreateTemp(p.dir, ".profile-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete removes the profile name
+func (p *ProfileStore) Delete(name string) error {
+	path, err := p.path(name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrProfileNotFound
+	}
+	return err
+}
+
+func (p *Profile) validate() error {
+	if p.Defaults.Profile != "" {
+		return errors.New("profile defaults cannot reference a profile")
+	}
+	return p.Defaults.Validate()
+}
+
+// ApplyProfile fills every empty field of req with the value of profile
+func (req *FirmwareRequest) ApplyProfile(profile *Profile) {
+	for _, field := range req.fields() {
+		if *field.value == "" {
+			*field.value = *profile.Defaults.field(field.name)
+		}
+	}
+	req.Encrypt = req.Encrypt || profile.Defaults.Encrypt
+	if req.ChipRevision == "" {
+		req.ChipRevision = profile.Defaults.ChipRevision
+	}
+}
+
+// masked returns a copy of the profile with all secret values masked
+func (p Profile) masked() Profile {
+	for _, field := range p.Defaults.fields() {
+		if field.secret && *field.value != "" {
+			*field.value = maskedValue
+		}
+	}
+	return p
+}
+
+// keepSecrets replaces masked secrets of profile with the stored values, so
+// a profile read from the API can be sent back unchanged
+func (p *Profile) keepSecrets(stored *Profile) {
+	for _, field := range p.Defaults.fields() {
+		if field.secret && *field.value == maskedValue {
+			*field.value = *stored.Defaults.field(field.name)
+		}
+	}
+}
+
+// profileStore returns the profile store or answers that profiles are disabled
+func (s *Dirigera2MQTT) profileStore(c *gin.Context) (*ProfileStore, bool) {
+	if s.profiles == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "profiles are not configured"})
+		return nil, false
+	}
+	return s.profiles, true
+}
+
+func (s *Dirigera2MQTT) listProfiles(c *gin.Context) {
+	store, ok := s.profileStore(c)
+	if !ok {
+		return
+	}
+	profiles, err := store.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range profiles {
+		profiles[i] = profiles[i].masked()
+	}
+	c.JSON(http.StatusOK, profiles)
+}
+
+func (s *Dirigera2MQTT) getProfile(c *gin.Context) {
+	store, ok := s.profileStore(c)
+	if !ok {
+		return
+	}
+	profile, err := store.Get(c.Param("name"))
+	if err != nil {
+		profileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, profile.masked())
+}
+
+func (s *Dirigera2MQTT) putProfile(c *gin.Context) {
+	store, ok := s.profileStore(c)
+	if !ok {
+		return
+	}
+	var profile Profile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	profile.Name = c.Param("name")
+	stored, err := store.Get(profile.Name)
+	switch {
+	case err == nil:
+		profile.keepSecrets(stored)
+	case !errors.Is(err, ErrProfileNotFound):
+		profileError(c, err)
+		return
+	}
+	if err := profile.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := store.Put(&profile); err != nil {
+		profileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, profile.masked())
+}
+
+func (s *Dirigera2MQTT) deleteProfile(c *gin.Context) {
+	store, ok := s.profileStore(c)
+	if !ok {
+		return
+	}
+	if err := store.Delete(c.Param("name")); err != nil {
+		profileError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func profileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrProfileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidProfileName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,80 @@
+package service_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileEndpoints(t *testing.T) {
+	t.Parallel()
+
+	s, err := service.NewTrustAnchorAttestationService(config.DefaultConfig())
+	require.NoError(t, err)
+	store, err := service.NewProfileStore(t.TempDir())
+	require.NoError(t, err)
+	s.SetProfiles(store)
+
+	serve := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.GetRouter().ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := serve(http.MethodPut, "/profiles/site-a", `{"description":"Site A","defaults":{"dir_uri":"https://hub.site-a:8443","dir_auth_token":"secret-token"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var profile service.Profile
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &profile))
+	assert.Equal(t, "site-a", profile.Name)
+	assert.Equal(t, "********", profile.Defaults.DirAuthToken)
+
+	// sending the masked profile back keeps the stored secret
+	profile.Defaults.LiquidAddress = "tlq1qq"
+	body, err := json.Marshal(profile)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/profiles/site-a", string(body)).Code)
+	stored, err := store.Get("site-a")
+	require.NoError(t, err)
+	assert.Equal(t, "secret-token", stored.Defaults.DirAuthToken)
+	assert.Equal(t, "tlq1qq", stored.Defaults.LiquidAddress)
+
+	var profiles []service.Profile
+	w = serve(http.MethodGet, "/profiles", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &profiles))
+	assert.Equal(t, 1, len(profiles))
+	assert.Equal(t, "https://hub.site-a:8443", profiles[0].Defaults.DirURI)
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/profiles/site-b", `{"defaults":{"dir_uri":"hub.local"}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/profiles/site.b", `{}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/profiles/site-b", "").Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/profiles/site-a", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/profiles/site-a", "").Code)
+}
+
+func TestApplyProfile(t *testing.T) {
+	t.Parallel()
+
+	profile := &service.Profile{Name: "site-a", Defaults: service.FirmwareRequest{
+		SSID:   "site-wifi",
+		DirURI: "https://hub.site-a:8443",
+	}}
+	req := &service.FirmwareRequest{SSID: "other-wifi", PWD: "mypassword", Profile: "site-a"}
+	req.ApplyProfile(profile)
+	assert.Equal(t, "other-wifi", req.SSID)
+	assert.Equal(t, "mypassword", req.PWD)
+	assert.Equal(t, "https://hub.site-a:8443", req.DirURI)
+	assert.NoError(t, req.Validate())
+
+	req.LiquidAddress = strings.Repeat("x", service.LiquidAddressSlot.Size()+1)
+	req.DirURI = "ftp://hub"
+	err := req.Validate()
+	assert.ErrorContains(t, err, "liquid_address")
+	assert.ErrorContains(t, err, "dir_uri")
+}
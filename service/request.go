@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/flashcrypt"
+	"github.com/rddl-network/dirigera2mqtt/otadata"
+	"github.com/rddl-network/dirigera2mqtt/partition"
+)
+
+// requestField links a text field of a FirmwareRequest to its slot
+type requestField struct {
+	name   string
+	value  *string
+	slot   Slot
+	secret bool
+}
+
+// fields lists the text fields of req. Certificates and keys have no size
+// limit here, they are checked once encoded. The boot slot and partition
+// table and the flash encryption key are not stored in slots.
+func (req *FirmwareRequest) fields() []requestField {
+	return []requestField{
+		{"ssid", &req.SSID, SSIDSlot, false},
+		{"pwd", &req.PWD, PasswordSlot, true},
+		{"liquid_address", &req.LiquidAddress, LiquidAddressSlot, false},
+		{"dir_auth_token", &req.DirAuthToken, DirAuthTokenSlot, true},
+		{"dir_uri", &req.DirURI, DirURISlot, false},
+		{"ca_cert", &req.CACert, Slot{}, false},
+		{"client_cert", &req.ClientCert, Slot{}, false},
+		{"client_key", &req.ClientKey, Slot{}, true},
+		{"boot_slot", &req.BootSlot, Slot{}, false},
+		{"partition_table", &req.PartitionTable, Slot{}, false},
+		{"flash_encryption_key", &req.FlashEncryptionKey, Slot{}, true},
+	}
+}
+
+func (req *FirmwareRequest) field(name string) *string {
+	for _, field := range req.fields() {
+		if field.name == name {
+			return field.value
+		}
+	}
+	return nil
+}
+
+// Validate reports every value of req that does not fit into its slot or is
+// malformed. Certificates are validated by ValidateCertificates.
+func (req *FirmwareRequest) Validate() error {
+	var errs []error
+	for _, field := range req.fields() {
+		if field.slot.Pattern != "" && len(*field.value) > field.slot.Size() {
+			errs = append(errs, fmt.Errorf("%s: %d bytes exceed the %d bytes reserved in the firmware", field.name, len(*field.value), field.slot.Size()))
+		}
+	}
+	if req.DirURI != "" {
+		if uri, err := url.Parse(req.DirURI); err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+			errs = append(errs, fmt.Errorf("dir_uri: %q is not a http:// or https:// URI", req.DirURI))
+		}
+	}
+	if req.BootSlot != "" {
+		if _, err := otadata.ParseSlot(req.BootSlot); err != nil {
+			errs = append(errs, fmt.Errorf("boot_slot: %w", err))
+		}
+	}
+	if req.PartitionTable != "" {
+		if _, err := parsePartitionTable(req.PartitionTable); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if req.FlashEncryptionKey != "" {
+		if _, err := req.flashEncryptionKey(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if req.ChipRevision != "" {
+		if _, err := req.chipRevision(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// chipRevision parses the chip revision of req
+func (req *FirmwareRequest) chipRevision() (esp.ChipRevision, error) {
+	rev, err := esp.ParseChipRevision(req.ChipRevision)
+	if err != nil {
+		return 0, fmt.Errorf("chip_revision: %w", err)
+	}
+	return rev, nil
+}
+
+// CheckChipRevision refuses a firmware running on revisions if req targets a
+// chip revision outside of them, with an esp.UnsupportedChipRevisionError.
+// Other errors report an invalid chip_revision.
+func (req *FirmwareRequest) CheckChipRevision(revisions esp.ChipRevisionRange) error {
+	if req.ChipRevision == "" {
+		return nil
+	}
+	rev, err := req.chipRevision()
+	if err != nil {
+		return err
+	}
+	return revisions.Check(rev)
+}
+
+// CheckSchema reports the fields set in req that are not listed in schema,
+// the request fields a firmware supports. An empty schema supports all.
+func (req *FirmwareRequest) CheckSchema(schema []string) error {
+	if len(schema) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, field := range req.fields() {
+		if *field.value != "" && !slices.Contains(schema, field.name) {
+			errs = append(errs, fmt.Errorf("%s: not supported by the firmware", field.name))
+		}
+	}
+	if req.Encrypt && !slices.Contains(schema, "encrypt") {
+		errs = append(errs, errors.New("encrypt: not supported by the firmware"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateSchema reports the names of schema that are no request fields
+func validateSchema(schema []string) error {
+	var req FirmwareRequest
+	var errs []error
+	for _, name := range schema {
+		if name != "encrypt" && req.field(name) == nil {
+			errs = append(errs, fmt.Errorf("schema: %q is no request field", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flashEncryptionKey decodes the flash encryption key of req
+func (req *FirmwareRequest) flashEncryptionKey() ([]byte, error) {
+	key, err := hex.DecodeString(req.FlashEncryptionKey)
+	if err != nil || len(key) != flashcrypt.KeySize {
+		return nil, fmt.Errorf("flash_encryption_key: must be %d hex digits", 2*flashcrypt.KeySize)
+	}
+	return key, nil
+}
+
+// parsePartitionTable parses and validates a CSV partition table placed at
+// the default offset
+func parsePartitionTable(csv string) (*partition.Table, error) {
+	table, err := partition.ParseCSV(strings.NewReader(csv), partition.DefaultOffset)
+	if err == nil {
+		err = table.Validate(partition.DefaultOffset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("partition_table: %w", err)
+	}
+	return table, nil
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rddl-network/dirigera2mqtt/esp"
 )
 
 func (s *Dirigera2MQTT) GetRouter() *gin.Engine {
@@ -18,29 +22,187 @@ func (s *Dirigera2MQTT) getFirmware(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid request body"})
 		return
 	}
-	ssid := req.SSID
-	pwd := req.PWD
-	liquidAddress := req.LiquidAddress
-	dirAuthToken := req.DirAuthToken
-	dirURI := req.DirURI
-	// Optional parameters can be used as needed
-
-	var filename string
-	var firmwareBytes []byte
-	switch mcu {
-	case "esp32c6":
-		firmwareBytes = s.firmwareESP32C6
-		filename = "dirigerac2mqtt_esp32c6.bin"
-	default:
+
+	fw, ok := s.firmwareFor(mcu)
+	if !ok {
 		c.String(404, "Resource not found, Firmware not supported")
 		return
 	}
-	fmt.Printf("Request: {mcu: %s, ssid: %s", mcu, ssid)
-	patchedFirmware := PatchFirmware(firmwareBytes[:], ssid, pwd, liquidAddress, dirAuthToken, dirURI, 0x20000)
-	ComputeAndSetFirmwareChecksum(patchedFirmware[:], 0x20000)
+	if fw.builder == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the " + mcu + " firmware is not loaded"})
+		return
+	}
+	if req.Profile != "" {
+		store, ok := s.profileStore(c)
+		if !ok {
+			return
+		}
+		profile, err := store.Get(req.Profile)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "profile " + req.Profile + ": " + err.Error()})
+			return
+		}
+		req.ApplyProfile(profile)
+	}
+	if err := req.CheckSchema(fw.Schema); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.CheckChipRevision(fw.revisions); err != nil {
+		status := 400
+		var unsupported *esp.UnsupportedChipRevisionError
+		if errors.As(err, &unsupported) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("msg", "firmware request", "mcu", mcu)
+	builder := fw.builder
+	// only builds embedding an identity are registered, others would leave
+	// identities in the registry that exist on no device
+	if builder.HasSlot(DeviceIdentitySlot) {
+		identity, err := NewDeviceIdentity()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "generating device identity: " + err.Error()})
+			return
+		}
+		req.Identity = identity
+	} else {
+		s.logger.Warn("msg", "firmware has no device identity slot, the build is not registered", "mcu", mcu)
+	}
+	build, cacheStatus, err := s.buildFirmware(builder, &req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var invalid *RequestError
+		if errors.As(err, &invalid) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.Header("Content-Disposition", "attachment; filename="+filename)
-	c.Data(http.StatusOK, "application/octet-stream", patchedFirmware[:])
+	if req.Identity != nil {
+		device, err := s.recordDevice(fw, &req, build.SHA256)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "registering device: " + err.Error()})
+			return
+		}
+		c.Header("X-Device-ID", device.ID)
+	}
+	c.Header("X-Build-Cache", cacheStatus)
+	c.Header("X-Firmware-MD5", build.MD5)
+	setAppDescHeaders(c, fw.appDesc())
+	c.Header("Content-Disposition", "attachment; filename="+fw.Filename)
+	c.Header("Content-Length", strconv.Itoa(build.Build.Len()))
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+	_, _ = build.Build.WriteTo(c.Writer)
+}
+
+// setAppDescHeaders describes the app of a build in X-Firmware-* headers.
+// Patching leaves the descriptor untouched, so it is the one of the base.
+func setAppDescHeaders(c *gin.Context, desc *esp.AppDesc) {
+	if desc == nil {
+		return
+	}
+	c.Header("X-Firmware-Project", desc.ProjectName)
+	c.Header("X-Firmware-Version", desc.Version)
+	c.Header("X-Firmware-Secure-Version", strconv.FormatUint(uint64(desc.SecureVersion), 10))
+	c.Header("X-Firmware-Compile-Time", desc.Date+" "+desc.Time)
+	c.Header("X-Firmware-IDF-Version", desc.IDFVersion)
+	c.Header("X-Firmware-ELF-SHA256", desc.ELFSHA256)
+}
+
+// buildFirmware builds req or takes the result from the build cache. Builds
+// with a device identity or opted out of caching bypass the cache.
+func (s *Dirigera2MQTT) buildFirmware(builder *FirmwareBuilder, req *FirmwareRequest) (*CachedBuild, string, error) {
+	cacheable := s.buildCache != nil && !req.NoCache && req.Identity == nil
+	var key string
+	if cacheable {
+		key = s.buildCache.Key(builder.Digest, req)
+		if build, ok := s.buildCache.Get(key); ok {
+			// certificates expire while their builds are cached
+			if _, err := ValidateCertificates(req.CACert, req.ClientCert, req.ClientKey, time.Now()); err != nil {
+				return nil, "", &RequestError{Err: err}
+			}
+			return build, "HIT", nil
+		}
+	}
+	firmware, err := builder.Build(req)
+	if err != nil {
+		return nil, "", err
+	}
+	build := &CachedBuild{Build: firmware}
+	build.MD5, build.SHA256 = firmware.Digests()
+	if !cacheable {
+		return build, "BYPASS", nil
+	}
+	s.buildCache.Put(key, build)
+	return build, "MISS", nil
+}
+
+// inspectFirmware reads back the provisioned settings of an uploaded image.
+// The image is sent as request body; the query parameters select the base
+// firmware (mcu, the first one of the registry by default) and whether secrets are revealed (reveal=true).
+func (s *Dirigera2MQTT) inspectFirmware(c *gin.Context) {
+	mcu := c.Query("mcu")
+	if mcu == "" && len(s.mcus) > 0 {
+		mcu = s.mcus[0].Name
+	}
+	fw, ok := s.firmwareFor(mcu)
+	if !ok {
+		c.String(404, "Resource not found, Firmware not supported")
+		return
+	}
+	image, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	report, err := InspectFirmware(fw.base, image, fw.AppOffset(), c.Query("reveal") == "true")
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// FirmwareInfo describes a firmware offered by the service
+type FirmwareInfo struct {
+	MCU      string `json:"mcu"`
+	Filename string `json:"filename"`
+	Version  string `json:"version,omitempty"`
+	Project  string `json:"project,omitempty"`
+	// Chip is the chip family named by the image header, with what web
+	// flashers need to detect it and read its revision
+	Chip *esp.Chip `json:"chip,omitempty"`
+	// ChipRevisions is the range of chip revisions the firmware runs on
+	ChipRevisions *esp.ChipRevisionRange `json:"chip_revisions,omitempty"`
+	// Schema lists the request fields the firmware supports, empty if it
+	// supports all
+	Schema []string `json:"schema,omitempty"`
+	// AppDesc is the complete application descriptor of the app
+	AppDesc *esp.AppDesc `json:"app_desc,omitempty"`
+}
+
+// listFirmware lists the enabled MCUs of the registry in configuration order
+func (s *Dirigera2MQTT) listFirmware(c *gin.Context) {
+	infos := []FirmwareInfo{}
+	for _, fw := range s.mcus {
+		info := FirmwareInfo{MCU: fw.Name, Filename: fw.Filename, Schema: fw.Schema}
+		if fw.app != nil {
+			info.Chip = fw.app.Chip
+			info.ChipRevisions = &fw.revisions
+		}
+		if desc := fw.appDesc(); desc != nil {
+			info.Version = desc.Version
+			info.Project = desc.ProjectName
+			info.AppDesc = desc
+		}
+		infos = append(infos, info)
+	}
+	c.JSON(http.StatusOK, infos)
 }
 
 func (s *Dirigera2MQTT) GetRoutes() gin.RoutesInfo {
@@ -1,19 +1,175 @@
 package service_test
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/esp"
+	"github.com/rddl-network/dirigera2mqtt/registry"
 	"github.com/rddl-network/dirigera2mqtt/service"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTestnetModeTrue(t *testing.T) {
 	cfg := config.DefaultConfig()
 
-	s := service.NewTrustAnchorAttestationService(cfg)
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
 
 	routes := s.GetRoutes()
-	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, 12, len(routes))
+}
+
+func TestUIAndCatalog(t *testing.T) {
+	cfg := config.DefaultConfig()
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, w.Body.String(), "Dirigera2MQTT Bridge Provisioning")
+
+	w = httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/firmware", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var firmwares []service.FirmwareInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &firmwares))
+	assert.Equal(t, "esp32c6", firmwares[0].MCU)
+
+	info := service.FirmwareInfo{MCU: "esp32c6", ChipRevisions: &esp.ChipRevisionRange{Min: 0, Max: esp.NewChipRevision(0, 99)}}
+	encoded, err := json.Marshal(info)
+	assert.NoError(t, err)
+	var decoded service.FirmwareInfo
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, info, decoded)
+}
+
+func TestDeviceEndpoints(t *testing.T) {
+	cfg := config.DefaultConfig()
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
+	store := registry.NewMemoryStore()
+	now := time.Now().UTC()
+	assert.NoError(t, store.Put(registry.Device{ID: "a1", MCU: "esp32c6", DirURI: "https://hub-1", CreatedAt: now, UpdatedAt: now}))
+	assert.NoError(t, store.Put(registry.Device{ID: "b2", MCU: "esp32c6", DirURI: "https://hub-2", CreatedAt: now.Add(time.Second), UpdatedAt: now}))
+	s.SetRegistry(store)
+
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.GetRouter().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	var devices []registry.Device
+	w := serve(http.MethodGet, "/devices?q=hub-2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &devices))
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, "b2", devices[0].ID)
+
+	w = serve(http.MethodPost, "/devices/a1/revoke")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var device registry.Device
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &device))
+	assert.True(t, device.Revoked())
+
+	w = serve(http.MethodGet, "/devices")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &devices))
+	assert.Equal(t, 1, len(devices))
+	w = serve(http.MethodGet, "/devices?include_revoked=true")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &devices))
+	assert.Equal(t, 2, len(devices))
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/devices/b2").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/devices/unknown").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/devices/unknown/revoke").Code)
+}
+
+func TestMCURegistryCatalog(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.MCURegistry = filepath.Join(t.TempDir(), "mcus.json")
+	assert.NoError(t, os.WriteFile(cfg.MCURegistry, []byte(`{"mcus": [
+		{"name": "esp32s3", "firmware": "s3.bin", "app-offsets": [65536], "schema": ["ssid", "pwd"]},
+		{"name": "esp32c6", "firmware": "c6.bin", "app-offsets": [131072], "enabled": false}
+	]}`), 0o600))
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/firmware", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var firmwares []service.FirmwareInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &firmwares))
+	assert.Equal(t, []service.FirmwareInfo{
+		{MCU: "esp32s3", Filename: "dirigera2mqtt_esp32s3.bin", Schema: []string{"ssid", "pwd"}},
+	}, firmwares)
+
+	w = httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/firmware/esp32c6", strings.NewReader("{}")))
+	assert.Equal(t, http.StatusNotFound, w.Code, "disabled MCUs are not served")
+
+	req := service.FirmwareRequest{SSID: "mynetwork", DirURI: "https://dirigera.local", Encrypt: true}
+	assert.NoError(t, req.CheckSchema(nil))
+	err = req.CheckSchema([]string{"ssid", "pwd"})
+	assert.ErrorContains(t, err, "dir_uri: not supported by the firmware")
+	assert.ErrorContains(t, err, "encrypt: not supported by the firmware")
+	assert.NotContains(t, err.Error(), "ssid")
+
+	cfg.MCURegistry = filepath.Join(t.TempDir(), "mcus.json")
+	assert.NoError(t, os.WriteFile(cfg.MCURegistry, []byte(`{"mcus": [
+		{"name": "esp32c6", "firmware": "c6.bin", "app-offsets": [131072], "enabled": false}
+	]}`), 0o600))
+	_, err = service.NewTrustAnchorAttestationService(cfg)
+	assert.ErrorContains(t, err, "enables no MCU")
+}
+
+func downloadFirmware(t *testing.T, firmware string) (http.Header, *registry.MemoryStore) {
+	cfg := config.DefaultConfig()
+	cfg.FirmwareESP32C6 = firmware
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.LoadFirmwares())
+	store := registry.NewMemoryStore()
+	s.SetRegistry(store)
+
+	body := `{"ssid": "mynetwork", "pwd": "secret", "liquid_address": "tlq1qq"}`
+	w := httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/firmware/esp32c6", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return w.Header(), store
+}
+
+func TestFirmwareDownloadIsRegistered(t *testing.T) {
+	firmware := filepath.Join(t.TempDir(), "firmware.bin")
+	require.NoError(t, os.WriteFile(firmware, baseWithAllSlots(t), 0o600))
+	header, store := downloadFirmware(t, firmware)
+	id := header.Get("X-Device-ID")
+	require.NotEmpty(t, id)
+
+	device, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, "esp32c6", device.MCU)
+	assert.Equal(t, "tlq1qq", device.LiquidAddress)
+	assert.NotEmpty(t, device.OutputHash)
+	assert.NotEmpty(t, device.PublicKey)
+}
+
+func TestFirmwareDownloadWithoutIdentitySlotIsNotRegistered(t *testing.T) {
+	// the shipped firmware has no device identity slot
+	header, store := downloadFirmware(t, "../test/energy-intelligence-bridge.bin")
+	assert.Empty(t, header.Get("X-Device-ID"))
+	devices, err := store.List(registry.Query{})
+	require.NoError(t, err)
+	assert.Empty(t, devices)
 }
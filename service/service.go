@@ -1,18 +1,28 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/registry"
 	"github.com/rddl-network/go-utils/logger"
 )
 
 type Dirigera2MQTT struct {
-	cfg             *config.Config
-	router          *gin.Engine
-	logger          logger.AppLogger
-	firmwareESP32C6 []byte
+	cfg        *config.Config
+	router     *gin.Engine
+	logger     logger.AppLogger
+	mcus       []*mcuFirmware
+	registry   registry.Store
+	profiles   *ProfileStore
+	buildCache *BuildCache
 }
 type FirmwareRequest struct {
 	SSID          string `json:"ssid"`
@@ -20,12 +30,51 @@ type FirmwareRequest struct {
 	LiquidAddress string `json:"liquid_address,omitempty"`
 	DirAuthToken  string `json:"dir_auth_token,omitempty"`
 	DirURI        string `json:"dir_uri,omitempty"`
+	CACert        string `json:"ca_cert,omitempty"`
+	ClientCert    string `json:"client_cert,omitempty"`
+	ClientKey     string `json:"client_key,omitempty"`
+	// BootSlot selects the app partition the device boots, factory or ota_<n>;
+	// empty keeps the otadata of the base firmware
+	BootSlot string `json:"boot_slot,omitempty"`
+	// PartitionTable is an ESP-IDF CSV partition table replacing the one of
+	// the base firmware
+	PartitionTable string `json:"partition_table,omitempty"`
+	// Encrypt returns the firmware pre-encrypted for flash encryption in
+	// development mode, with FlashEncryptionKey or the configured key
+	Encrypt bool `json:"encrypt,omitempty"`
+	// FlashEncryptionKey is the hex encoded XTS-AES-128 key of the device;
+	// setting it implies Encrypt
+	FlashEncryptionKey string `json:"flash_encryption_key,omitempty"`
+	// ChipRevision is the revision of the target chip, e.g. v0.1; firmwares
+	// that cannot run on it are refused
+	ChipRevision string `json:"chip_revision,omitempty"`
+	// Profile names a profile providing the values of all empty fields
+	Profile string `json:"profile,omitempty"`
+	// NoCache keeps one-time credentials out of the build cache
+	NoCache bool `json:"no_cache,omitempty"`
+	// Identity is generated by the service and never taken from a request
+	Identity *DeviceIdentity `json:"-"`
 }
 
-func NewTrustAnchorAttestationService(cfg *config.Config) *Dirigera2MQTT {
+// NewTrustAnchorAttestationService sets up the service for the MCU registry
+// of cfg. Their firmwares are loaded by Run.
+func NewTrustAnchorAttestationService(cfg *config.Config) (*Dirigera2MQTT, error) {
+	mcus, err := enabledMCUs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("mcu registry: %w", err)
+	}
 	service := &Dirigera2MQTT{
-		cfg:    cfg,
-		logger: logger.GetLogger(cfg.LogLevel),
+		cfg:      cfg,
+		logger:   logger.GetLogger(cfg.LogLevel),
+		mcus:     mcus,
+		registry: registry.NewMemoryStore(),
+	}
+	if cfg.BuildCacheSize > 0 {
+		cache, err := NewBuildCache(cfg.BuildCacheSize)
+		if err != nil {
+			service.logger.Error("msg", "build cache disabled", "error", err)
+		}
+		service.buildCache = cache
 	}
 
 	gin.SetMode(gin.ReleaseMode)
@@ -33,37 +82,111 @@ func NewTrustAnchorAttestationService(cfg *config.Config) *Dirigera2MQTT {
 	// CORS middleware
 	service.router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Firmware-MD5, X-Firmware-Project, X-Firmware-Version, X-Firmware-Secure-Version, X-Firmware-Compile-Time, X-Firmware-IDF-Version, X-Firmware-ELF-SHA256, X-Device-ID, X-Build-Cache, Content-Disposition")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
 		}
 		c.Next()
 	})
+	service.router.Use(func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxBodySize)
+		c.Next()
+	})
+	service.router.GET("/", service.getUI)
+	service.router.GET("/firmware", service.listFirmware)
+	service.router.POST("/firmware/inspect", service.inspectFirmware)
 	service.router.POST("/firmware/:mcu", service.getFirmware)
+	service.router.GET("/devices", service.listDevices)
+	service.router.GET("/devices/:id", service.getDevice)
+	service.router.POST("/devices/:id/revoke", service.revokeDevice)
+	service.router.GET("/profiles", service.listProfiles)
+	service.router.GET("/profiles/:name", service.getProfile)
+	service.router.PUT("/profiles/:name", service.putProfile)
+	service.router.DELETE("/profiles/:name", service.deleteProfile)
+	service.router.GET("/build-cache", service.getBuildCacheStats)
 
-	return service
+	return service, nil
+}
+
+// SetRegistry replaces the store provisioned devices are recorded in
+func (s *Dirigera2MQTT) SetRegistry(store registry.Store) {
+	s.registry = store
+}
+
+// SetProfiles sets the store of provisioning profiles
+func (s *Dirigera2MQTT) SetProfiles(store *ProfileStore) {
+	s.profiles = store
 }
 
 func (s *Dirigera2MQTT) Run() (err error) {
-	s.loadFirmwares()
-	err = s.startWebService()
-	if err != nil {
-		fmt.Print(err.Error())
+	if err = s.LoadFirmwares(); err != nil {
+		return err
+	}
+	if s.cfg.ProfilesDir != "" {
+		store, err := NewProfileStore(s.cfg.ProfilesDir)
+		if err != nil {
+			return fmt.Errorf("opening profiles: %w", err)
+		}
+		s.SetProfiles(store)
+	}
+	if s.cfg.RegistryPath != "" {
+		store, err := registry.OpenBoltStore(s.cfg.RegistryPath)
+		if err != nil {
+			return fmt.Errorf("opening device registry: %w", err)
+		}
+		defer store.Close()
+		s.SetRegistry(store)
 	}
-	return err
-}
 
-func (s *Dirigera2MQTT) loadFirmwares() {
-	s.firmwareESP32C6 = loadFirmware(s.cfg.FirmwareESP32C6)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return s.startWebService(ctx)
 }
 
-func (s *Dirigera2MQTT) startWebService() error {
+func (s *Dirigera2MQTT) startWebService(ctx context.Context) error {
 	addr := fmt.Sprintf("%s:%d", s.cfg.ServiceBind, s.cfg.ServicePort)
-	err := s.router.Run(addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve handles requests on listener until ctx is done. In-flight requests
+// get the configured shutdown timeout to finish before their connections are
+// closed.
+func (s *Dirigera2MQTT) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           s.router,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
 
-	return err
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	s.logger.Info("msg", "shutting down, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		_ = server.Close()
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 //func (s *Dirigera2MQTT) getFirmware(c *gin.Context) {
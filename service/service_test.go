@@ -0,0 +1,77 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rddl-network/dirigera2mqtt/config"
+	"github.com/rddl-network/dirigera2mqtt/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeAndShutdown(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.MaxBodySize = 1024
+	cfg.ShutdownTimeout = 5 * time.Second
+	s, err := service.NewTrustAnchorAttestationService(cfg)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	s.GetRouter().GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	base := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, listener)
+	}()
+
+	response, err := http.Get(base + "/firmware")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = http.Post(base+"/firmware/inspect", "application/octet-stream", strings.NewReader(strings.Repeat("x", 2048)))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// a request in flight when the shutdown starts is still answered
+	slow := make(chan string, 1)
+	go func() {
+		response, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		slow <- string(body)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(cfg.ShutdownTimeout):
+		t.Fatal("service did not shut down")
+	}
+	assert.Equal(t, "done", <-slow)
+
+	_, err = http.Get(base + "/firmware")
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Slot describes a placeholder region reserved inside the firmware image. The
+// firmware is built with the marker text padded with spaces to the slot size,
+// which is what gets searched for and replaced while patching.
+type Slot struct {
+	Name    string
+	Pattern string
+	Secret  bool
+}
+
+func newSlot(name string, marker string, size int, secret bool) Slot {
+	return Slot{
+		Name:    name,
+		Pattern: marker + strings.Repeat(" ", size-len(marker)),
+		Secret:  secret,
+	}
+}
+
+// Size returns the number of bytes reserved by the slot.
+func (s Slot) Size() int {
+	return len(s.Pattern)
+}
+
+var (
+	SSIDSlot          = newSlot("ssid", "WIFI SSID", 64, false)
+	PasswordSlot      = newSlot("pwd", "WIFI PASSWORD", 64, true)
+	LiquidAddressSlot = newSlot("liquid_address", "LIQUID ADDRESS", 64, false)
+	DirAuthTokenSlot  = newSlot("dir_auth_token", "DIRIGERA TOKEN", 512, true)
+	DirURISlot        = newSlot("dir_uri", "DIRIGERA URI", 64, false)
+	CACertSlot        = newSlot("ca_cert", "MQTT CA CERT", 4096, false)
+	ClientCertSlot    = newSlot("client_cert", "MQTT CLIENT CERT", 2048, false)
+	ClientKeySlot     = newSlot("client_key", "MQTT CLIENT KEY", 2048, true)
+	// DeviceIdentitySlot holds the per-device ID and Ed25519 key, see DeviceIdentity
+	DeviceIdentitySlot = newSlot("device_identity", "DEVICE IDENTITY", 128, true)
+)
+
+// Slots lists every placeholder slot known to the firmware.
+var Slots = []Slot{
+	SSIDSlot,
+	PasswordSlot,
+	LiquidAddressSlot,
+	DirAuthTokenSlot,
+	DirURISlot,
+	CACertSlot,
+	ClientCertSlot,
+	ClientKeySlot,
+	DeviceIdentitySlot,
+}
+
+// SlotLocation reports where a placeholder slot was found in an image.
+type SlotLocation struct {
+	Slot   Slot
+	Offset int
+}
+
+// FindSlots returns the location of every placeholder slot that is still
+// unpatched in image. Slots that are not present are omitted.
+func FindSlots(image []byte) (locations []SlotLocation) {
+	for _, slot := range Slots {
+		if i := bytes.Index(image, []byte(slot.Pattern)); i >= 0 {
+			locations = append(locations, SlotLocation{Slot: slot, Offset: i})
+		}
+	}
+	return
+}
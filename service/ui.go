@@ -0,0 +1,21 @@
+package service
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// getUI serves the self-service provisioning page
+func (s *Dirigera2MQTT) getUI(c *gin.Context) {
+	page, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "UI not available")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}